@@ -4,16 +4,23 @@ import (
 	"bytes"
 	"context"
 	cryptoRand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/smtp"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -21,8 +28,10 @@ import (
 
 	"golang.org/x/oauth2"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
+
+	"protocolgen/protocol"
 )
 
 /* ======================================================
@@ -105,6 +114,18 @@ func validatePassword(p string) error {
 
 type App struct {
 	db *sql.DB
+
+	// Sessions end this long after sign-in, or after this long without a
+	// request, whichever comes first.
+	sessionMaxAge      time.Duration
+	sessionIdleTimeout time.Duration
+
+	// Who may create an account, and whether it needs approval first.
+	signupPolicy signupPolicy
+
+	// Outgoing mail, and the public address links in it point at.
+	mailer  Mailer
+	baseURL string
 }
 
 type User struct {
@@ -113,16 +134,57 @@ type User struct {
 	CreatedAt  time.Time `json:"created_at"`
 	IsAdmin    bool      `json:"is_admin"`
 	IsApproved bool      `json:"is_approved"`
+	IsReviewer bool      `json:"is_reviewer"`
 }
 
 type Protocol struct {
-	ID        int64     `json:"id"`
-	Name      string    `json:"name"`
-	Data      string    `json:"data,omitempty"` // omit in list
-	CreatedAt time.Time `json:"created_at"`
-	IsPublic  bool      `json:"is_public"`
+	ID        int64              `json:"id"`
+	Name      string             `json:"name"`
+	Data      *protocol.Document `json:"data,omitempty"` // omit in list
+	CreatedAt time.Time          `json:"created_at"`
+	IsPublic  bool               `json:"is_public"` // visible to every signed-in user
+	Version   int                `json:"version"`
+	// Who can read it: private, team, organization or public.
+	Visibility string `json:"visibility"`
+	Status     string `json:"status"`
+	// Latest version a reviewer approved; only it may go to Xtract.
+	ApprovedVersion *int `json:"approved_version,omitempty"`
+	// Protocol (and version of it) this one was forked from.
+	ForkedFrom *ProtocolRef `json:"forked_from,omitempty"`
+	ForkCount  int          `json:"fork_count"`
+	// Team that owns it, if any; its owners and editors can edit it.
+	TeamID   *int64 `json:"team_id,omitempty"`
+	TeamName string `json:"team_name,omitempty"`
+	// Set when the viewer reads it through a share: "read" or "edit".
+	SharedWithMe string `json:"shared_with_me,omitempty"`
+	// Whether the viewer owns it (see protocolOwnedBy) and so may change
+	// its visibility, share it, move it or delete it.
+	CanManage bool `json:"can_manage"`
+}
+
+// ProtocolRef points at one version of a protocol.
+type ProtocolRef struct {
+	ID      int64  `json:"id"`
+	Version int    `json:"version"`
+	Name    string `json:"name,omitempty"`
 }
 
+// Protocol visibility levels (protocols.visibility), narrowest first.
+const (
+	visibilityPrivate      = "private"      // owner only
+	visibilityTeam         = "team"         // members of the owning team
+	visibilityOrganization = "organization" // every signed-in user
+	visibilityPublic       = "public"       // anyone, including signed-out readers
+)
+
+// Protocol lifecycle states (protocols.status).
+const (
+	statusDraft    = "draft"
+	statusInReview = "in_review"
+	statusApproved = "approved"
+	statusRetired  = "retired"
+)
+
 /* ======================================================
    Main
    ====================================================== */
@@ -177,6 +239,113 @@ func main() {
         config_json TEXT NOT NULL,           -- full JSON blob used by UI
         standard_order INTEGER               -- 1,2,3,... for your default set (nullable)
     );
+
+    CREATE TABLE IF NOT EXISTS protocol_test_cases (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        protocol_id INTEGER NOT NULL,
+        name TEXT NOT NULL,
+        case_json TEXT NOT NULL,             -- grid, edits and expected rows
+        created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE(protocol_id, name),
+        FOREIGN KEY(protocol_id) REFERENCES protocols(id) ON DELETE CASCADE
+    );
+
+    -- Append-only history; protocols.data is a copy of the head version
+    CREATE TABLE IF NOT EXISTS protocol_versions (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        protocol_id INTEGER NOT NULL,
+        version_number INTEGER NOT NULL,
+        name TEXT NOT NULL,
+        data TEXT NOT NULL,
+        author_id INTEGER,                   -- NULL once the author's account is deleted
+        restored_from INTEGER,               -- version this one was restored from
+        created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE(protocol_id, version_number),
+        FOREIGN KEY(protocol_id) REFERENCES protocols(id) ON DELETE CASCADE,
+        FOREIGN KEY(author_id) REFERENCES users(id) ON DELETE SET NULL
+    );
+
+    -- Audit of lifecycle transitions (draft / in_review / approved / retired)
+    CREATE TABLE IF NOT EXISTS protocol_status_events (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        protocol_id INTEGER NOT NULL,
+        version_number INTEGER NOT NULL,
+        from_status TEXT NOT NULL,
+        to_status TEXT NOT NULL,
+        actor_id INTEGER,                    -- NULL once the actor's account is deleted
+        comment TEXT NOT NULL DEFAULT '',
+        created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY(protocol_id) REFERENCES protocols(id) ON DELETE CASCADE,
+        FOREIGN KEY(actor_id) REFERENCES users(id) ON DELETE SET NULL
+    );
+
+    -- Teams share ownership of protocols and column presets
+    CREATE TABLE IF NOT EXISTS teams (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        name TEXT NOT NULL,
+        created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+    );
+
+    CREATE TABLE IF NOT EXISTS team_members (
+        team_id INTEGER NOT NULL,
+        user_id INTEGER NOT NULL,
+        role TEXT NOT NULL,                  -- owner, editor or viewer
+        added_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY(team_id, user_id),
+        FOREIGN KEY(team_id) REFERENCES teams(id) ON DELETE CASCADE,
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+
+    CREATE TABLE IF NOT EXISTS protocol_shares (
+        protocol_id INTEGER NOT NULL,
+        user_id INTEGER NOT NULL,            -- who it is shared with
+        permission TEXT NOT NULL,            -- read or edit
+        granted_by INTEGER,
+        created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY(protocol_id, user_id),
+        FOREIGN KEY(protocol_id) REFERENCES protocols(id) ON DELETE CASCADE,
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+        FOREIGN KEY(granted_by) REFERENCES users(id) ON DELETE SET NULL
+    );
+
+    CREATE TABLE IF NOT EXISTS protocol_share_links (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        token TEXT NOT NULL UNIQUE,          -- same generator as session ids
+        protocol_id INTEGER NOT NULL,
+        created_by INTEGER,
+        created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        expires_at DATETIME,                 -- NULL = never
+        revoked_at DATETIME,
+        last_used_at DATETIME,
+        FOREIGN KEY(protocol_id) REFERENCES protocols(id) ON DELETE CASCADE,
+        FOREIGN KEY(created_by) REFERENCES users(id) ON DELETE SET NULL
+    );
+
+    CREATE TABLE IF NOT EXISTS invitations (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        token_hash TEXT NOT NULL UNIQUE,     -- sha256 of the invite code, hex
+        email TEXT NOT NULL,                 -- the only address that may redeem it
+        role TEXT NOT NULL,                  -- user, reviewer or admin
+        created_by INTEGER,
+        created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        expires_at DATETIME NOT NULL,
+        revoked_at DATETIME,
+        redeemed_at DATETIME,
+        redeemed_by INTEGER,
+        FOREIGN KEY(created_by) REFERENCES users(id) ON DELETE SET NULL,
+        FOREIGN KEY(redeemed_by) REFERENCES users(id) ON DELETE SET NULL
+    );
+
+    CREATE TABLE IF NOT EXISTS password_resets (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        token_hash TEXT NOT NULL UNIQUE,     -- sha256 of the emailed token, hex
+        user_id INTEGER NOT NULL,
+        created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        expires_at DATETIME NOT NULL,
+        used_at DATETIME,
+        FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+    );
 `)
 
 	if err != nil {
@@ -206,6 +375,44 @@ func main() {
 		log.Fatal("migration error (ai usage column):", err)
 	}
 
+	if err := ensureProtocolVersions(db); err != nil {
+		log.Fatal("migration error (protocol versions):", err)
+	}
+
+	if err := ensureProtocolLifecycleColumns(db); err != nil {
+		log.Fatal("migration error (protocol lifecycle):", err)
+	}
+
+	if err := ensureProtocolDeletedAt(db); err != nil {
+		log.Fatal("migration error (protocol trash):", err)
+	}
+
+	if err := ensureProtocolForkColumns(db); err != nil {
+		log.Fatal("migration error (protocol forks):", err)
+	}
+
+	if err := ensureProtocolVisibility(db); err != nil {
+		log.Fatal("migration error (protocol visibility):", err)
+	}
+
+	if err := ensureTeamColumns(db); err != nil {
+		log.Fatal("migration error (teams):", err)
+	}
+
+	if err := ensureHistoryOutlivesUsers(db); err != nil {
+		log.Fatal("migration error (history authors):", err)
+	}
+
+	if err := ensureInvitationTokenHashes(db); err != nil {
+		log.Fatal("migration error (invitation tokens):", err)
+	}
+
+	if n, err := upgradeStoredProtocols(db); err != nil {
+		log.Fatal("migration error (protocol format):", err)
+	} else if n > 0 {
+		log.Printf("upgraded %d stored protocol document(s) to format %d", n, protocol.FormatVersion)
+	}
+
 	// Make Ocean admin automatically (optional)
 
 	// Make Ocean admin automatically (optional)
@@ -218,7 +425,25 @@ func main() {
 	}
 
 	app := &App{
-		db: db,
+		db:                 db,
+		sessionMaxAge:      durationFromEnv("SESSION_MAX_AGE_HOURS", time.Hour, defaultSessionMaxAge),
+		sessionIdleTimeout: durationFromEnv("SESSION_IDLE_TIMEOUT_MINUTES", time.Minute, defaultSessionIdleTimeout),
+		signupPolicy:       signupPolicyFromEnv(),
+		mailer:             mailerFromEnv(),
+		baseURL:            strings.TrimRight(os.Getenv("APP_BASE_URL"), "/"),
+	}
+	if app.baseURL == "" {
+		// Never taken from the Host header: a forged one would send reset
+		// links to someone else's server.
+		app.baseURL = "http://localhost:8080"
+		if isProd() {
+			log.Printf("APP_BASE_URL is not set; emailed links will point at %s", app.baseURL)
+		}
+	}
+	log.Printf("signup policy: %s", app.signupPolicy.mode)
+
+	if err := ensureSessionColumns(db, app.sessionMaxAge); err != nil {
+		log.Fatal("migration error (sessions):", err)
 	}
 
 	// Serve your static UI
@@ -244,6 +469,7 @@ func main() {
 
 	// Auth endpoints
 	http.HandleFunc("/signup", app.handleSignup)
+	http.HandleFunc("/signup/policy", app.handleSignupPolicy)
 	http.HandleFunc("/login", app.handleLogin)
 	http.HandleFunc("/logout", app.handleLogout)
 	http.HandleFunc("/me", app.handleMe)
@@ -251,6 +477,10 @@ func main() {
 	http.HandleFunc("/oauth/callback", app.handleOktaCallback)
 	http.HandleFunc("/logout/okta", app.handleOktaLogout)
 
+	// Forgotten password: email a reset link, then set a new password
+	http.HandleFunc("/forgot-password", app.handleForgotPassword)
+	http.Handle("/reset-password", withSecurityHeaders(http.HandlerFunc(app.handleResetPassword)))
+
 	// User self-service password change
 	http.Handle("/change-password",
 		app.requireAuth(http.HandlerFunc(app.handleChangePassword)),
@@ -269,13 +499,79 @@ func main() {
 		app.requireAuth(app.requireAdmin(http.HandlerFunc(app.handleAdminDemote))),
 	)
 
+	http.Handle("/admin/reviewer",
+		app.requireAuth(app.requireAdmin(http.HandlerFunc(app.handleAdminSetReviewer))),
+	)
+
 	// Admin API
 	http.Handle("/admin/reset-password",
 		app.requireAuth(app.requireAdmin(http.HandlerFunc(app.handleAdminResetPassword))),
 	)
-	// Protocol endpoints (save/list/get)
+	// Protocol endpoints (save/list/get); kept for the builder and old scripts
 	http.HandleFunc("/api/protocols", app.handleProtocols)
 
+	// Protocol API v1 (REST verbs, id in the path, JSON errors)
+	http.HandleFunc("/api/v1/protocols", app.handleV1Protocols)
+	http.HandleFunc("/api/v1/protocols/{id}", app.handleV1Protocol)
+	http.HandleFunc("/api/v1/protocols/{id}/publish", app.handleV1PublishProtocol)
+	http.HandleFunc("/api/v1/protocols/{id}/unpublish", app.handleV1UnpublishProtocol)
+
+	// Protocol test cases (list/save/delete) and running them
+	http.HandleFunc("/api/protocols/{id}/tests", app.handleProtocolTestCases)
+	http.HandleFunc("/api/protocols/{id}/test", app.handleRunProtocolTests)
+
+	// Protocol version history
+	http.HandleFunc("/api/protocols/{id}/versions", app.handleProtocolVersions)
+	http.HandleFunc("/api/protocols/{id}/versions/{version}", app.handleProtocolVersion)
+	http.HandleFunc("/api/protocols/{id}/versions/{version}/restore", app.handleRestoreProtocolVersion)
+	http.HandleFunc("/api/protocols/{id}/diff", app.handleProtocolDiff)
+
+	// Protocol trash (soft-deleted protocols) and restoring from it
+	http.HandleFunc("/api/protocols/trash", app.handleProtocolTrash)
+	http.HandleFunc("/api/protocols/{id}/restore", app.handleRestoreProtocol)
+
+	// Who can see a protocol (private / team / organization / public)
+	http.HandleFunc("/api/protocols/{id}/visibility", app.handleProtocolVisibility)
+
+	// Forking a protocol and listing who forked it
+	http.HandleFunc("/api/protocols/{id}/fork", app.handleForkProtocol)
+	http.HandleFunc("/api/protocols/{id}/forks", app.handleProtocolForks)
+
+	// Protocol lifecycle: submit / approve / reject / retire / reopen, plus audit
+	http.HandleFunc("/api/protocols/{id}/transitions", app.handleProtocolTransitions)
+
+	// Teams: membership and moving protocols into a team
+	http.HandleFunc("/api/teams", app.handleTeams)
+	http.HandleFunc("/api/teams/{id}/members", app.handleTeamMembers)
+	http.HandleFunc("/api/teams/{id}/members/{userId}", app.handleRemoveTeamMember)
+	http.HandleFunc("/api/protocols/{id}/team", app.handleProtocolTeam)
+
+	// Sharing a protocol with individual users
+	http.HandleFunc("/api/protocols/{id}/shares", app.handleProtocolShares)
+	http.HandleFunc("/api/protocols/{id}/shares/{userId}", app.handleRevokeProtocolShare)
+
+	// Canonical Xtract JSON of the approved version, for downstream systems
+	http.HandleFunc("/api/protocols/{id}/export", app.handleExportProtocol)
+
+	// JSON Schema of the protocol format (public)
+	http.HandleFunc("/api/schema/protocol.json", app.handleProtocolSchema)
+
+	// Import hand-written Xtract JSON as an editable protocol
+	http.HandleFunc("/api/protocols/import", app.handleImportProtocol)
+
+	// Share links: read-only access for people without an account
+	http.HandleFunc("/api/protocols/{id}/links", app.handleProtocolShareLinks)
+	http.HandleFunc("/api/protocols/{id}/links/{linkId}", app.handleRevokeProtocolShareLink)
+	http.HandleFunc("/api/shared/{token}", app.handleSharedProtocol)
+	http.HandleFunc("/api/shared/{token}/export", app.handleSharedProtocolExport)
+	http.Handle("/shared/{token}", withSecurityHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		http.ServeFile(w, r, "./static/shared.html")
+	})))
+
 	// Example of auth-protected endpoint
 	http.Handle("/api/protected-test",
 		app.requireAuth(http.HandlerFunc(app.handleProtectedTest)),
@@ -296,12 +592,30 @@ func main() {
 		app.requireAuth(app.requireAdmin(http.HandlerFunc(app.handleAdminUnapprove))),
 	)
 
+	// Invitations: list/create, and revoke one
+	http.Handle("/admin/invitations",
+		app.requireAuth(app.requireAdmin(http.HandlerFunc(app.handleInvitations))),
+	)
+	http.Handle("/admin/invitations/{id}",
+		app.requireAuth(app.requireAdmin(http.HandlerFunc(app.handleRevokeInvitation))),
+	)
+
+	// The caller's own sessions: list, sign out others, revoke one
+	http.HandleFunc("/api/sessions", app.handleSessions)
+	http.HandleFunc("/api/sessions/{id}", app.handleRevokeSession)
+
 	http.Handle("/api/column-presets",
 		withSecurityHeaders(app.requireAuth(http.HandlerFunc(app.handleColumnPresets))),
 	)
 
+	// Empty the protocol trash of anything older than the retention period
+	go app.runProtocolPurger(protocolTrashRetention(), time.Hour)
+
+	// Delete expired and idle sessions
+	go app.runSessionSweeper(15 * time.Minute)
+
 	log.Println("LogicGrid running on http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	log.Fatal(http.ListenAndServe(":8080", requireCSRF(http.DefaultServeMux)))
 }
 
 func (a *App) handleAdminPage(w http.ResponseWriter, r *http.Request) {
@@ -318,9 +632,9 @@ func (a *App) handleListUsers(w http.ResponseWriter, r *http.Request) {
 	}
 
 	rows, err := a.db.Query(`
-        SELECT id, email, is_admin, is_approved
+        SELECT id, email, is_admin, is_approved, is_reviewer, created_at
         FROM users
-        ORDER BY email COLLATE NOCASE ASC
+        ORDER BY is_approved ASC, email COLLATE NOCASE ASC
     `)
 
 	if err != nil {
@@ -335,13 +649,16 @@ func (a *App) handleListUsers(w http.ResponseWriter, r *http.Request) {
 		Email      string `json:"email"`
 		IsAdmin    bool   `json:"is_admin"`
 		IsApproved bool   `json:"is_approved"`
+		IsReviewer bool   `json:"is_reviewer"`
+		// For pending users this is when they asked for an account.
+		CreatedAt time.Time `json:"created_at"`
 	}
 
 	var users []userLite
 	for rows.Next() {
 		var u userLite
 		var isAdminInt, isApprovedInt int
-		if err := rows.Scan(&u.ID, &u.Email, &isAdminInt, &isApprovedInt); err != nil {
+		if err := rows.Scan(&u.ID, &u.Email, &isAdminInt, &isApprovedInt, &u.IsReviewer, &u.CreatedAt); err != nil {
 			log.Printf("handleListUsers: scan error: %v", err)
 			http.Error(w, "db error", http.StatusInternalServerError)
 			return
@@ -399,7 +716,43 @@ func (a *App) handleAdminDeleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res, err := a.db.Exec(`DELETE FROM users WHERE id = ?`, req.UserID)
+	tx, err := a.db.Begin()
+	if err != nil {
+		log.Printf("handleAdminDeleteUser: begin error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Team protocols stay with the team: hand them to the longest-standing
+	// remaining owner or editor. Personal protocols still block the delete.
+	_, err = tx.Exec(`
+        UPDATE protocols AS p
+        SET user_id = (
+            SELECT tm.user_id FROM team_members tm
+            WHERE tm.team_id = p.team_id AND tm.user_id != p.user_id
+              AND tm.role IN ('owner', 'editor')
+            ORDER BY tm.role = 'owner' DESC, tm.added_at, tm.user_id
+            LIMIT 1)
+        WHERE p.user_id = ? AND p.team_id IS NOT NULL AND EXISTS (
+            SELECT 1 FROM team_members tm
+            WHERE tm.team_id = p.team_id AND tm.user_id != p.user_id
+              AND tm.role IN ('owner', 'editor'))
+    `, req.UserID)
+	if err != nil {
+		log.Printf("handleAdminDeleteUser: reassign protocols error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	// Clear any sessions for that user first; they reference the user row
+	if _, err := tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, req.UserID); err != nil {
+		log.Printf("handleAdminDeleteUser: delete sessions error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	res, err := tx.Exec(`DELETE FROM users WHERE id = ?`, req.UserID)
 	if err != nil {
 		// If you hit FK constraints (protocols linked), you can map to 409:
 		if strings.Contains(err.Error(), "FOREIGN KEY") {
@@ -418,8 +771,34 @@ func (a *App) handleAdminDeleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Also clear any sessions for that user
-	_, _ = a.db.Exec(`DELETE FROM sessions WHERE user_id = ?`, req.UserID)
+	// Teams the user was the last owner of get their earliest member promoted
+	_, err = tx.Exec(`
+        UPDATE team_members AS m
+        SET role = 'owner'
+        WHERE m.user_id = (
+                SELECT tm.user_id FROM team_members tm
+                WHERE tm.team_id = m.team_id
+                ORDER BY tm.added_at, tm.user_id
+                LIMIT 1)
+          AND NOT EXISTS (
+                SELECT 1 FROM team_members o
+                WHERE o.team_id = m.team_id AND o.role = 'owner')
+    `)
+	if err != nil {
+		log.Printf("handleAdminDeleteUser: promote owner error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		if strings.Contains(err.Error(), "FOREIGN KEY") {
+			http.Error(w, "cannot delete user with existing data", http.StatusConflict)
+			return
+		}
+		log.Printf("handleAdminDeleteUser: commit error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
 
 	json.NewEncoder(w).Encode(map[string]any{
 		"ok":     true,
@@ -519,11 +898,133 @@ func (a *App) handleAdminUnapprove(w http.ResponseWriter, r *http.Request) {
    ====================================================== */
 
 type saveProtocolRequest struct {
-	ID         int64  `json:"id"` // 0 or missing = new
-	Name       string `json:"name"`
-	Data       string `json:"data"`
-	Delete     bool   `json:"delete"`
-	MakePublic bool   `json:"makePublic"`
+	ID         int64           `json:"id"` // 0 or missing = new
+	Name       string          `json:"name"`
+	Data       json.RawMessage `json:"data"` // protocol object (or legacy JSON string)
+	Delete     bool            `json:"delete"`
+	MakePublic bool            `json:"makePublic"`
+	TeamID     int64           `json:"teamId"` // new protocols only; 0 = personal
+}
+
+// protocolDataBytes accepts the protocol either as a JSON object or, from
+// older clients, as a string holding the JSON, and returns the object.
+func protocolDataBytes(raw json.RawMessage) ([]byte, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, err
+		}
+		raw = []byte(s)
+	}
+	return raw, nil
+}
+
+// parseProtocolData decodes request data without checking it.
+func parseProtocolData(raw json.RawMessage) (*protocol.Document, error) {
+	b, err := protocolDataBytes(raw)
+	if err != nil {
+		return nil, err
+	}
+	return protocol.Parse(b)
+}
+
+// checkProtocolData checks request data against the published schema and
+// decodes it. A nil document comes with the problems to report.
+func checkProtocolData(raw json.RawMessage) (*protocol.Document, []protocol.Problem) {
+	b, err := protocolDataBytes(raw)
+	if err != nil {
+		return nil, []protocol.Problem{parseProblem(err)}
+	}
+	if problems := protocol.CheckSchema(b); len(problems) > 0 {
+		return nil, problems
+	}
+	doc, err := protocol.Parse(b)
+	if err != nil {
+		return nil, []protocol.Problem{parseProblem(err)}
+	}
+	return doc, nil
+}
+
+// parseProblem turns a JSON decode error into a validation problem, using
+// the offending field as the path when encoding/json reports one.
+func parseProblem(err error) protocol.Problem {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return protocol.Problem{
+			Path:    typeErr.Field,
+			Message: fmt.Sprintf("expected %s, got %s", typeErr.Type, typeErr.Value),
+		}
+	}
+	return protocol.Problem{Path: "data", Message: err.Error()}
+}
+
+// writeProtocolProblems sends a 422 listing every problem with its path.
+func writeProtocolProblems(w http.ResponseWriter, problems []protocol.Problem) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error":    "protocol failed validation",
+		"problems": problems,
+	})
+}
+
+// loadProtocolData parses the data column of a protocols row. Old formats
+// are upgraded as they are read.
+func loadProtocolData(data string) (*protocol.Document, error) {
+	return protocol.Parse([]byte(data))
+}
+
+// upgradeStoredProtocols rewrites every protocols and protocol_versions row
+// whose data predates protocol.FormatVersion, so the database holds what
+// reads already see. Rows that don't parse are logged and left alone.
+func upgradeStoredProtocols(db *sql.DB) (int, error) {
+	upgraded := 0
+	for _, table := range []string{"protocols", "protocol_versions"} {
+		rows, err := db.Query(`
+            SELECT id, data FROM `+table+`
+            WHERE json_valid(data)
+              AND COALESCE(json_extract(data, '$.format_version'), 0) < ?
+        `, protocol.FormatVersion)
+		if err != nil {
+			return upgraded, err
+		}
+
+		type staleRow struct {
+			id   int64
+			data string
+		}
+		var stale []staleRow
+		for rows.Next() {
+			var r staleRow
+			if err := rows.Scan(&r.id, &r.data); err != nil {
+				rows.Close()
+				return upgraded, err
+			}
+			stale = append(stale, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return upgraded, err
+		}
+
+		for _, r := range stale {
+			doc, err := protocol.Parse([]byte(r.data))
+			if err != nil {
+				log.Printf("upgradeStoredProtocols: %s %d: %v", table, r.id, err)
+				continue
+			}
+			b, err := protocol.Marshal(doc)
+			if err != nil {
+				return upgraded, err
+			}
+			if _, err := db.Exec(`UPDATE `+table+` SET data = ? WHERE id = ?`, string(b), r.id); err != nil {
+				return upgraded, err
+			}
+			upgraded++
+		}
+	}
+	return upgraded, nil
 }
 
 func (a *App) handleProtocols(w http.ResponseWriter, r *http.Request) {
@@ -554,50 +1055,137 @@ func (a *App) handleProtocols(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+var (
+	errNotFound  = errors.New("not found")
+	errForbidden = errors.New("forbidden")
+)
+
 func (a *App) handleListProtocols(w http.ResponseWriter, r *http.Request, userID int64) {
-	scope := r.URL.Query().Get("scope")
+	out, err := a.listProtocols(userID, r.URL.Query().Get("scope"))
+	if err == errForbidden {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("handleListProtocols: db error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
 
+// listProtocols returns the protocols visible to userID in the given scope
+// ("account", "shared", "review" or the builder default), without their
+// data.
+func (a *App) listProtocols(userID int64, scope string) ([]Protocol, error) {
 	var rows *sql.Rows
 	var err error
 
-	if scope == "account" {
-		// Account page: only this user’s protocols
-		rows, err = a.db.Query(`
-            SELECT id, name, created_at, is_public
-            FROM protocols
-            WHERE user_id = ?
-            ORDER BY created_at DESC
-        `, userID)
-	} else {
-		// Builder: show my protocols + all public protocols
-		rows, err = a.db.Query(`
-            SELECT id, name, created_at, is_public
-            FROM protocols
-            WHERE user_id = ? OR is_public = 1
-            ORDER BY is_public DESC, created_at DESC
+	switch scope {
+	case "account":
+		// Account page: this user’s protocols and the ones their teams let them edit
+		rows, err = a.db.Query(protocolListSelect+`
+            WHERE `+protocolEditableBy+` AND p.deleted_at IS NULL
+            ORDER BY p.created_at DESC
+        `, userID, userID, userID)
+
+	case "shared":
+		// Protocols other people shared with this user
+		rows, err = a.db.Query(protocolListSelect+`
+            WHERE sh.user_id IS NOT NULL AND p.deleted_at IS NULL
+            ORDER BY sh.created_at DESC
         `, userID)
+
+	case "review":
+		// Reviewers: everything waiting for review
+		ok, rerr := a.isReviewer(userID)
+		if rerr != nil {
+			return nil, rerr
+		}
+		if !ok {
+			return nil, errForbidden
+		}
+		rows, err = a.db.Query(protocolListSelect+`
+            WHERE p.status = ? AND p.deleted_at IS NULL
+            ORDER BY p.updated_at ASC
+        `, userID, statusInReview)
+
+	default:
+		// Builder: show my protocols, my teams' protocols, ones shared with me
+		// + everything published to the organization (retired ones are hidden)
+		rows, err = a.db.Query(protocolListSelect+`
+            WHERE (p.user_id = ? OR p.visibility IN ('organization', 'public') OR sh.user_id IS NOT NULL
+                   OR EXISTS (
+                    SELECT 1 FROM team_members tm
+                    WHERE tm.team_id = p.team_id AND tm.user_id = ?
+                      AND (tm.role != 'viewer' OR p.visibility != 'private')))
+              AND p.status != ? AND p.deleted_at IS NULL
+            ORDER BY (p.visibility != 'private') DESC, p.created_at DESC
+        `, userID, userID, userID, statusRetired)
 	}
 
 	if err != nil {
-		log.Printf("handleListProtocols: db error: %v", err)
-		http.Error(w, "db error", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 	defer rows.Close()
 
 	var out []Protocol
 	for rows.Next() {
 		var p Protocol
-		if err := rows.Scan(&p.ID, &p.Name, &p.CreatedAt, &p.IsPublic); err != nil {
-			log.Printf("handleListProtocols: scan error: %v", err)
-			http.Error(w, "db error", http.StatusInternalServerError)
-			return
+		if err := scanProtocolRow(rows, &p); err != nil {
+			return nil, err
 		}
 		out = append(out, p)
 	}
+	return out, rows.Err()
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(out)
+// protocolListSelect is the SELECT ... FROM shared by protocol list and
+// get queries (protocols aliased p); scanProtocolRow reads its columns.
+// Its one parameter (?1, used more than once) is the viewer's user id: a
+// fork only shows its source's name while the viewer can still see the
+// source, and shares are reported for the viewer.
+const protocolListSelect = `
+        SELECT p.id, p.name, p.created_at, p.visibility, p.current_version, p.status, p.approved_version,
+               p.forked_from_id, p.forked_from_version,
+               CASE WHEN src.deleted_at IS NULL AND (src.user_id = ?1
+                         OR src.visibility IN ('organization', 'public')
+                         OR EXISTS (SELECT 1 FROM protocol_shares ss WHERE ss.protocol_id = src.id AND ss.user_id = ?1)
+                         OR EXISTS (SELECT 1 FROM team_members stm WHERE stm.team_id = src.team_id AND stm.user_id = ?1
+                                    AND (stm.role != 'viewer' OR src.visibility != 'private')))
+                    THEN src.name ELSE '' END,
+               (SELECT COUNT(*) FROM protocols f WHERE f.forked_from_id = p.id AND f.deleted_at IS NULL),
+               p.team_id, COALESCE(t.name, ''),
+               COALESCE(sh.permission, ''),
+               CASE WHEN p.team_id IS NULL THEN p.user_id = ?1
+                    ELSE EXISTS (SELECT 1 FROM team_members otm WHERE otm.team_id = p.team_id AND otm.user_id = ?1
+                                 AND otm.role = 'owner') END
+        FROM protocols p
+        LEFT JOIN protocols src ON src.id = p.forked_from_id
+        LEFT JOIN teams t ON t.id = p.team_id
+        LEFT JOIN protocol_shares sh ON sh.protocol_id = p.id AND sh.user_id = ?1
+`
+
+func scanProtocolRow(row interface{ Scan(...any) error }, p *Protocol) error {
+	var forkedFromID sql.NullInt64
+	var forkedFromVersion sql.NullInt64
+	var forkedFromName sql.NullString
+	err := row.Scan(&p.ID, &p.Name, &p.CreatedAt, &p.Visibility, &p.Version, &p.Status, &p.ApprovedVersion,
+		&forkedFromID, &forkedFromVersion, &forkedFromName, &p.ForkCount, &p.TeamID, &p.TeamName, &p.SharedWithMe, &p.CanManage)
+	if err != nil {
+		return err
+	}
+	p.IsPublic = p.Visibility == visibilityOrganization || p.Visibility == visibilityPublic
+	if forkedFromID.Valid {
+		p.ForkedFrom = &ProtocolRef{
+			ID:      forkedFromID.Int64,
+			Version: int(forkedFromVersion.Int64),
+			Name:    forkedFromName.String,
+		}
+	}
+	return nil
 }
 
 func (a *App) handleGetProtocol(w http.ResponseWriter, r *http.Request, userID int64, idStr string) {
@@ -607,26 +1195,135 @@ func (a *App) handleGetProtocol(w http.ResponseWriter, r *http.Request, userID i
 		return
 	}
 
-	var p Protocol
-	err = a.db.QueryRow(`
-        SELECT id, name, data, created_at, is_public
-        FROM protocols
-        WHERE id = ? AND (user_id = ? OR is_public = 1)
-    `, id, userID).Scan(&p.ID, &p.Name, &p.Data, &p.CreatedAt, &p.IsPublic)
-	if err == sql.ErrNoRows {
+	p, err := a.getProtocol(id, userID)
+	if err == errNotFound {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
 	if err != nil {
-		log.Printf("handleGetProtocol: db error: %v", err)
+		log.Printf("handleGetProtocol: %v", err)
 		http.Error(w, "db error", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", protocolETag(p.Version))
 	json.NewEncoder(w).Encode(p)
 }
 
+// getProtocol loads a protocol with its data if userID may read it, and
+// errNotFound otherwise.
+func (a *App) getProtocol(id, userID int64) (*Protocol, error) {
+	canRead, _, err := a.protocolAccess(id, userID)
+	if err == sql.ErrNoRows || (err == nil && !canRead) {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var p Protocol
+	if err := scanProtocolRow(a.db.QueryRow(protocolListSelect+`WHERE p.id = ?`, userID, id), &p); err != nil {
+		return nil, err
+	}
+
+	var data string
+	if err := a.db.QueryRow(`SELECT data FROM protocols WHERE id = ?`, id).Scan(&data); err != nil {
+		return nil, err
+	}
+
+	p.Data, err = loadProtocolData(data)
+	if err != nil {
+		return nil, fmt.Errorf("stored protocol %d does not parse: %w", id, err)
+	}
+	return &p, nil
+}
+
+// deleteProtocol moves a protocol userID owns to the trash. It stays
+// restorable until purgeDeletedProtocols removes it.
+func (a *App) deleteProtocol(id, userID int64) error {
+	res, err := a.db.Exec(`
+        UPDATE protocols AS p
+        SET deleted_at = CURRENT_TIMESTAMP
+        WHERE p.id = ? AND `+protocolOwnedBy+` AND p.deleted_at IS NULL
+    `, id, userID, userID)
+	if err != nil {
+		return err
+	}
+
+	rows, _ := res.RowsAffected()
+	if rows == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+var (
+	errInvalidVisibility = errors.New("visibility must be private, team, organization or public")
+	errNoTeam            = errors.New("protocol does not belong to a team")
+)
+
+// setProtocolVisibility moves a protocol userID owns to another
+// visibility level. Forks are copies, so narrowing the source never breaks
+// them; they only stop showing its name.
+func (a *App) setProtocolVisibility(id, userID int64, visibility string) error {
+	switch visibility {
+	case visibilityPrivate, visibilityTeam, visibilityOrganization, visibilityPublic:
+	default:
+		return errInvalidVisibility
+	}
+
+	var teamID sql.NullInt64
+	err := a.db.QueryRow(`
+        SELECT p.team_id FROM protocols p
+        WHERE p.id = ? AND `+protocolOwnedBy+` AND p.deleted_at IS NULL
+    `, id, userID, userID).Scan(&teamID)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if visibility == visibilityTeam && !teamID.Valid {
+		return errNoTeam
+	}
+
+	// is_public is kept in step for older builds reading the same database.
+	isPublic := visibility == visibilityOrganization || visibility == visibilityPublic
+	res, err := a.db.Exec(`
+        UPDATE protocols
+        SET visibility = ?, is_public = ?, updated_at = CURRENT_TIMESTAMP
+        WHERE id = ?
+    `, visibility, isPublic, id)
+	if err != nil {
+		return err
+	}
+
+	rows, _ := res.RowsAffected()
+	if rows == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// decodeProtocolDocument checks request data against the schema, parses it
+// and validates it. A nil document comes with the problems to report.
+func decodeProtocolDocument(raw json.RawMessage) (*protocol.Document, []protocol.Problem) {
+	doc, problems := checkProtocolData(raw)
+	if doc == nil {
+		return nil, problems
+	}
+
+	if err := protocol.Validate(doc); err != nil {
+		var verr *protocol.ValidationError
+		if errors.As(err, &verr) {
+			return nil, verr.Problems
+		}
+		return nil, []protocol.Problem{{Path: "data", Message: err.Error()}}
+	}
+	return doc, nil
+}
+
 func (a *App) handleSaveProtocol(w http.ResponseWriter, r *http.Request, userID int64) {
 	ct := r.Header.Get("Content-Type")
 	if ct != "" && !strings.HasPrefix(ct, "application/json") {
@@ -653,19 +1350,14 @@ func (a *App) handleSaveProtocol(w http.ResponseWriter, r *http.Request, userID
 			return
 		}
 
-		res, err := a.db.Exec(`
-            DELETE FROM protocols
-            WHERE id = ? AND user_id = ?
-        `, req.ID, userID)
-		if err != nil {
-			log.Printf("handleSaveProtocol: delete error: %v", err)
-			http.Error(w, "db error", http.StatusInternalServerError)
+		err := a.deleteProtocol(req.ID, userID)
+		if err == errNotFound {
+			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
-
-		rows, _ := res.RowsAffected()
-		if rows == 0 {
-			http.Error(w, "not found", http.StatusNotFound)
+		if err != nil {
+			log.Printf("handleSaveProtocol: delete error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
 			return
 		}
 
@@ -680,23 +1372,18 @@ func (a *App) handleSaveProtocol(w http.ResponseWriter, r *http.Request, userID
 			return
 		}
 
-		res, err := a.db.Exec(`
-            UPDATE protocols
-            SET is_public = 1, updated_at = CURRENT_TIMESTAMP
-            WHERE id = ? AND user_id = ?
-        `, req.ID, userID)
+		// "Public" here has always meant every signed-in user
+		err := a.setProtocolVisibility(req.ID, userID, visibilityOrganization)
+		if err == errNotFound {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
 		if err != nil {
 			log.Printf("handleSaveProtocol: makePublic update error: %v", err)
 			http.Error(w, "db error", http.StatusInternalServerError)
 			return
 		}
 
-		rows, _ := res.RowsAffected()
-		if rows == 0 {
-			http.Error(w, "not found", http.StatusNotFound)
-			return
-		}
-
 		json.NewEncoder(w).Encode(map[string]any{
 			"ok":       true,
 			"id":       req.ID,
@@ -706,307 +1393,4370 @@ func (a *App) handleSaveProtocol(w http.ResponseWriter, r *http.Request, userID
 	}
 
 	// 🔹 Create / update path: require name + data
-	if strings.TrimSpace(req.Name) == "" || strings.TrimSpace(req.Data) == "" {
+	if strings.TrimSpace(req.Name) == "" || len(bytes.TrimSpace(req.Data)) == 0 {
 		http.Error(w, "name and data required", http.StatusBadRequest)
 		return
 	}
 
+	doc, problems := decodeProtocolDocument(req.Data)
+	if doc == nil {
+		writeProtocolProblems(w, problems)
+		return
+	}
+
 	// New or update?
+	var source *ProtocolRef
 	if req.ID > 0 {
-		// Try to update existing (only if it belongs to this user)
-		res, err := a.db.Exec(`
-            UPDATE protocols
-            SET name = ?, data = ?, updated_at = CURRENT_TIMESTAMP
-            WHERE id = ? AND user_id = ?
-        `, req.Name, req.Data, req.ID, userID)
-		if err != nil {
-			log.Printf("handleSaveProtocol: update error: %v", err)
+		// Append a new version if the protocol belongs to this user
+		canRead, canEdit, err := a.protocolAccess(req.ID, userID)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("handleSaveProtocol: access error: %v", err)
 			http.Error(w, "db error", http.StatusInternalServerError)
 			return
 		}
 
-		rows, _ := res.RowsAffected()
-		if rows > 0 {
+		if err == nil && canEdit {
+			// Updates must say which version they were made against
+			baseVersion, sent, err := ifMatchVersion(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !sent {
+				http.Error(w, "If-Match header required to update a protocol", http.StatusPreconditionRequired)
+				return
+			}
+
+			version, err := a.appendProtocolVersion(req.ID, req.Name, doc, userID, nil, baseVersion)
+			if err == errVersionConflict {
+				a.writeVersionConflict(w, req.ID, userID)
+				return
+			}
+			if err != nil {
+				log.Printf("handleSaveProtocol: version error: %v", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+
 			// Updated successfully (owner editing their own protocol, public or not)
+			w.Header().Set("ETag", protocolETag(version))
 			json.NewEncoder(w).Encode(map[string]any{
-				"ok": true,
-				"id": req.ID,
+				"ok":      true,
+				"id":      req.ID,
+				"version": version,
 			})
 			return
 		}
 
-		// 🔹 If no rows were updated, treat it as "Save As" and insert a new record.
-		// This covers cases where the protocol is public and belongs to someone else.
+		// 🔹 If the user can't edit it, treat it as "Save As" and insert a new record.
+		// This covers cases where the protocol is public and belongs to someone else,
+		// so record it as a fork of what they were looking at.
+		if err == nil && canRead {
+			source, err = a.protocolHead(req.ID)
+			if err != nil {
+				log.Printf("handleSaveProtocol: fork source error: %v", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+		}
 	}
 
 	// Insert new
-	res, err := a.db.Exec(`
-        INSERT INTO protocols (user_id, name, data)
-        VALUES (?, ?, ?)
-    `, userID, req.Name, req.Data)
+	if req.TeamID > 0 {
+		ok, err := a.canEditForTeam(req.TeamID, userID)
+		if err != nil {
+			log.Printf("handleSaveProtocol: team role error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "you must be an owner or editor of that team", http.StatusForbidden)
+			return
+		}
+	}
+
+	newID, version, err := a.createProtocol(userID, req.TeamID, req.Name, doc, source)
 	if err != nil {
 		log.Printf("handleSaveProtocol: insert error: %v", err)
 		http.Error(w, "db error", http.StatusInternalServerError)
 		return
 	}
 
-	newID, _ := res.LastInsertId()
+	w.Header().Set("ETag", protocolETag(version))
 	json.NewEncoder(w).Encode(map[string]any{
-		"ok": true,
-		"id": newID,
+		"ok":      true,
+		"id":      newID,
+		"version": version,
 	})
 }
 
-func (a *App) generateSessionID() (string, error) {
-	b := make([]byte, 32)
-	if _, err := cryptoRand.Read(b); err != nil {
-		return "", err
-	}
-	return hex.EncodeToString(b), nil
-}
-
-func ensureIsAdminColumn(db *sql.DB) error {
-	rows, err := db.Query(`PRAGMA table_info(users);`)
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
+/* ======================================================
+   Protocol API v1
+   ====================================================== */
 
-	hasIsAdmin := false
-	for rows.Next() {
-		var cid int
-		var name, colType string
-		var notnull, pk int
-		var dflt sql.NullString
-		if err := rows.Scan(&cid, &name, &colType, &notnull, &dflt, &pk); err != nil {
-			return err
-		}
-		if name == "is_admin" {
-			hasIsAdmin = true
-			break
-		}
-	}
+// /api/v1/protocols is the resource-style protocol API: the HTTP verb says
+// what to do and the id lives in the path. Every error is a JSON body
+// {"error": "..."}; validation failures add "problems". /api/protocols
+// stays as the builder's original endpoint.
 
-	if hasIsAdmin {
-		return nil // already exists
-	}
+type v1ProtocolRequest struct {
+	Name   *string         `json:"name"`
+	Data   json.RawMessage `json:"data"`
+	TeamID int64           `json:"teamId"` // create only
+}
 
-	_, err = db.Exec(`ALTER TABLE users ADD COLUMN is_admin INTEGER NOT NULL DEFAULT 0;`)
-	return err
+// writeAPIError is http.Error for the v1 API.
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"error": msg})
 }
 
-// --- Add is_approved column to users if missing ---
-func ensureIsApprovedColumn(db *sql.DB) error {
-	rows, err := db.Query(`PRAGMA table_info(users);`)
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
+func writeAPIJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
 
-	hasIsApproved := false
-	for rows.Next() {
-		var cid int
-		var name, colType string
-		var notnull, pk int
-		var dflt sql.NullString
-		if err := rows.Scan(&cid, &name, &colType, &notnull, &dflt, &pk); err != nil {
-			return err
-		}
-		if strings.EqualFold(name, "is_approved") {
-			hasIsApproved = true
-			break
-		}
+// decodeV1ProtocolRequest reads a protocol body, writing the error itself
+// and returning false on failure.
+func decodeV1ProtocolRequest(w http.ResponseWriter, r *http.Request, req *v1ProtocolRequest) bool {
+	ct := r.Header.Get("Content-Type")
+	if ct != "" && !strings.HasPrefix(ct, "application/json") {
+		writeAPIError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+		return false
 	}
-
-	if hasIsApproved {
-		return nil
+	if err := decodeJSONBody(w, r, req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid JSON")
+		return false
 	}
-
-	// Add column with default 0 (false)
-	if _, err := db.Exec(`ALTER TABLE users ADD COLUMN is_approved INTEGER NOT NULL DEFAULT 0;`); err != nil {
-		return err
+	if req.Name != nil && strings.TrimSpace(*req.Name) == "" {
+		writeAPIError(w, http.StatusBadRequest, "name cannot be empty")
+		return false
 	}
-
-	// Mark all existing users as approved so you don't lock yourself out
-	_, err = db.Exec(`UPDATE users SET is_approved = 1;`)
-	return err
+	return true
 }
 
-// --- Add is_public column to protocols if missing ---
-func ensureIsPublicColumn(db *sql.DB) error {
-	rows, err := db.Query(`PRAGMA table_info(protocols);`)
-	if err != nil {
-		return err
+// /api/v1/protocols
+func (a *App) handleV1Protocols(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized")
+		return
 	}
-	defer rows.Close()
 
-	found := false
-	for rows.Next() {
-		var cid int
-		var name, colType string
-		var notnull, pk int
-		var dflt sql.NullString
-		if err := rows.Scan(&cid, &name, &colType, &notnull, &dflt, &pk); err != nil {
-			return err
+	switch r.Method {
+	case http.MethodGet:
+		list, err := a.listProtocols(userID, r.URL.Query().Get("scope"))
+		if err == errForbidden {
+			writeAPIError(w, http.StatusForbidden, "forbidden")
+			return
 		}
-		if strings.EqualFold(name, "is_public") {
-			found = true
-			break
+		if err != nil {
+			log.Printf("handleV1Protocols: list error: %v", err)
+			writeAPIError(w, http.StatusInternalServerError, "db error")
+			return
 		}
-	}
-
-	if found {
-		return nil
-	}
+		if list == nil {
+			list = []Protocol{}
+		}
+		writeAPIJSON(w, http.StatusOK, list)
 
-	_, err = db.Exec(`ALTER TABLE protocols ADD COLUMN is_public INTEGER NOT NULL DEFAULT 0;`)
-	return err
-}
+	case http.MethodPost:
+		var req v1ProtocolRequest
+		if !decodeV1ProtocolRequest(w, r, &req) {
+			return
+		}
+		if req.Name == nil || len(bytes.TrimSpace(req.Data)) == 0 {
+			writeAPIError(w, http.StatusBadRequest, "name and data required")
+			return
+		}
 
-// Add this helper function to main.go
-func ensureAIUsageColumn(db *sql.DB) error {
-	rows, err := db.Query(`PRAGMA table_info(users);`)
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
+		doc, problems := decodeProtocolDocument(req.Data)
+		if doc == nil {
+			writeProtocolProblems(w, problems)
+			return
+		}
 
-	hasCol := false
-	for rows.Next() {
-		var cid int
-		var name, colType string
-		var notnull, pk int
-		var dflt sql.NullString
-		if err := rows.Scan(&cid, &name, &colType, &notnull, &dflt, &pk); err != nil {
-			return err
+		if req.TeamID > 0 {
+			ok, err := a.canEditForTeam(req.TeamID, userID)
+			if err != nil {
+				log.Printf("handleV1Protocols: team role error: %v", err)
+				writeAPIError(w, http.StatusInternalServerError, "db error")
+				return
+			}
+			if !ok {
+				writeAPIError(w, http.StatusForbidden, "you must be an owner or editor of that team")
+				return
+			}
 		}
-		if name == "ai_usage_count" {
-			hasCol = true
-			break
+
+		id, _, err := a.createProtocol(userID, req.TeamID, *req.Name, doc, nil)
+		if err != nil {
+			log.Printf("handleV1Protocols: insert error: %v", err)
+			writeAPIError(w, http.StatusInternalServerError, "db error")
+			return
 		}
-	}
 
-	if !hasCol {
-		if _, err := db.Exec(`ALTER TABLE users ADD COLUMN ai_usage_count INTEGER NOT NULL DEFAULT 0;`); err != nil {
-			return err
+		p, err := a.getProtocol(id, userID)
+		if err != nil {
+			log.Printf("handleV1Protocols: reload error: %v", err)
+			writeAPIError(w, http.StatusInternalServerError, "db error")
+			return
 		}
+		w.Header().Set("Location", fmt.Sprintf("/api/v1/protocols/%d", id))
+		w.Header().Set("ETag", protocolETag(p.Version))
+		writeAPIJSON(w, http.StatusCreated, p)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET or POST")
 	}
-	return nil
 }
 
-func ensureSecurityColumns(db *sql.DB) error {
-	rows, err := db.Query(`PRAGMA table_info(users);`)
-	if err != nil {
-		return err
+// /api/v1/protocols/{id}
+func (a *App) handleV1Protocol(w http.ResponseWriter, r *http.Request) {
+	// Public protocols can be read without signing in (userID 0)
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok && r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized")
+		return
 	}
-	defer rows.Close()
 
-	hasFailedAttempts := false
-	hasLockoutUntil := false
+	id, ok := protocolIDFromPath(r)
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
 
-	for rows.Next() {
-		var cid int
-		var name, colType string
-		var notnull, pk int
-		var dflt sql.NullString
-		if err := rows.Scan(&cid, &name, &colType, &notnull, &dflt, &pk); err != nil {
-			return err
-		}
-		if name == "failed_attempts" {
-			hasFailedAttempts = true
+	switch r.Method {
+	case http.MethodGet:
+		p, err := a.getProtocol(id, userID)
+		if err == errNotFound {
+			writeAPIError(w, http.StatusNotFound, "not found")
+			return
 		}
-		if name == "lockout_until" {
-			hasLockoutUntil = true
+		if err != nil {
+			log.Printf("handleV1Protocol: get error: %v", err)
+			writeAPIError(w, http.StatusInternalServerError, "db error")
+			return
 		}
-	}
+		w.Header().Set("ETag", protocolETag(p.Version))
+		writeAPIJSON(w, http.StatusOK, p)
 
-	if !hasFailedAttempts {
-		if _, err := db.Exec(`ALTER TABLE users ADD COLUMN failed_attempts INTEGER NOT NULL DEFAULT 0;`); err != nil {
-			return err
+	case http.MethodPut, http.MethodPatch:
+		baseVersion, sent, err := ifMatchVersion(r)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
 		}
-	}
-	if !hasLockoutUntil {
-		if _, err := db.Exec(`ALTER TABLE users ADD COLUMN lockout_until DATETIME;`); err != nil {
-			return err
+		if !sent {
+			writeAPIError(w, http.StatusPreconditionRequired, "If-Match header required")
+			return
 		}
-	}
-	return nil
-}
-
-func (a *App) setSessionCookie(w http.ResponseWriter, userID int64) error {
-	sid, err := a.generateSessionID()
-	if err != nil {
-		return err
-	}
 
-	_, err = a.db.Exec(`INSERT INTO sessions (id, user_id) VALUES (?, ?)`, sid, userID)
-	if err != nil {
-		log.Printf("setSessionCookie: failed inserting session for user %d: %v", userID, err)
-		return err
-	}
+		var req v1ProtocolRequest
+		if !decodeV1ProtocolRequest(w, r, &req) {
+			return
+		}
 
-	log.Printf("setSessionCookie: created session %s for user %d", sid, userID)
+		// PUT replaces the whole protocol; PATCH keeps whatever is omitted.
+		hasData := len(bytes.TrimSpace(req.Data)) > 0
+		if r.Method == http.MethodPut && (req.Name == nil || !hasData) {
+			writeAPIError(w, http.StatusBadRequest, "name and data required")
+			return
+		}
+		if r.Method == http.MethodPatch && req.Name == nil && !hasData {
+			writeAPIError(w, http.StatusBadRequest, "nothing to update")
+			return
+		}
 
-	http.SetCookie(w, &http.Cookie{
+		current, err := a.getProtocol(id, userID)
+		if err == errNotFound {
+			writeAPIError(w, http.StatusNotFound, "not found")
+			return
+		}
+		if err != nil {
+			log.Printf("handleV1Protocol: load error: %v", err)
+			writeAPIError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+
+		_, canEdit, err := a.protocolAccess(id, userID)
+		if err != nil {
+			log.Printf("handleV1Protocol: access error: %v", err)
+			writeAPIError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+		if !canEdit {
+			writeAPIError(w, http.StatusForbidden, "only the owner can update this protocol")
+			return
+		}
+
+		name, doc := current.Name, current.Data
+		if req.Name != nil {
+			name = *req.Name
+		}
+		if hasData {
+			var problems []protocol.Problem
+			doc, problems = decodeProtocolDocument(req.Data)
+			if doc == nil {
+				writeProtocolProblems(w, problems)
+				return
+			}
+		}
+
+		_, err = a.appendProtocolVersion(id, name, doc, userID, nil, baseVersion)
+		if err == errVersionConflict {
+			a.writeVersionConflict(w, id, userID)
+			return
+		}
+		if err != nil {
+			log.Printf("handleV1Protocol: version error: %v", err)
+			writeAPIError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+
+		p, err := a.getProtocol(id, userID)
+		if err != nil {
+			log.Printf("handleV1Protocol: reload error: %v", err)
+			writeAPIError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+		w.Header().Set("ETag", protocolETag(p.Version))
+		writeAPIJSON(w, http.StatusOK, p)
+
+	case http.MethodDelete:
+		err := a.deleteProtocol(id, userID)
+		if err == errNotFound {
+			writeAPIError(w, http.StatusNotFound, "not found")
+			return
+		}
+		if err != nil {
+			log.Printf("handleV1Protocol: delete error: %v", err)
+			writeAPIError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, PUT, PATCH, DELETE")
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET, PUT, PATCH or DELETE")
+	}
+}
+
+type v1VisibilityRequest struct {
+	Visibility string `json:"visibility"`
+}
+
+// /api/v1/protocols/{id}/publish
+//
+// Sets the visibility given in the body, "organization" if there is none.
+func (a *App) handleV1PublishProtocol(w http.ResponseWriter, r *http.Request) {
+	a.v1SetVisibility(w, r, visibilityOrganization)
+}
+
+// /api/v1/protocols/{id}/unpublish
+func (a *App) handleV1UnpublishProtocol(w http.ResponseWriter, r *http.Request) {
+	a.v1SetVisibility(w, r, visibilityPrivate)
+}
+
+func (a *App) v1SetVisibility(w http.ResponseWriter, r *http.Request, visibility string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeAPIError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	id, ok := protocolIDFromPath(r)
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	if visibility != visibilityPrivate && r.ContentLength != 0 {
+		var req v1VisibilityRequest
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid JSON")
+			return
+		}
+		if req.Visibility != "" {
+			visibility = req.Visibility
+		}
+	}
+
+	err := a.setProtocolVisibility(id, userID, visibility)
+	if err == errNotFound {
+		writeAPIError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if err == errInvalidVisibility || err == errNoTeam {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("v1SetVisibility: update error: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	p, err := a.getProtocol(id, userID)
+	if err != nil {
+		log.Printf("v1SetVisibility: reload error: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	w.Header().Set("ETag", protocolETag(p.Version))
+	writeAPIJSON(w, http.StatusOK, p)
+}
+
+/* ======================================================
+   Protocol versions
+   ====================================================== */
+
+// createProtocol inserts a protocol and its first version. teamID 0 means
+// owned by userID alone; source is set for forks.
+func (a *App) createProtocol(userID, teamID int64, name string, doc *protocol.Document, source *ProtocolRef) (int64, int, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	var forkedFromID, forkedFromVersion, team any
+	if source != nil {
+		forkedFromID, forkedFromVersion = source.ID, source.Version
+	}
+	if teamID > 0 {
+		team = teamID
+	}
+
+	res, err := tx.Exec(`
+        INSERT INTO protocols (user_id, team_id, name, data, forked_from_id, forked_from_version)
+        VALUES (?, ?, ?, '', ?, ?)
+    `, userID, team, name, forkedFromID, forkedFromVersion)
+	if err != nil {
+		return 0, 0, err
+	}
+	id, _ := res.LastInsertId()
+
+	version, err := appendProtocolVersionTx(tx, id, name, doc, userID, nil, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	return id, version, tx.Commit()
+}
+
+// A protocol's ETag is its head version number, which changes on every
+// save. Clients send it back in If-Match so a save made against an older
+// head is refused instead of silently overwriting someone else's work.
+
+var errVersionConflict = errors.New("protocol changed since it was loaded")
+
+// isWriteConflict reports whether err is SQLite refusing a write because
+// another save got there first: the version number was just taken, or the
+// database is locked by the other writer. Either way the caller should
+// reload and retry, so it is answered like a stale If-Match.
+func isWriteConflict(err error) bool {
+	var se sqlite3.Error
+	if !errors.As(err, &se) {
+		return false
+	}
+	return se.ExtendedCode == sqlite3.ErrConstraintUnique ||
+		se.Code == sqlite3.ErrBusy || se.Code == sqlite3.ErrLocked
+}
+
+func protocolETag(version int) string {
+	return fmt.Sprintf(`"v%d"`, version)
+}
+
+// ifMatchVersion reads the If-Match header. sent is false when there is
+// none; "*" is sent with version 0 (any head).
+func ifMatchVersion(r *http.Request) (version int, sent bool, err error) {
+	h := strings.TrimSpace(r.Header.Get("If-Match"))
+	if h == "" {
+		return 0, false, nil
+	}
+	if h == "*" {
+		return 0, true, nil
+	}
+
+	tag := strings.TrimPrefix(h, "W/")
+	tag = strings.TrimSuffix(strings.TrimPrefix(tag, `"`), `"`)
+	n, err := strconv.Atoi(strings.TrimPrefix(tag, "v"))
+	if err != nil || n <= 0 {
+		return 0, true, fmt.Errorf("invalid If-Match %q", h)
+	}
+	return n, true, nil
+}
+
+// writeVersionConflict answers a stale If-Match with 409 and the current
+// head, so the client can show what changed or retry against it.
+func (a *App) writeVersionConflict(w http.ResponseWriter, id, userID int64) {
+	current, err := a.getProtocol(id, userID)
+	if err != nil {
+		log.Printf("writeVersionConflict: load error: %v", err)
+		writeAPIError(w, http.StatusConflict, errVersionConflict.Error())
+		return
+	}
+
+	w.Header().Set("ETag", protocolETag(current.Version))
+	writeAPIJSON(w, http.StatusConflict, map[string]any{
+		"error":   errVersionConflict.Error(),
+		"current": current,
+	})
+}
+
+// appendProtocolVersion records a new version and makes it the head.
+// baseVersion is the head the caller edited; if it is no longer the head
+// the save fails with errVersionConflict. 0 skips the check.
+func (a *App) appendProtocolVersion(protocolID int64, name string, doc *protocol.Document, authorID int64, restoredFrom *int, baseVersion int) (int, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	version, err := appendProtocolVersionTx(tx, protocolID, name, doc, authorID, restoredFrom, baseVersion)
+	if err != nil {
+		return 0, err
+	}
+	return version, tx.Commit()
+}
+
+// appendProtocolVersionTx stamps doc with the protocol id and next version
+// number, appends it to protocol_versions and copies it onto the protocols
+// row, which always holds the head.
+func appendProtocolVersionTx(tx *sql.Tx, protocolID int64, name string, doc *protocol.Document, authorID int64, restoredFrom *int, baseVersion int) (int, error) {
+	// Writing first takes SQLite's write lock, so no other save can slip in
+	// between the head check, the MAX(version_number) read and the insert
+	// below. Done even without a base version (If-Match: *), which would
+	// otherwise race another writer to the same version number.
+	lock := `UPDATE protocols SET updated_at = updated_at WHERE id = ?`
+	args := []any{protocolID}
+	if baseVersion > 0 {
+		lock += ` AND current_version = ?`
+		args = append(args, baseVersion)
+	}
+	res, err := tx.Exec(lock, args...)
+	if isWriteConflict(err) {
+		return 0, errVersionConflict
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if baseVersion > 0 {
+			return 0, errVersionConflict
+		}
+		return 0, errNotFound
+	}
+
+	var version int
+	err = tx.QueryRow(`
+        SELECT COALESCE(MAX(version_number), 0) + 1
+        FROM protocol_versions
+        WHERE protocol_id = ?
+    `, protocolID).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+
+	stamped := *doc
+	stamped.ProtocolID = protocolID
+	stamped.VersionNumber = version
+
+	// Store the server's canonical encoding of what we parsed.
+	encoded, err := protocol.Marshal(&stamped)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`
+        INSERT INTO protocol_versions (protocol_id, version_number, name, data, author_id, restored_from)
+        VALUES (?, ?, ?, ?, ?, ?)
+    `, protocolID, version, name, string(encoded), authorID, restoredFrom)
+	if isWriteConflict(err) {
+		return 0, errVersionConflict
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// A new head has not been reviewed: pull it back to draft. The
+	// approved_version stays exportable until the new one is approved.
+	var status string
+	if err := tx.QueryRow(`SELECT status FROM protocols WHERE id = ?`, protocolID).Scan(&status); err != nil {
+		return 0, err
+	}
+	if status == statusInReview || status == statusApproved {
+		if err := recordStatusEventTx(tx, protocolID, version, status, statusDraft, authorID, "new version saved"); err != nil {
+			return 0, err
+		}
+		status = statusDraft
+	}
+
+	_, err = tx.Exec(`
+        UPDATE protocols
+        SET name = ?, data = ?, current_version = ?, status = ?, updated_at = CURRENT_TIMESTAMP
+        WHERE id = ?
+    `, name, string(encoded), version, status, protocolID)
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+type ProtocolVersion struct {
+	Version      int                `json:"version"`
+	Name         string             `json:"name"`
+	AuthorID     int64              `json:"author_id"`
+	AuthorEmail  string             `json:"author_email"`
+	CreatedAt    time.Time          `json:"created_at"`
+	RestoredFrom *int               `json:"restored_from,omitempty"`
+	Data         *protocol.Document `json:"data,omitempty"` // omit in list
+}
+
+// loadProtocolVersion fetches one stored version, with its data.
+func (a *App) loadProtocolVersion(protocolID int64, version int) (*ProtocolVersion, error) {
+	var v ProtocolVersion
+	var restoredFrom sql.NullInt64
+	var data string
+	err := a.db.QueryRow(`
+        SELECT v.version_number, v.name, COALESCE(v.author_id, 0), COALESCE(u.email, ''), v.created_at, v.restored_from, v.data
+        FROM protocol_versions v
+        LEFT JOIN users u ON u.id = v.author_id
+        WHERE v.protocol_id = ? AND v.version_number = ?
+    `, protocolID, version).Scan(&v.Version, &v.Name, &v.AuthorID, &v.AuthorEmail, &v.CreatedAt, &restoredFrom, &data)
+	if err != nil {
+		return nil, err
+	}
+	if restoredFrom.Valid {
+		n := int(restoredFrom.Int64)
+		v.RestoredFrom = &n
+	}
+
+	v.Data, err = loadProtocolData(data)
+	if err != nil {
+		return nil, fmt.Errorf("version %d: %w", version, err)
+	}
+	return &v, nil
+}
+
+// versionFromPath parses the {version} wildcard.
+func versionFromPath(r *http.Request) (int, bool) {
+	v, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil || v <= 0 {
+		return 0, false
+	}
+	return v, true
+}
+
+// handleProtocolVersions lists the history of a protocol, newest first.
+// GET /api/protocols/{id}/versions
+func (a *App) handleProtocolVersions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	protocolID, ok := protocolIDFromPath(r)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	canRead, _, err := a.protocolAccess(protocolID, userID)
+	if err == sql.ErrNoRows || (err == nil && !canRead) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("handleProtocolVersions: access error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := a.db.Query(`
+        SELECT v.version_number, v.name, COALESCE(v.author_id, 0), COALESCE(u.email, ''), v.created_at, v.restored_from
+        FROM protocol_versions v
+        LEFT JOIN users u ON u.id = v.author_id
+        WHERE v.protocol_id = ?
+        ORDER BY v.version_number DESC
+    `, protocolID)
+	if err != nil {
+		log.Printf("handleProtocolVersions: db error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	out := []ProtocolVersion{}
+	for rows.Next() {
+		var v ProtocolVersion
+		var restoredFrom sql.NullInt64
+		if err := rows.Scan(&v.Version, &v.Name, &v.AuthorID, &v.AuthorEmail, &v.CreatedAt, &restoredFrom); err != nil {
+			log.Printf("handleProtocolVersions: scan error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if restoredFrom.Valid {
+			n := int(restoredFrom.Int64)
+			v.RestoredFrom = &n
+		}
+		out = append(out, v)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// handleProtocolVersion returns one version including its data.
+// GET /api/protocols/{id}/versions/{version}
+func (a *App) handleProtocolVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	protocolID, ok := protocolIDFromPath(r)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	version, ok := versionFromPath(r)
+	if !ok {
+		http.Error(w, "invalid version", http.StatusBadRequest)
+		return
+	}
+
+	canRead, _, err := a.protocolAccess(protocolID, userID)
+	if err == sql.ErrNoRows || (err == nil && !canRead) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("handleProtocolVersion: access error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	v, err := a.loadProtocolVersion(protocolID, version)
+	if err == sql.ErrNoRows {
+		http.Error(w, "version not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("handleProtocolVersion: db error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleRestoreProtocolVersion copies an old version forward as the new
+// head. History is never rewritten. Like a save it needs If-Match with the
+// head it was chosen from ("*" to restore over whatever is there).
+// POST /api/protocols/{id}/versions/{version}/restore
+func (a *App) handleRestoreProtocolVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	protocolID, ok := protocolIDFromPath(r)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	version, ok := versionFromPath(r)
+	if !ok {
+		http.Error(w, "invalid version", http.StatusBadRequest)
+		return
+	}
+
+	canRead, canEdit, err := a.protocolAccess(protocolID, userID)
+	if err == sql.ErrNoRows || (err == nil && !canRead) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("handleRestoreProtocolVersion: access error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if !canEdit {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	old, err := a.loadProtocolVersion(protocolID, version)
+	if err == sql.ErrNoRows {
+		http.Error(w, "version not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("handleRestoreProtocolVersion: load error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	baseVersion, sent, err := ifMatchVersion(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !sent {
+		http.Error(w, "If-Match header required to restore a version", http.StatusPreconditionRequired)
+		return
+	}
+
+	newVersion, err := a.appendProtocolVersion(protocolID, old.Name, old.Data, userID, &version, baseVersion)
+	if err == errVersionConflict {
+		a.writeVersionConflict(w, protocolID, userID)
+		return
+	}
+	if err != nil {
+		log.Printf("handleRestoreProtocolVersion: append error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", protocolETag(newVersion))
+	json.NewEncoder(w).Encode(map[string]any{
+		"ok":           true,
+		"id":           protocolID,
+		"version":      newVersion,
+		"restoredFrom": version,
+	})
+}
+
+// handleProtocolDiff compares two versions of a protocol. "to" defaults
+// to the current head.
+// GET /api/protocols/{id}/diff?from=3&to=5
+func (a *App) handleProtocolDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	protocolID, ok := protocolIDFromPath(r)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	canRead, _, err := a.protocolAccess(protocolID, userID)
+	if err == sql.ErrNoRows || (err == nil && !canRead) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("handleProtocolDiff: access error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	from, err := strconv.Atoi(r.URL.Query().Get("from"))
+	if err != nil || from <= 0 {
+		http.Error(w, "from version required", http.StatusBadRequest)
+		return
+	}
+
+	var to int
+	if toStr := r.URL.Query().Get("to"); toStr != "" {
+		to, err = strconv.Atoi(toStr)
+		if err != nil || to <= 0 {
+			http.Error(w, "invalid to version", http.StatusBadRequest)
+			return
+		}
+	} else if err := a.db.QueryRow(`SELECT current_version FROM protocols WHERE id = ?`, protocolID).Scan(&to); err != nil {
+		log.Printf("handleProtocolDiff: head lookup error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	var versions [2]*ProtocolVersion
+	for i, n := range []int{from, to} {
+		versions[i], err = a.loadProtocolVersion(protocolID, n)
+		if err == sql.ErrNoRows {
+			http.Error(w, fmt.Sprintf("version %d not found", n), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("handleProtocolDiff: load error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	diff := protocol.Compare(versions[0].Data, versions[1].Data)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":          protocolID,
+		"from":        from,
+		"to":          to,
+		"nameChanged": versions[0].Name != versions[1].Name,
+		"identical":   diff.Empty(),
+		"diff":        diff,
+	})
+}
+
+/* ======================================================
+   Protocol trash
+   ====================================================== */
+
+const defaultTrashRetentionDays = 30
+
+// protocolTrashRetention is how long deleted protocols stay restorable,
+// from PROTOCOL_TRASH_RETENTION_DAYS (default 30).
+func protocolTrashRetention() time.Duration {
+	days := defaultTrashRetentionDays
+	if v := os.Getenv("PROTOCOL_TRASH_RETENTION_DAYS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("PROTOCOL_TRASH_RETENTION_DAYS=%q is not a number of days; using %d", v, days)
+		} else {
+			days = n
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+type trashedProtocol struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Version   int       `json:"version"`
+	DeletedAt time.Time `json:"deleted_at"`
+	PurgeAt   time.Time `json:"purge_at"`
+}
+
+// handleProtocolTrash lists deleted protocols the caller could edit.
+// GET /api/protocols/trash
+func (a *App) handleProtocolTrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := a.db.Query(`
+        SELECT p.id, p.name, p.current_version, p.deleted_at
+        FROM protocols p
+        WHERE `+protocolOwnedBy+` AND p.deleted_at IS NOT NULL
+        ORDER BY p.deleted_at DESC
+    `, userID, userID)
+	if err != nil {
+		log.Printf("handleProtocolTrash: db error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	retention := protocolTrashRetention()
+	out := []trashedProtocol{}
+	for rows.Next() {
+		var p trashedProtocol
+		if err := rows.Scan(&p.ID, &p.Name, &p.Version, &p.DeletedAt); err != nil {
+			log.Printf("handleProtocolTrash: scan error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		p.PurgeAt = p.DeletedAt.Add(retention)
+		out = append(out, p)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// handleRestoreProtocol takes a protocol the caller owns out of the trash.
+// POST /api/protocols/{id}/restore
+func (a *App) handleRestoreProtocol(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, ok := protocolIDFromPath(r)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	res, err := a.db.Exec(`
+        UPDATE protocols AS p
+        SET deleted_at = NULL, updated_at = CURRENT_TIMESTAMP
+        WHERE p.id = ? AND `+protocolOwnedBy+` AND p.deleted_at IS NOT NULL
+    `, id, userID, userID)
+	if err != nil {
+		log.Printf("handleRestoreProtocol: update error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	rows, _ := res.RowsAffected()
+	if rows == 0 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"ok": true,
+		"id": id,
+	})
+}
+
+// purgeDeletedProtocols permanently removes protocols that have been in the
+// trash longer than retention. Versions, test cases and status events go
+// with them through ON DELETE CASCADE.
+func (a *App) purgeDeletedProtocols(retention time.Duration) (int64, error) {
+	cutoff := time.Now().UTC().Add(-retention).Format("2006-01-02 15:04:05")
+	res, err := a.db.Exec(`
+        DELETE FROM protocols
+        WHERE deleted_at IS NOT NULL AND deleted_at <= ?
+    `, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// runProtocolPurger purges the trash now and then every interval. It never
+// returns.
+func (a *App) runProtocolPurger(retention, interval time.Duration) {
+	for {
+		n, err := a.purgeDeletedProtocols(retention)
+		if err != nil {
+			log.Printf("runProtocolPurger: purge error: %v", err)
+		} else if n > 0 {
+			log.Printf("runProtocolPurger: purged %d deleted protocol(s)", n)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// ensureProtocolDeletedAt adds protocols.deleted_at to older databases.
+func ensureProtocolDeletedAt(db *sql.DB) error {
+	has, err := columnExists(db, "protocols", "deleted_at")
+	if err != nil || has {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE protocols ADD COLUMN deleted_at DATETIME;`)
+	return err
+}
+
+/* ======================================================
+   Teams
+   ====================================================== */
+
+// Team roles, most privileged first. Owners manage membership; owners and
+// editors can change the team's protocols and presets; viewers can read
+// the team's protocols once they are not private.
+const (
+	teamRoleOwner  = "owner"
+	teamRoleEditor = "editor"
+	teamRoleViewer = "viewer"
+)
+
+func validTeamRole(role string) bool {
+	return role == teamRoleOwner || role == teamRoleEditor || role == teamRoleViewer
+}
+
+// protocolEditableBy matches protocols (aliased p) userID may change: their
+// own, and their teams' where they are an owner or editor. Takes userID
+// twice.
+const protocolEditableBy = `(p.user_id = ? OR EXISTS (
+            SELECT 1 FROM team_members tm
+            WHERE tm.team_id = p.team_id AND tm.user_id = ? AND tm.role IN ('owner', 'editor')))`
+
+// protocolOwnedBy matches protocols (aliased p) userID owns: their creator
+// while they are personal, and their team's owners once a team has them.
+// Only owners change who can see a protocol, share it, move it or delete
+// it; editors change its content alone. Takes userID twice.
+const protocolOwnedBy = `(CASE WHEN p.team_id IS NULL THEN p.user_id = ? ELSE EXISTS (
+            SELECT 1 FROM team_members tm
+            WHERE tm.team_id = p.team_id AND tm.user_id = ? AND tm.role = 'owner') END)`
+
+// teamRole is userID's role in teamID, or "" if they are not a member.
+func (a *App) teamRole(teamID, userID int64) (string, error) {
+	var role string
+	err := a.db.QueryRow(`SELECT role FROM team_members WHERE team_id = ? AND user_id = ?`, teamID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// canEditForTeam reports whether userID may create or change things owned
+// by teamID.
+func (a *App) canEditForTeam(teamID, userID int64) (bool, error) {
+	role, err := a.teamRole(teamID, userID)
+	return role == teamRoleOwner || role == teamRoleEditor, err
+}
+
+type Team struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role"` // the caller's role
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type TeamMember struct {
+	UserID  int64     `json:"user_id"`
+	Email   string    `json:"email"`
+	Role    string    `json:"role"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+type createTeamRequest struct {
+	Name string `json:"name"`
+}
+
+// handleTeams lists the caller's teams (GET) or creates one with the
+// caller as its owner (POST).
+// /api/teams
+func (a *App) handleTeams(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := a.db.Query(`
+            SELECT t.id, t.name, tm.role, t.created_at
+            FROM teams t
+            JOIN team_members tm ON tm.team_id = t.id
+            WHERE tm.user_id = ?
+            ORDER BY t.name COLLATE NOCASE
+        `, userID)
+		if err != nil {
+			log.Printf("handleTeams: db error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		out := []Team{}
+		for rows.Next() {
+			var t Team
+			if err := rows.Scan(&t.ID, &t.Name, &t.Role, &t.CreatedAt); err != nil {
+				log.Printf("handleTeams: scan error: %v", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			out = append(out, t)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+
+	case http.MethodPost:
+		var req createTeamRequest
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimSpace(req.Name)
+		if name == "" {
+			http.Error(w, "name required", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := a.db.Begin()
+		if err != nil {
+			log.Printf("handleTeams: begin error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		res, err := tx.Exec(`INSERT INTO teams (name) VALUES (?)`, name)
+		if err != nil {
+			log.Printf("handleTeams: insert error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		teamID, _ := res.LastInsertId()
+
+		_, err = tx.Exec(`INSERT INTO team_members (team_id, user_id, role) VALUES (?, ?, ?)`, teamID, userID, teamRoleOwner)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("handleTeams: member insert error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"ok":   true,
+			"id":   teamID,
+			"name": name,
+		})
+
+	default:
+		http.Error(w, "use GET or POST", http.StatusMethodNotAllowed)
+	}
+}
+
+type teamMemberRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// handleTeamMembers lists a team's members (any member) or adds a member /
+// changes their role by email (owners only).
+// /api/teams/{id}/members
+func (a *App) handleTeamMembers(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	teamID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || teamID <= 0 {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	role, err := a.teamRole(teamID, userID)
+	if err != nil {
+		log.Printf("handleTeamMembers: role error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if role == "" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := a.db.Query(`
+            SELECT tm.user_id, u.email, tm.role, tm.added_at
+            FROM team_members tm
+            JOIN users u ON u.id = tm.user_id
+            WHERE tm.team_id = ?
+            ORDER BY u.email COLLATE NOCASE
+        `, teamID)
+		if err != nil {
+			log.Printf("handleTeamMembers: db error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		out := []TeamMember{}
+		for rows.Next() {
+			var m TeamMember
+			if err := rows.Scan(&m.UserID, &m.Email, &m.Role, &m.AddedAt); err != nil {
+				log.Printf("handleTeamMembers: scan error: %v", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			out = append(out, m)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+
+	case http.MethodPost:
+		if role != teamRoleOwner {
+			http.Error(w, "only team owners can manage members", http.StatusForbidden)
+			return
+		}
+
+		var req teamMemberRequest
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if !validTeamRole(req.Role) {
+			http.Error(w, "role must be owner, editor or viewer", http.StatusBadRequest)
+			return
+		}
+
+		var memberID int64
+		email := strings.TrimSpace(req.Email)
+		err := a.db.QueryRow(`SELECT id FROM users WHERE email = ? COLLATE NOCASE`, email).Scan(&memberID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "no user with that email", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("handleTeamMembers: user lookup error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+
+		if memberID == userID && req.Role != teamRoleOwner {
+			other, err := a.teamHasOtherOwner(teamID, userID)
+			if err != nil {
+				log.Printf("handleTeamMembers: owner check error: %v", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			if !other {
+				http.Error(w, "a team needs at least one owner", http.StatusConflict)
+				return
+			}
+		}
+
+		_, err = a.db.Exec(`
+            INSERT INTO team_members (team_id, user_id, role) VALUES (?, ?, ?)
+            ON CONFLICT(team_id, user_id) DO UPDATE SET role = excluded.role
+        `, teamID, memberID, req.Role)
+		if err != nil {
+			log.Printf("handleTeamMembers: upsert error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"ok":     true,
+			"userId": memberID,
+			"role":   req.Role,
+		})
+
+	default:
+		http.Error(w, "use GET or POST", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRemoveTeamMember removes a member. Owners can remove anyone;
+// everyone can remove themselves (leave).
+// DELETE /api/teams/{id}/members/{userId}
+func (a *App) handleRemoveTeamMember(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "use DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	teamID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || teamID <= 0 {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	memberID, err := strconv.ParseInt(r.PathValue("userId"), 10, 64)
+	if err != nil || memberID <= 0 {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	role, err := a.teamRole(teamID, userID)
+	if err != nil {
+		log.Printf("handleRemoveTeamMember: role error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if role == "" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if role != teamRoleOwner && memberID != userID {
+		http.Error(w, "only team owners can remove members", http.StatusForbidden)
+		return
+	}
+
+	memberRole, err := a.teamRole(teamID, memberID)
+	if err != nil {
+		log.Printf("handleRemoveTeamMember: role error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if memberRole == teamRoleOwner {
+		other, err := a.teamHasOtherOwner(teamID, memberID)
+		if err != nil {
+			log.Printf("handleRemoveTeamMember: owner check error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if !other {
+			http.Error(w, "a team needs at least one owner", http.StatusConflict)
+			return
+		}
+	}
+
+	res, err := a.db.Exec(`DELETE FROM team_members WHERE team_id = ? AND user_id = ?`, teamID, memberID)
+	if err != nil {
+		log.Printf("handleRemoveTeamMember: delete error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "not a member", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *App) teamHasOtherOwner(teamID, userID int64) (bool, error) {
+	var n int
+	err := a.db.QueryRow(`
+        SELECT COUNT(*) FROM team_members
+        WHERE team_id = ? AND user_id != ? AND role = ?
+    `, teamID, userID, teamRoleOwner).Scan(&n)
+	return n > 0, err
+}
+
+type protocolTeamRequest struct {
+	TeamID int64 `json:"teamId"` // 0 = back to the caller personally
+}
+
+// handleProtocolTeam hands a protocol to a team, or takes it back as the
+// caller's own. Only the protocol's team owner (or its creator, while it
+// is personal) may move it, and they must be able to edit in the target
+// team.
+// POST /api/protocols/{id}/team
+func (a *App) handleProtocolTeam(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, ok := protocolIDFromPath(r)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	var req protocolTeamRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	// Team editors and edit shares don't extend to moving the protocol
+	canManage, err := a.canManageProtocol(id, userID)
+	if err != nil {
+		log.Printf("handleProtocolTeam: access error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if !canManage {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	if req.TeamID > 0 {
+		ok, err := a.canEditForTeam(req.TeamID, userID)
+		if err != nil {
+			log.Printf("handleProtocolTeam: role error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "you must be an owner or editor of that team", http.StatusForbidden)
+			return
+		}
+		_, err = a.db.Exec(`
+            UPDATE protocols SET team_id = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?
+        `, req.TeamID, id)
+	} else {
+		// Leaving the team: the caller keeps it, and "team" visibility no
+		// longer means anything.
+		_, err = a.db.Exec(`
+            UPDATE protocols
+            SET team_id = NULL, user_id = ?, updated_at = CURRENT_TIMESTAMP,
+                visibility = CASE visibility WHEN 'team' THEN 'private' ELSE visibility END
+            WHERE id = ?
+        `, userID, id)
+	}
+	if err != nil {
+		log.Printf("handleProtocolTeam: update error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"ok":     true,
+		"id":     id,
+		"teamId": req.TeamID,
+	})
+}
+
+// ensureTeamColumns adds team ownership to protocols and column presets.
+// NULL means owned by a user (protocols) or shared by everyone (presets).
+func ensureTeamColumns(db *sql.DB) error {
+	for _, table := range []string{"protocols", "column_presets"} {
+		has, err := columnExists(db, table, "team_id")
+		if err != nil {
+			return err
+		}
+		if has {
+			continue
+		}
+		if _, err := db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN team_id INTEGER REFERENCES teams(id);`); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureHistoryOutlivesUsers rebuilds protocol_versions and
+// protocol_status_events from before teams, whose author/actor foreign
+// keys stopped a user who had ever saved a protocol from being deleted.
+// Now the reference is set to NULL and the history stays with the team.
+func ensureHistoryOutlivesUsers(db *sql.DB) error {
+	tables := []struct {
+		name, userColumn, ddl, columns string
+	}{
+		{
+			name:       "protocol_versions",
+			userColumn: "author_id",
+			ddl: `CREATE TABLE protocol_versions_new (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                protocol_id INTEGER NOT NULL,
+                version_number INTEGER NOT NULL,
+                name TEXT NOT NULL,
+                data TEXT NOT NULL,
+                author_id INTEGER,
+                restored_from INTEGER,
+                created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+                UNIQUE(protocol_id, version_number),
+                FOREIGN KEY(protocol_id) REFERENCES protocols(id) ON DELETE CASCADE,
+                FOREIGN KEY(author_id) REFERENCES users(id) ON DELETE SET NULL
+            )`,
+			columns: "id, protocol_id, version_number, name, data, author_id, restored_from, created_at",
+		},
+		{
+			name:       "protocol_status_events",
+			userColumn: "actor_id",
+			ddl: `CREATE TABLE protocol_status_events_new (
+                id INTEGER PRIMARY KEY AUTOINCREMENT,
+                protocol_id INTEGER NOT NULL,
+                version_number INTEGER NOT NULL,
+                from_status TEXT NOT NULL,
+                to_status TEXT NOT NULL,
+                actor_id INTEGER,
+                comment TEXT NOT NULL DEFAULT '',
+                created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+                FOREIGN KEY(protocol_id) REFERENCES protocols(id) ON DELETE CASCADE,
+                FOREIGN KEY(actor_id) REFERENCES users(id) ON DELETE SET NULL
+            )`,
+			columns: "id, protocol_id, version_number, from_status, to_status, actor_id, comment, created_at",
+		},
+	}
+
+	ctx := context.Background()
+	for _, t := range tables {
+		var onDelete string
+		err := db.QueryRow(`
+            SELECT on_delete FROM pragma_foreign_key_list(?) WHERE "from" = ?
+        `, t.name, t.userColumn).Scan(&onDelete)
+		if err != nil {
+			return err
+		}
+		if onDelete == "SET NULL" {
+			continue
+		}
+
+		// Foreign keys have to be off on this connection while the old
+		// table is dropped; the pragma is a no-op inside a transaction.
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		err = rebuildTable(ctx, conn, t.name, t.ddl, t.columns)
+		conn.Close()
+		if err != nil {
+			return fmt.Errorf("rebuild %s: %w", t.name, err)
+		}
+	}
+	return nil
+}
+
+func rebuildTable(ctx context.Context, conn *sql.Conn, name, ddl, columns string) error {
+	if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF`); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `PRAGMA foreign_keys = ON`)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmts := []string{
+		ddl,
+		`INSERT INTO ` + name + `_new (` + columns + `) SELECT ` + columns + ` FROM ` + name,
+		`DROP TABLE ` + name,
+		`ALTER TABLE ` + name + `_new RENAME TO ` + name,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+/* ======================================================
+   Protocol sharing
+   ====================================================== */
+
+const (
+	sharePermissionRead = "read"
+	sharePermissionEdit = "edit"
+)
+
+// ProtocolShare is one person a protocol is shared with.
+type ProtocolShare struct {
+	UserID     int64     `json:"user_id"`
+	Email      string    `json:"email"`
+	Permission string    `json:"permission"`
+	GrantedBy  string    `json:"granted_by,omitempty"` // email
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type shareProtocolRequest struct {
+	Email      string `json:"email"`
+	Permission string `json:"permission"` // read (default) or edit
+}
+
+// canManageProtocol reports whether userID owns protocol id (see
+// protocolOwnedBy): only they may change its visibility, share it, hand
+// out links to it, move it or delete it. Team editors and edit shares
+// cover the protocol's content alone.
+func (a *App) canManageProtocol(id, userID int64) (bool, error) {
+	var one int
+	err := a.db.QueryRow(`
+        SELECT 1 FROM protocols p
+        WHERE p.id = ? AND `+protocolOwnedBy+` AND p.deleted_at IS NULL
+    `, id, userID, userID).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// handleProtocolShares lists who a protocol is shared with (GET) or shares
+// it with someone by email (POST; sharing again changes the permission).
+// /api/protocols/{id}/shares
+func (a *App) handleProtocolShares(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, ok := protocolIDFromPath(r)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	canManage, err := a.canManageProtocol(id, userID)
+	if err != nil {
+		log.Printf("handleProtocolShares: access error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if !canManage {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := a.db.Query(`
+            SELECT s.user_id, u.email, s.permission, COALESCE(g.email, ''), s.created_at
+            FROM protocol_shares s
+            JOIN users u ON u.id = s.user_id
+            LEFT JOIN users g ON g.id = s.granted_by
+            WHERE s.protocol_id = ?
+            ORDER BY u.email COLLATE NOCASE
+        `, id)
+		if err != nil {
+			log.Printf("handleProtocolShares: db error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		out := []ProtocolShare{}
+		for rows.Next() {
+			var s ProtocolShare
+			if err := rows.Scan(&s.UserID, &s.Email, &s.Permission, &s.GrantedBy, &s.CreatedAt); err != nil {
+				log.Printf("handleProtocolShares: scan error: %v", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			out = append(out, s)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+
+	case http.MethodPost:
+		ct := r.Header.Get("Content-Type")
+		if ct != "" && !strings.HasPrefix(ct, "application/json") {
+			http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req shareProtocolRequest
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		email := strings.TrimSpace(req.Email)
+		if email == "" {
+			http.Error(w, "email required", http.StatusBadRequest)
+			return
+		}
+		if req.Permission == "" {
+			req.Permission = sharePermissionRead
+		}
+		if req.Permission != sharePermissionRead && req.Permission != sharePermissionEdit {
+			http.Error(w, "permission must be read or edit", http.StatusBadRequest)
+			return
+		}
+
+		var targetID, ownerID int64
+		err := a.db.QueryRow(`SELECT id FROM users WHERE email = ? COLLATE NOCASE`, email).Scan(&targetID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "no user with that email", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("handleProtocolShares: user lookup error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if err := a.db.QueryRow(`SELECT user_id FROM protocols WHERE id = ?`, id).Scan(&ownerID); err != nil {
+			log.Printf("handleProtocolShares: owner lookup error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if targetID == ownerID {
+			http.Error(w, "that user already owns this protocol", http.StatusBadRequest)
+			return
+		}
+
+		_, err = a.db.Exec(`
+            INSERT INTO protocol_shares (protocol_id, user_id, permission, granted_by)
+            VALUES (?, ?, ?, ?)
+            ON CONFLICT(protocol_id, user_id) DO UPDATE SET
+                permission = excluded.permission,
+                granted_by = excluded.granted_by
+        `, id, targetID, req.Permission, userID)
+		if err != nil {
+			log.Printf("handleProtocolShares: upsert error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"ok":         true,
+			"userId":     targetID,
+			"permission": req.Permission,
+		})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRevokeProtocolShare stops sharing a protocol with one user. People
+// it is shared with may also remove themselves.
+// DELETE /api/protocols/{id}/shares/{userId}
+func (a *App) handleRevokeProtocolShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "use DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, ok := protocolIDFromPath(r)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	targetID, err := strconv.ParseInt(r.PathValue("userId"), 10, 64)
+	if err != nil || targetID <= 0 {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	if targetID != userID {
+		canManage, err := a.canManageProtocol(id, userID)
+		if err != nil {
+			log.Printf("handleRevokeProtocolShare: access error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if !canManage {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	res, err := a.db.Exec(`DELETE FROM protocol_shares WHERE protocol_id = ? AND user_id = ?`, id, targetID)
+	if err != nil {
+		log.Printf("handleRevokeProtocolShare: delete error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "not shared with that user", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"ok":     true,
+		"userId": targetID,
+	})
+}
+
+/* ======================================================
+   Protocol export
+   ====================================================== */
+
+// handleExportProtocol returns the JSON Xtract consumes for a protocol's
+// approved version, built the way stripUiMeta builds it in the browser.
+// The body is canonical (fixed key order, compact), and its SHA-256 is sent
+// as the ETag and Content-Digest so pollers can skip unchanged protocols
+// with If-None-Match. Public protocols can be exported without signing in.
+// GET /api/protocols/{id}/export
+func (a *App) handleExportProtocol(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := a.getUserIDFromRequest(r) // 0 when signed out
+
+	id, ok := protocolIDFromPath(r)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	p, err := a.getProtocol(id, userID)
+	if err == errNotFound {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("handleExportProtocol: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	export, version, err := a.approvedExport(p)
+	if err == errNotApproved {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("handleExportProtocol: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	body, hash, err := export.Canonical()
+	if err != nil {
+		log.Printf("handleExportProtocol: encode error: %v", err)
+		http.Error(w, "encode error", http.StatusInternalServerError)
+		return
+	}
+
+	etag := `"sha256-` + hash + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("X-Protocol-Version", strconv.Itoa(version))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	sum, _ := hex.DecodeString(hash)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum)+":")
+	w.Write(body)
+}
+
+/* ======================================================
+   Protocol schema
+   ====================================================== */
+
+// handleProtocolSchema publishes the JSON Schema that saves and imports
+// are checked against, for teams writing their own tools. No login needed.
+// GET /api/schema/protocol.json
+func (a *App) handleProtocolSchema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := protocol.SchemaJSON()
+	if err != nil {
+		log.Printf("handleProtocolSchema: encode error: %v", err)
+		http.Error(w, "schema error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(body)
+}
+
+/* ======================================================
+   Protocol import
+   ====================================================== */
+
+type importProtocolRequest struct {
+	Name   string          `json:"name"`
+	Data   json.RawMessage `json:"data"`   // Xtract JSON (object or string)
+	TeamID int64           `json:"teamId"` // optional; import into a team
+}
+
+// handleImportProtocol saves a hand-written Xtract protocol (columns,
+// calculationRules and namedFunctions only) as a normal editable protocol.
+// Functions and rules the builder would have generated are read back into
+// scoring configs and tab behaviours; the rest is kept as custom code and
+// listed in the report.
+// POST /api/protocols/import
+func (a *App) handleImportProtocol(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ct := r.Header.Get("Content-Type")
+	if ct != "" && !strings.HasPrefix(ct, "application/json") {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var req importProtocolRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(bytes.TrimSpace(req.Data)) == 0 {
+		http.Error(w, "name and data required", http.StatusBadRequest)
+		return
+	}
+
+	src, problems := checkProtocolData(req.Data)
+	if src == nil {
+		writeProtocolProblems(w, problems)
+		return
+	}
+
+	imported, report := protocol.Import(src)
+	doc := protocol.Compile(imported)
+	if err := protocol.Validate(doc); err != nil {
+		var verr *protocol.ValidationError
+		if errors.As(err, &verr) {
+			writeProtocolProblems(w, verr.Problems)
+			return
+		}
+		writeProtocolProblems(w, []protocol.Problem{{Path: "data", Message: err.Error()}})
+		return
+	}
+
+	if req.TeamID > 0 {
+		ok, err := a.canEditForTeam(req.TeamID, userID)
+		if err != nil {
+			log.Printf("handleImportProtocol: team role error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "you must be an owner or editor of that team", http.StatusForbidden)
+			return
+		}
+	}
+
+	newID, version, err := a.createProtocol(userID, req.TeamID, name, doc, nil)
+	if err != nil {
+		log.Printf("handleImportProtocol: insert error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", protocolETag(version))
+	json.NewEncoder(w).Encode(map[string]any{
+		"ok":      true,
+		"id":      newID,
+		"version": version,
+		"report":  report,
+	})
+}
+
+/* ======================================================
+   Protocol share links
+   ====================================================== */
+
+// ShareLink is an unguessable URL that shows one protocol, read-only, to
+// anyone holding it.
+type ShareLink struct {
+	ID         int64      `json:"id"`
+	Token      string     `json:"token"`
+	URL        string     `json:"url"`
+	CreatedBy  string     `json:"created_by,omitempty"` // email
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+type createShareLinkRequest struct {
+	ExpiresInDays int `json:"expiresInDays"` // 0 = never expires
+}
+
+func shareLinkURL(token string) string {
+	return "/shared/" + token
+}
+
+// handleProtocolShareLinks lists a protocol's share links (GET) or creates
+// one (POST). Only people who can manage the protocol may do either.
+// /api/protocols/{id}/links
+func (a *App) handleProtocolShareLinks(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, ok := protocolIDFromPath(r)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	canManage, err := a.canManageProtocol(id, userID)
+	if err != nil {
+		log.Printf("handleProtocolShareLinks: access error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if !canManage {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := a.db.Query(`
+            SELECT l.id, l.token, COALESCE(u.email, ''), l.created_at, l.expires_at, l.revoked_at, l.last_used_at
+            FROM protocol_share_links l
+            LEFT JOIN users u ON u.id = l.created_by
+            WHERE l.protocol_id = ?
+            ORDER BY l.created_at DESC, l.id DESC
+        `, id)
+		if err != nil {
+			log.Printf("handleProtocolShareLinks: db error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		out := []ShareLink{}
+		for rows.Next() {
+			var l ShareLink
+			if err := rows.Scan(&l.ID, &l.Token, &l.CreatedBy, &l.CreatedAt, &l.ExpiresAt, &l.RevokedAt, &l.LastUsedAt); err != nil {
+				log.Printf("handleProtocolShareLinks: scan error: %v", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			l.URL = shareLinkURL(l.Token)
+			out = append(out, l)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+
+	case http.MethodPost:
+		var req createShareLinkRequest
+		if r.ContentLength != 0 {
+			if err := decodeJSONBody(w, r, &req); err != nil {
+				http.Error(w, "invalid JSON", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.ExpiresInDays < 0 {
+			http.Error(w, "expiresInDays must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		token, err := a.generateSessionID()
+		if err != nil {
+			log.Printf("handleProtocolShareLinks: token error: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		var expiresAt any
+		if req.ExpiresInDays > 0 {
+			expiresAt = time.Now().UTC().AddDate(0, 0, req.ExpiresInDays).Format("2006-01-02 15:04:05")
+		}
+
+		res, err := a.db.Exec(`
+            INSERT INTO protocol_share_links (token, protocol_id, created_by, expires_at)
+            VALUES (?, ?, ?, ?)
+        `, token, id, userID, expiresAt)
+		if err != nil {
+			log.Printf("handleProtocolShareLinks: insert error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		linkID, _ := res.LastInsertId()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{
+			"ok":        true,
+			"id":        linkID,
+			"token":     token,
+			"url":       shareLinkURL(token),
+			"expiresAt": expiresAt,
+		})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRevokeProtocolShareLink stops a share link from working. The row
+// is kept so the link list shows when it was revoked.
+// DELETE /api/protocols/{id}/links/{linkId}
+func (a *App) handleRevokeProtocolShareLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "use DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, ok := protocolIDFromPath(r)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	linkID, err := strconv.ParseInt(r.PathValue("linkId"), 10, 64)
+	if err != nil || linkID <= 0 {
+		http.Error(w, "invalid link id", http.StatusBadRequest)
+		return
+	}
+
+	canManage, err := a.canManageProtocol(id, userID)
+	if err != nil {
+		log.Printf("handleRevokeProtocolShareLink: access error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if !canManage {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	res, err := a.db.Exec(`
+        UPDATE protocol_share_links SET revoked_at = CURRENT_TIMESTAMP
+        WHERE id = ? AND protocol_id = ? AND revoked_at IS NULL
+    `, linkID, id)
+	if err != nil {
+		log.Printf("handleRevokeProtocolShareLink: update error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "link not found or already revoked", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"ok": true,
+		"id": linkID,
+	})
+}
+
+// sharedProtocol resolves a share link token to its protocol's metadata,
+// or errNotFound when the token is unknown, revoked or expired, or the
+// protocol is in the trash. Callers serve the approved version through
+// approvedExport, never the draft head.
+func (a *App) sharedProtocol(token string) (*Protocol, error) {
+	now := time.Now().UTC().Format("2006-01-02 15:04:05")
+
+	var linkID, protocolID int64
+	err := a.db.QueryRow(`
+        SELECT l.id, l.protocol_id
+        FROM protocol_share_links l
+        JOIN protocols p ON p.id = l.protocol_id
+        WHERE l.token = ? AND l.revoked_at IS NULL
+          AND (l.expires_at IS NULL OR l.expires_at > ?)
+          AND p.deleted_at IS NULL
+    `, token, now).Scan(&linkID, &protocolID)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, _ = a.db.Exec(`UPDATE protocol_share_links SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?`, linkID)
+
+	var p Protocol
+	if err := scanProtocolRow(a.db.QueryRow(protocolListSelect+`WHERE p.id = ?`, 0, protocolID), &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// handleSharedProtocol returns what the read-only page at /shared/{token}
+// shows: the protocol's name and its approved version's exported JSON, or
+// 409 when nothing is approved. No login.
+// GET /api/shared/{token}
+func (a *App) handleSharedProtocol(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p, err := a.sharedProtocol(r.PathValue("token"))
+	if err == errNotFound {
+		http.Error(w, "this link is invalid, revoked or expired", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("handleSharedProtocol: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	export, version, err := a.approvedExport(p)
+	if err == errNotApproved {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("handleSharedProtocol: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]any{
+		"name":     p.Name,
+		"version":  version,
+		"status":   p.Status,
+		"protocol": export,
+	})
+}
+
+// handleSharedProtocolExport serves a shared protocol's approved version as
+// a download, exactly what /export hands Xtract. No login.
+// GET /api/shared/{token}/export
+func (a *App) handleSharedProtocolExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p, err := a.sharedProtocol(r.PathValue("token"))
+	if err == errNotFound {
+		http.Error(w, "this link is invalid, revoked or expired", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("handleSharedProtocolExport: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	export, version, err := a.approvedExport(p)
+	if err == errNotApproved {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("handleSharedProtocolExport: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	out, err := protocol.MarshalIndent(export)
+	if err != nil {
+		log.Printf("handleSharedProtocolExport: encode error: %v", err)
+		http.Error(w, "encode error", http.StatusInternalServerError)
+		return
+	}
+
+	filename := protocol.SanitizeForFunctionName(p.Name)
+	if filename == "" {
+		filename = "protocol"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-v%d.json"`, filename, version))
+	w.Write(out)
+}
+
+/* ======================================================
+   Protocol visibility
+   ====================================================== */
+
+type protocolVisibilityRequest struct {
+	Visibility string `json:"visibility"`
+}
+
+// handleProtocolVisibility lets the owner move a protocol between
+// visibility levels, including back to private.
+// POST /api/protocols/{id}/visibility
+func (a *App) handleProtocolVisibility(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, ok := protocolIDFromPath(r)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	var req protocolVisibilityRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	err := a.setProtocolVisibility(id, userID, req.Visibility)
+	if err == errNotFound {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err == errInvalidVisibility || err == errNoTeam {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("handleProtocolVisibility: update error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"ok":         true,
+		"id":         id,
+		"visibility": req.Visibility,
+	})
+}
+
+// ensureProtocolVisibility adds protocols.visibility. Protocols published
+// with the old is_public flag were visible to every signed-in user, which
+// is now "organization".
+func ensureProtocolVisibility(db *sql.DB) error {
+	has, err := columnExists(db, "protocols", "visibility")
+	if err != nil || has {
+		return err
+	}
+
+	if _, err := db.Exec(`ALTER TABLE protocols ADD COLUMN visibility TEXT NOT NULL DEFAULT 'private';`); err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE protocols SET visibility = 'organization' WHERE is_public = 1;`)
+	return err
+}
+
+/* ======================================================
+   Protocol forks
+   ====================================================== */
+
+// protocolHead is the current name and version of a protocol, as recorded
+// on a fork of it.
+func (a *App) protocolHead(id int64) (*ProtocolRef, error) {
+	ref := &ProtocolRef{ID: id}
+	err := a.db.QueryRow(`SELECT name, current_version FROM protocols WHERE id = ?`, id).Scan(&ref.Name, &ref.Version)
+	if err != nil {
+		return nil, err
+	}
+	return ref, nil
+}
+
+type forkProtocolRequest struct {
+	Name   string `json:"name"`   // optional; defaults to "<source name> (fork)"
+	TeamID int64  `json:"teamId"` // optional; fork into a team
+}
+
+// handleForkProtocol copies the head of a readable protocol into a new
+// protocol owned by the caller, remembering where it came from.
+// POST /api/protocols/{id}/fork
+func (a *App) handleForkProtocol(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	sourceID, ok := protocolIDFromPath(r)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	var req forkProtocolRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+
+	src, err := a.getProtocol(sourceID, userID)
+	if err == errNotFound {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("handleForkProtocol: load error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = src.Name + " (fork)"
+	}
+
+	source := &ProtocolRef{ID: src.ID, Version: src.Version, Name: src.Name}
+	if req.TeamID > 0 {
+		ok, err := a.canEditForTeam(req.TeamID, userID)
+		if err != nil {
+			log.Printf("handleForkProtocol: team role error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "you must be an owner or editor of that team", http.StatusForbidden)
+			return
+		}
+	}
+
+	newID, version, err := a.createProtocol(userID, req.TeamID, name, src.Data, source)
+	if err != nil {
+		log.Printf("handleForkProtocol: insert error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", protocolETag(version))
+	json.NewEncoder(w).Encode(map[string]any{
+		"ok":         true,
+		"id":         newID,
+		"name":       name,
+		"version":    version,
+		"forkedFrom": source,
+	})
+}
+
+type protocolFork struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	OwnerEmail  string    `json:"owner_email"`
+	FromVersion int       `json:"from_version"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// handleProtocolForks lets a protocol's owner see who forked it.
+// GET /api/protocols/{id}/forks
+func (a *App) handleProtocolForks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	protocolID, ok := protocolIDFromPath(r)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	canRead, canEdit, err := a.protocolAccess(protocolID, userID)
+	if err == sql.ErrNoRows || (err == nil && !canRead) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("handleProtocolForks: access error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if !canEdit {
+		http.Error(w, "only the owner can see forks", http.StatusForbidden)
+		return
+	}
+
+	rows, err := a.db.Query(`
+        SELECT f.id, f.name, COALESCE(u.email, ''), f.forked_from_version, f.created_at
+        FROM protocols f
+        LEFT JOIN users u ON u.id = f.user_id
+        WHERE f.forked_from_id = ? AND f.deleted_at IS NULL
+        ORDER BY f.created_at DESC
+    `, protocolID)
+	if err != nil {
+		log.Printf("handleProtocolForks: db error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	out := []protocolFork{}
+	for rows.Next() {
+		var f protocolFork
+		if err := rows.Scan(&f.ID, &f.Name, &f.OwnerEmail, &f.FromVersion, &f.CreatedAt); err != nil {
+			log.Printf("handleProtocolForks: scan error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		out = append(out, f)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// ensureProtocolForkColumns adds the fork lineage columns to older
+// databases. Forks are not foreign keys: a fork outlives its source.
+func ensureProtocolForkColumns(db *sql.DB) error {
+	for _, col := range []string{"forked_from_id", "forked_from_version"} {
+		has, err := columnExists(db, "protocols", col)
+		if err != nil {
+			return err
+		}
+		if has {
+			continue
+		}
+		if _, err := db.Exec(`ALTER TABLE protocols ADD COLUMN ` + col + ` INTEGER;`); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* ======================================================
+   Protocol lifecycle
+   ====================================================== */
+
+// protocolTransition is one allowed move between lifecycle states.
+type protocolTransition struct {
+	from     []string
+	to       string
+	reviewer bool // reviewer action; otherwise the owner's
+}
+
+var protocolTransitions = map[string]protocolTransition{
+	"submit":   {from: []string{statusDraft}, to: statusInReview},
+	"withdraw": {from: []string{statusInReview}, to: statusDraft},
+	"approve":  {from: []string{statusInReview}, to: statusApproved, reviewer: true},
+	"reject":   {from: []string{statusInReview}, to: statusDraft, reviewer: true},
+	"retire":   {from: []string{statusDraft, statusApproved}, to: statusRetired},
+	"reopen":   {from: []string{statusRetired}, to: statusDraft},
+}
+
+// isReviewer reports whether the user may approve protocols. Admins always can.
+func (a *App) isReviewer(userID int64) (bool, error) {
+	var isAdmin, isReviewer int
+	err := a.db.QueryRow(`SELECT is_admin, is_reviewer FROM users WHERE id = ?`, userID).Scan(&isAdmin, &isReviewer)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return isAdmin == 1 || isReviewer == 1, nil
+}
+
+// errNotApproved means a protocol has nothing that may go to Xtract: no
+// version has been approved, or it has been retired.
+var errNotApproved = errors.New("protocol has no approved version to export, or it is retired")
+
+// approvedExport is the Xtract export of p's approved version. Every path
+// that hands out export JSON goes through here, so drafts and in-review
+// edits never reach Xtract, and the export is always compiled from the
+// version's scoringConfigs rather than whatever functions were stored
+// with it. Versions from before the builder settings were kept (only
+// hand-written functions, no scoringConfigs or customFunctions) are
+// imported first so Compile keeps their code.
+func (a *App) approvedExport(p *Protocol) (*protocol.Export, int, error) {
+	if p.ApprovedVersion == nil || p.Status == statusRetired {
+		return nil, 0, errNotApproved
+	}
+
+	v, err := a.loadProtocolVersion(p.ID, *p.ApprovedVersion)
+	if err != nil {
+		return nil, 0, fmt.Errorf("approved version %d: %w", *p.ApprovedVersion, err)
+	}
+	doc := v.Data
+	if len(doc.ScoringConfigs) == 0 && len(doc.CustomFunctions) == 0 && len(doc.CustomRules) == 0 && len(doc.NamedFunctions) > 1 {
+		doc, _ = protocol.Import(doc)
+	}
+	return protocol.StripUIMeta(protocol.Compile(doc)), v.Version, nil
+}
+
+func recordStatusEventTx(tx *sql.Tx, protocolID int64, version int, from, to string, actorID int64, comment string) error {
+	_, err := tx.Exec(`
+        INSERT INTO protocol_status_events (protocol_id, version_number, from_status, to_status, actor_id, comment)
+        VALUES (?, ?, ?, ?, ?, ?)
+    `, protocolID, version, from, to, actorID, comment)
+	return err
+}
+
+type protocolTransitionRequest struct {
+	Action  string `json:"action"`
+	Comment string `json:"comment"`
+}
+
+type protocolStatusEvent struct {
+	Version    int       `json:"version"`
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	ActorID    int64     `json:"actor_id"`
+	ActorEmail string    `json:"actor_email"`
+	Comment    string    `json:"comment,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// handleProtocolTransitions moves a protocol through its lifecycle (POST)
+// or lists who moved it when (GET).
+// /api/protocols/{id}/transitions
+func (a *App) handleProtocolTransitions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	protocolID, ok := protocolIDFromPath(r)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	canRead, canEdit, err := a.protocolAccess(protocolID, userID)
+	if err == sql.ErrNoRows || (err == nil && !canRead) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("handleProtocolTransitions: access error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := a.db.Query(`
+            SELECT e.version_number, e.from_status, e.to_status, COALESCE(e.actor_id, 0), COALESCE(u.email, ''), e.comment, e.created_at
+            FROM protocol_status_events e
+            LEFT JOIN users u ON u.id = e.actor_id
+            WHERE e.protocol_id = ?
+            ORDER BY e.id DESC
+        `, protocolID)
+		if err != nil {
+			log.Printf("handleProtocolTransitions: db error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		out := []protocolStatusEvent{}
+		for rows.Next() {
+			var e protocolStatusEvent
+			if err := rows.Scan(&e.Version, &e.From, &e.To, &e.ActorID, &e.ActorEmail, &e.Comment, &e.CreatedAt); err != nil {
+				log.Printf("handleProtocolTransitions: scan error: %v", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			out = append(out, e)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+
+	case http.MethodPost:
+		var req protocolTransitionRequest
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		t, ok := protocolTransitions[req.Action]
+		if !ok {
+			http.Error(w, "unknown action", http.StatusBadRequest)
+			return
+		}
+
+		if t.reviewer {
+			reviewer, err := a.isReviewer(userID)
+			if err != nil {
+				log.Printf("handleProtocolTransitions: reviewer check error: %v", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			if !reviewer {
+				http.Error(w, "only reviewers can "+req.Action, http.StatusForbidden)
+				return
+			}
+			if canEdit {
+				http.Error(w, "you cannot review your own protocol", http.StatusForbidden)
+				return
+			}
+		} else if !canEdit {
+			http.Error(w, "only the owner can "+req.Action, http.StatusForbidden)
+			return
+		}
+
+		to, version, err := a.transitionProtocol(protocolID, t, userID, strings.TrimSpace(req.Comment))
+		if err == errInvalidTransition {
+			http.Error(w, "cannot "+req.Action+" from the current status", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("handleProtocolTransitions: transition error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"ok":      true,
+			"id":      protocolID,
+			"status":  to,
+			"version": version,
+		})
+
+	default:
+		http.Error(w, "use GET or POST", http.StatusMethodNotAllowed)
+	}
+}
+
+var errInvalidTransition = errors.New("invalid transition")
+
+// transitionProtocol applies t if the protocol is in one of its from
+// states, recording the audit event in the same transaction.
+func (a *App) transitionProtocol(protocolID int64, t protocolTransition, actorID int64, comment string) (string, int, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return "", 0, err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var version int
+	err = tx.QueryRow(`SELECT status, current_version FROM protocols WHERE id = ?`, protocolID).Scan(&status, &version)
+	if err != nil {
+		return "", 0, err
+	}
+
+	allowed := false
+	for _, f := range t.from {
+		if f == status {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return "", 0, errInvalidTransition
+	}
+
+	if t.to == statusApproved {
+		_, err = tx.Exec(`
+            UPDATE protocols SET status = ?, approved_version = ?, updated_at = CURRENT_TIMESTAMP
+            WHERE id = ?
+        `, t.to, version, protocolID)
+	} else {
+		_, err = tx.Exec(`
+            UPDATE protocols SET status = ?, updated_at = CURRENT_TIMESTAMP
+            WHERE id = ?
+        `, t.to, protocolID)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	if err := recordStatusEventTx(tx, protocolID, version, status, t.to, actorID, comment); err != nil {
+		return "", 0, err
+	}
+	return t.to, version, tx.Commit()
+}
+
+type setReviewerRequest struct {
+	UserID     int64 `json:"userId"`
+	IsReviewer bool  `json:"isReviewer"`
+}
+
+func (a *App) handleAdminSetReviewer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ct := r.Header.Get("Content-Type")
+	if ct != "" && !strings.HasPrefix(ct, "application/json") {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var req setReviewerRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if req.UserID <= 0 {
+		http.Error(w, "userId required", http.StatusBadRequest)
+		return
+	}
+
+	res, err := a.db.Exec(`UPDATE users SET is_reviewer = ? WHERE id = ?`, req.IsReviewer, req.UserID)
+	if err != nil {
+		log.Printf("handleAdminSetReviewer: update error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	rows, _ := res.RowsAffected()
+	if rows == 0 {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"ok":         true,
+		"userId":     req.UserID,
+		"isReviewer": req.IsReviewer,
+	})
+}
+
+// ensureProtocolLifecycleColumns adds protocols.status / approved_version
+// and users.is_reviewer to older databases.
+func ensureProtocolLifecycleColumns(db *sql.DB) error {
+	cols := []struct {
+		table, name, ddl string
+	}{
+		{"protocols", "status", `ALTER TABLE protocols ADD COLUMN status TEXT NOT NULL DEFAULT 'draft';`},
+		{"protocols", "approved_version", `ALTER TABLE protocols ADD COLUMN approved_version INTEGER;`},
+		{"users", "is_reviewer", `ALTER TABLE users ADD COLUMN is_reviewer INTEGER NOT NULL DEFAULT 0;`},
+	}
+
+	for _, c := range cols {
+		has, err := columnExists(db, c.table, c.name)
+		if err != nil {
+			return err
+		}
+		if has {
+			continue
+		}
+		if _, err := db.Exec(c.ddl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureProtocolVersions adds protocols.current_version and gives every
+// protocol saved before versioning existed a version 1 from its current data.
+func ensureProtocolVersions(db *sql.DB) error {
+	has, err := columnExists(db, "protocols", "current_version")
+	if err != nil {
+		return err
+	}
+	if !has {
+		if _, err := db.Exec(`ALTER TABLE protocols ADD COLUMN current_version INTEGER NOT NULL DEFAULT 0;`); err != nil {
+			return err
+		}
+	}
+
+	_, err = db.Exec(`
+        INSERT INTO protocol_versions (protocol_id, version_number, name, data, author_id, created_at)
+        SELECT p.id, 1, p.name, p.data, p.user_id, p.updated_at
+        FROM protocols p
+        WHERE NOT EXISTS (SELECT 1 FROM protocol_versions v WHERE v.protocol_id = p.id)
+    `)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`UPDATE protocols SET current_version = 1 WHERE current_version = 0`)
+	return err
+}
+
+// columnExists reports whether table has the named column.
+func columnExists(db *sql.DB, table, column string) (bool, error) {
+	rows, err := db.Query(`PRAGMA table_info(` + table + `);`)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid int
+		var name, colType string
+		var notnull, pk int
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notnull, &dflt, &pk); err != nil {
+			return false, err
+		}
+		if strings.EqualFold(name, column) {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+/* ======================================================
+   Protocol access + test cases
+   ====================================================== */
+
+// protocolAccess reports what userID may do with protocol id, counting
+// their team roles and shares. userID 0 is a signed-out reader. It returns
+// sql.ErrNoRows when the protocol does not exist.
+func (a *App) protocolAccess(id, userID int64) (canRead, canEdit bool, err error) {
+	var ownerID int64
+	var teamID sql.NullInt64
+	var visibility, status string
+	err = a.db.QueryRow(`
+        SELECT user_id, team_id, visibility, status FROM protocols
+        WHERE id = ? AND deleted_at IS NULL
+    `, id).Scan(&ownerID, &teamID, &visibility, &status)
+	if err != nil {
+		return false, false, err
+	}
+
+	if userID == 0 {
+		return visibility == visibilityPublic, false, nil
+	}
+
+	canEdit = ownerID == userID
+	canRead = canEdit || visibility == visibilityOrganization || visibility == visibilityPublic
+
+	// Team owners and editors edit the team's protocols; viewers read the
+	// ones that are not private
+	if teamID.Valid && !canEdit {
+		role, err := a.teamRole(teamID.Int64, userID)
+		if err != nil {
+			return false, false, err
+		}
+		switch role {
+		case teamRoleOwner, teamRoleEditor:
+			canEdit, canRead = true, true
+		case teamRoleViewer:
+			canRead = canRead || visibility != visibilityPrivate
+		}
+	}
+
+	if !canEdit {
+		var permission string
+		err := a.db.QueryRow(`
+            SELECT permission FROM protocol_shares WHERE protocol_id = ? AND user_id = ?
+        `, id, userID).Scan(&permission)
+		if err != nil && err != sql.ErrNoRows {
+			return false, false, err
+		}
+		switch permission {
+		case sharePermissionEdit:
+			canEdit, canRead = true, true
+		case sharePermissionRead:
+			canRead = true
+		}
+	}
+
+	// Reviewers need to see private protocols that are waiting on them
+	if !canRead && status == statusInReview {
+		canRead, err = a.isReviewer(userID)
+		if err != nil {
+			return false, false, err
+		}
+	}
+	return canRead, canEdit, nil
+}
+
+// protocolIDFromPath parses the {id} wildcard of /api/protocols/{id}/...
+func protocolIDFromPath(r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// loadProtocolDocument fetches and parses the stored protocol.
+func (a *App) loadProtocolDocument(id int64) (*protocol.Document, error) {
+	var data string
+	if err := a.db.QueryRow(`SELECT data FROM protocols WHERE id = ?`, id).Scan(&data); err != nil {
+		return nil, err
+	}
+	return loadProtocolData(data)
+}
+
+type protocolTestCaseDTO struct {
+	ID        int64             `json:"id"`
+	Case      protocol.TestCase `json:"case"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+func (a *App) handleProtocolTestCases(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	protocolID, ok := protocolIDFromPath(r)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	canRead, canEdit, err := a.protocolAccess(protocolID, userID)
+	if err == sql.ErrNoRows || (err == nil && !canRead) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("handleProtocolTestCases: access error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		cases, err := a.listProtocolTestCases(protocolID)
+		if err != nil {
+			log.Printf("handleProtocolTestCases: list error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cases)
+
+	case http.MethodPost:
+		// Create or replace a test case by name (owner only)
+		if !canEdit {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		var tc protocol.TestCase
+		if err := decodeJSONBody(w, r, &tc); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		tc.Name = strings.TrimSpace(tc.Name)
+		if tc.Name == "" || len(tc.Edits) == 0 || len(tc.Expected) == 0 {
+			http.Error(w, "name, edits and expected required", http.StatusBadRequest)
+			return
+		}
+
+		caseJSON, err := protocol.Marshal(tc)
+		if err != nil {
+			http.Error(w, "encode error", http.StatusInternalServerError)
+			return
+		}
+
+		_, err = a.db.Exec(`
+            INSERT INTO protocol_test_cases (protocol_id, name, case_json)
+            VALUES (?, ?, ?)
+            ON CONFLICT(protocol_id, name) DO UPDATE SET
+                case_json = excluded.case_json,
+                updated_at = CURRENT_TIMESTAMP
+        `, protocolID, tc.Name, string(caseJSON))
+		if err != nil {
+			log.Printf("handleProtocolTestCases: upsert error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"ok":   true,
+			"name": tc.Name,
+		})
+
+	case http.MethodDelete:
+		// DELETE /api/protocols/{id}/tests?name=... (owner only)
+		if !canEdit {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		name := strings.TrimSpace(r.URL.Query().Get("name"))
+		if name == "" {
+			http.Error(w, "missing name", http.StatusBadRequest)
+			return
+		}
+
+		res, err := a.db.Exec(`
+            DELETE FROM protocol_test_cases
+            WHERE protocol_id = ? AND name = ?
+        `, protocolID, name)
+		if err != nil {
+			log.Printf("handleProtocolTestCases: delete error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if rows, _ := res.RowsAffected(); rows == 0 {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *App) listProtocolTestCases(protocolID int64) ([]protocolTestCaseDTO, error) {
+	rows, err := a.db.Query(`
+        SELECT id, case_json, updated_at
+        FROM protocol_test_cases
+        WHERE protocol_id = ?
+        ORDER BY name COLLATE NOCASE ASC
+    `, protocolID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []protocolTestCaseDTO{}
+	for rows.Next() {
+		var dto protocolTestCaseDTO
+		var caseJSON string
+		if err := rows.Scan(&dto.ID, &caseJSON, &dto.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(caseJSON), &dto.Case); err != nil {
+			return nil, fmt.Errorf("test case %d: %w", dto.ID, err)
+		}
+		out = append(out, dto)
+	}
+	return out, rows.Err()
+}
+
+type runProtocolTestsRequest struct {
+	// Optional unsaved protocol to test instead of the stored one.
+	Data json.RawMessage `json:"data"`
+}
+
+// handleRunProtocolTests runs every stored test case for a protocol.
+// POST /api/protocols/{id}/test
+func (a *App) handleRunProtocolTests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	protocolID, ok := protocolIDFromPath(r)
+	if !ok {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	canRead, _, err := a.protocolAccess(protocolID, userID)
+	if err == sql.ErrNoRows || (err == nil && !canRead) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("handleRunProtocolTests: access error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	var req runProtocolTestsRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSONBody(w, r, &req); err != nil && err != io.EOF {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var doc *protocol.Document
+	if len(bytes.TrimSpace(req.Data)) > 0 {
+		doc, err = parseProtocolData(req.Data)
+		if err != nil {
+			writeProtocolProblems(w, []protocol.Problem{parseProblem(err)})
+			return
+		}
+	} else {
+		doc, err = a.loadProtocolDocument(protocolID)
+		if err != nil {
+			log.Printf("handleRunProtocolTests: load error: %v", err)
+			http.Error(w, "stored protocol is invalid", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	cases, err := a.listProtocolTestCases(protocolID)
+	if err != nil {
+		log.Printf("handleRunProtocolTests: list error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	results := []protocol.TestResult{}
+	passed := 0
+	for _, c := range cases {
+		res := protocol.RunTestCase(doc, c.Case)
+		if res.Passed {
+			passed++
+		}
+		results = append(results, res)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"ok":      passed == len(results),
+		"total":   len(results),
+		"passed":  passed,
+		"failed":  len(results) - passed,
+		"results": results,
+	})
+}
+
+func (a *App) generateSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := cryptoRand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func ensureIsAdminColumn(db *sql.DB) error {
+	rows, err := db.Query(`PRAGMA table_info(users);`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	hasIsAdmin := false
+	for rows.Next() {
+		var cid int
+		var name, colType string
+		var notnull, pk int
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notnull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == "is_admin" {
+			hasIsAdmin = true
+			break
+		}
+	}
+
+	if hasIsAdmin {
+		return nil // already exists
+	}
+
+	_, err = db.Exec(`ALTER TABLE users ADD COLUMN is_admin INTEGER NOT NULL DEFAULT 0;`)
+	return err
+}
+
+// --- Add is_approved column to users if missing ---
+func ensureIsApprovedColumn(db *sql.DB) error {
+	rows, err := db.Query(`PRAGMA table_info(users);`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	hasIsApproved := false
+	for rows.Next() {
+		var cid int
+		var name, colType string
+		var notnull, pk int
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notnull, &dflt, &pk); err != nil {
+			return err
+		}
+		if strings.EqualFold(name, "is_approved") {
+			hasIsApproved = true
+			break
+		}
+	}
+
+	if hasIsApproved {
+		return nil
+	}
+
+	// Add column with default 0 (false)
+	if _, err := db.Exec(`ALTER TABLE users ADD COLUMN is_approved INTEGER NOT NULL DEFAULT 0;`); err != nil {
+		return err
+	}
+
+	// Mark all existing users as approved so you don't lock yourself out
+	_, err = db.Exec(`UPDATE users SET is_approved = 1;`)
+	return err
+}
+
+// --- Add is_public column to protocols if missing ---
+func ensureIsPublicColumn(db *sql.DB) error {
+	rows, err := db.Query(`PRAGMA table_info(protocols);`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	found := false
+	for rows.Next() {
+		var cid int
+		var name, colType string
+		var notnull, pk int
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notnull, &dflt, &pk); err != nil {
+			return err
+		}
+		if strings.EqualFold(name, "is_public") {
+			found = true
+			break
+		}
+	}
+
+	if found {
+		return nil
+	}
+
+	_, err = db.Exec(`ALTER TABLE protocols ADD COLUMN is_public INTEGER NOT NULL DEFAULT 0;`)
+	return err
+}
+
+// Add this helper function to main.go
+func ensureAIUsageColumn(db *sql.DB) error {
+	rows, err := db.Query(`PRAGMA table_info(users);`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	hasCol := false
+	for rows.Next() {
+		var cid int
+		var name, colType string
+		var notnull, pk int
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notnull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == "ai_usage_count" {
+			hasCol = true
+			break
+		}
+	}
+
+	if !hasCol {
+		if _, err := db.Exec(`ALTER TABLE users ADD COLUMN ai_usage_count INTEGER NOT NULL DEFAULT 0;`); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ensureSecurityColumns(db *sql.DB) error {
+	rows, err := db.Query(`PRAGMA table_info(users);`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	hasFailedAttempts := false
+	hasLockoutUntil := false
+
+	for rows.Next() {
+		var cid int
+		var name, colType string
+		var notnull, pk int
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notnull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == "failed_attempts" {
+			hasFailedAttempts = true
+		}
+		if name == "lockout_until" {
+			hasLockoutUntil = true
+		}
+	}
+
+	if !hasFailedAttempts {
+		if _, err := db.Exec(`ALTER TABLE users ADD COLUMN failed_attempts INTEGER NOT NULL DEFAULT 0;`); err != nil {
+			return err
+		}
+	}
+	if !hasLockoutUntil {
+		if _, err := db.Exec(`ALTER TABLE users ADD COLUMN lockout_until DATETIME;`); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	defaultSessionMaxAge      = 7 * 24 * time.Hour
+	defaultSessionIdleTimeout = 12 * time.Hour
+
+	// last_seen_at is written at most this often per session, not on
+	// every request.
+	sessionTouchInterval = time.Minute
+)
+
+// durationFromEnv reads a whole number of units from the environment,
+// falling back to def when unset or invalid.
+func durationFromEnv(name string, unit, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Printf("%s=%q is not a positive number; using the default", name, v)
+		return def
+	}
+	return time.Duration(n) * unit
+}
+
+// clientIP is the address the request came from. Fly's proxy puts the real
+// client in Fly-Client-IP; it is only recorded for the session list.
+func clientIP(r *http.Request) string {
+	if ip := r.Header.Get("Fly-Client-IP"); ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (a *App) setSessionCookie(w http.ResponseWriter, r *http.Request, userID int64) error {
+	sid, err := a.generateSessionID()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	_, err = a.db.Exec(`
+        INSERT INTO sessions (id, user_id, created_at, expires_at, last_seen_at, user_agent, ip)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+    `, sid, userID, now.Format("2006-01-02 15:04:05"), now.Add(a.sessionMaxAge).Format("2006-01-02 15:04:05"),
+		now.Format("2006-01-02 15:04:05"), r.UserAgent(), clientIP(r))
+	if err != nil {
+		log.Printf("setSessionCookie: failed inserting session for user %d: %v", userID, err)
+		return err
+	}
+
+	log.Printf("setSessionCookie: created session %s for user %d", sid, userID)
+
+	http.SetCookie(w, &http.Cookie{
 		Name:     "session_id",
 		Value:    sid,
 		Path:     "/",
+		MaxAge:   int(a.sessionMaxAge.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   isProd(),
+	})
+
+	return nil
+}
+
+// getUserIDFromRequest resolves the session cookie to a user. Sessions past
+// their absolute expiry or idle for too long are deleted and rejected;
+// live ones have last_seen_at moved forward, which is what keeps an active
+// session from going idle.
+func (a *App) getUserIDFromRequest(r *http.Request) (int64, bool) {
+	c, err := r.Cookie("session_id")
+	if err != nil || c.Value == "" {
+		if err != nil {
+			log.Printf("getUserIDFromRequest: no cookie: %v", err)
+		} else {
+			log.Printf("getUserIDFromRequest: empty session_id cookie")
+		}
+		return 0, false
+	}
+
+	var uid int64
+	var expiresAt, lastSeen time.Time
+	err = a.db.QueryRow(`SELECT user_id, expires_at, last_seen_at FROM sessions WHERE id = ?`, c.Value).
+		Scan(&uid, &expiresAt, &lastSeen)
+	if err == sql.ErrNoRows {
+		log.Printf("getUserIDFromRequest: session %s not found", c.Value)
+		return 0, false
+	}
+	if err != nil {
+		log.Printf("getUserIDFromRequest: DB error for session %s: %v", c.Value, err)
+		return 0, false
+	}
+
+	now := time.Now().UTC()
+	if !now.Before(expiresAt) || now.Sub(lastSeen) >= a.sessionIdleTimeout {
+		log.Printf("getUserIDFromRequest: session %s expired", c.Value)
+		if _, err := a.db.Exec(`DELETE FROM sessions WHERE id = ?`, c.Value); err != nil {
+			log.Printf("getUserIDFromRequest: delete expired session error: %v", err)
+		}
+		return 0, false
+	}
+
+	if now.Sub(lastSeen) >= sessionTouchInterval {
+		_, err := a.db.Exec(`UPDATE sessions SET last_seen_at = ?, ip = ? WHERE id = ?`,
+			now.Format("2006-01-02 15:04:05"), clientIP(r), c.Value)
+		if err != nil {
+			log.Printf("getUserIDFromRequest: touch session error: %v", err)
+		}
+	}
+
+	log.Printf("getUserIDFromRequest: session %s -> user %d", c.Value, uid)
+	return uid, true
+}
+
+func (a *App) clearSession(w http.ResponseWriter, r *http.Request) {
+	c, err := r.Cookie("session_id")
+	if err == nil {
+		_, _ = a.db.Exec(`DELETE FROM sessions WHERE id = ?`, c.Value)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session_id",
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
 		HttpOnly: true,
 		SameSite: http.SameSiteLaxMode,
 		Secure:   isProd(),
 	})
+}
+
+// ensureSessionColumns adds expiry and device details to older sessions
+// tables. Existing sessions get the absolute lifetime counted from when
+// they were created.
+func ensureSessionColumns(db *sql.DB, maxAge time.Duration) error {
+	columns := []struct{ name, ddl string }{
+		{"expires_at", `ALTER TABLE sessions ADD COLUMN expires_at DATETIME;`},
+		{"last_seen_at", `ALTER TABLE sessions ADD COLUMN last_seen_at DATETIME;`},
+		{"user_agent", `ALTER TABLE sessions ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';`},
+		{"ip", `ALTER TABLE sessions ADD COLUMN ip TEXT NOT NULL DEFAULT '';`},
+	}
+	for _, c := range columns {
+		has, err := columnExists(db, "sessions", c.name)
+		if err != nil {
+			return err
+		}
+		if !has {
+			if _, err := db.Exec(c.ddl); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := db.Exec(`
+        UPDATE sessions
+        SET expires_at = COALESCE(expires_at, datetime(created_at, ?)),
+            last_seen_at = COALESCE(last_seen_at, created_at)
+        WHERE expires_at IS NULL OR last_seen_at IS NULL
+    `, fmt.Sprintf("+%d seconds", int(maxAge.Seconds())))
+	return err
+}
+
+// sweepSessions deletes sessions past their absolute expiry or idle
+// timeout. getUserIDFromRequest already refuses them; this just keeps the
+// table from growing.
+func (a *App) sweepSessions() (int64, error) {
+	now := time.Now().UTC()
+	res, err := a.db.Exec(`
+        DELETE FROM sessions
+        WHERE expires_at <= ? OR last_seen_at <= ?
+    `, now.Format("2006-01-02 15:04:05"), now.Add(-a.sessionIdleTimeout).Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// runSessionSweeper sweeps sessions now and then every interval. It never
+// returns.
+func (a *App) runSessionSweeper(interval time.Duration) {
+	for {
+		n, err := a.sweepSessions()
+		if err != nil {
+			log.Printf("runSessionSweeper: sweep error: %v", err)
+		} else if n > 0 {
+			log.Printf("runSessionSweeper: deleted %d dead session(s)", n)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// sessionHandle identifies a session in the session list without handing
+// the session ID itself (the cookie value) to page scripts.
+func sessionHandle(sid string) string {
+	sum := sha256.Sum256([]byte(sid))
+	return hex.EncodeToString(sum[:8])
+}
+
+type sessionInfo struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	// When it ends if left alone: the idle timeout or the absolute expiry.
+	ExpiresAt time.Time `json:"expires_at"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	Current   bool      `json:"current"`
+}
+
+// handleSessions lists the caller's live sessions (GET) or signs out every
+// session but the current one (DELETE).
+// /api/sessions
+func (a *App) handleSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	current, _ := r.Cookie("session_id")
+
+	switch r.Method {
+	case http.MethodGet:
+		now := time.Now().UTC()
+		rows, err := a.db.Query(`
+            SELECT id, created_at, last_seen_at, expires_at, user_agent, ip
+            FROM sessions
+            WHERE user_id = ? AND expires_at > ? AND last_seen_at > ?
+            ORDER BY last_seen_at DESC
+        `, userID, now.Format("2006-01-02 15:04:05"), now.Add(-a.sessionIdleTimeout).Format("2006-01-02 15:04:05"))
+		if err != nil {
+			log.Printf("handleSessions: query error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		list := []sessionInfo{}
+		for rows.Next() {
+			var sid string
+			var s sessionInfo
+			if err := rows.Scan(&sid, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt, &s.UserAgent, &s.IP); err != nil {
+				log.Printf("handleSessions: scan error: %v", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			if idle := s.LastSeenAt.Add(a.sessionIdleTimeout); idle.Before(s.ExpiresAt) {
+				s.ExpiresAt = idle
+			}
+			s.ID = sessionHandle(sid)
+			s.Current = current != nil && sid == current.Value
+			list = append(list, s)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("handleSessions: rows error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(list)
+
+	case http.MethodDelete:
+		res, err := a.db.Exec(`DELETE FROM sessions WHERE user_id = ? AND id != ?`, userID, current.Value)
+		if err != nil {
+			log.Printf("handleSessions: delete error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		n, _ := res.RowsAffected()
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"ok":      true,
+			"revoked": n,
+		})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRevokeSession signs out one of the caller's sessions. Revoking the
+// current one also clears the cookie.
+// DELETE /api/sessions/{id}
+func (a *App) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "use DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	handle := r.PathValue("id")
+	rows, err := a.db.Query(`SELECT id FROM sessions WHERE user_id = ?`, userID)
+	if err != nil {
+		log.Printf("handleRevokeSession: query error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	var target string
+	for rows.Next() {
+		var sid string
+		if err := rows.Scan(&sid); err != nil {
+			rows.Close()
+			log.Printf("handleRevokeSession: scan error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if sessionHandle(sid) == handle {
+			target = sid
+		}
+	}
+	rows.Close()
+	if target == "" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	if current, err := r.Cookie("session_id"); err == nil && current.Value == target {
+		a.clearSession(w, r)
+	} else if _, err := a.db.Exec(`DELETE FROM sessions WHERE id = ? AND user_id = ?`, target, userID); err != nil {
+		log.Printf("handleRevokeSession: delete error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"ok": true,
+	})
+}
+
+type promoteUserRequest struct {
+	UserID int64 `json:"userId"`
+}
+
+func (a *App) handleAdminPromote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ct := r.Header.Get("Content-Type")
+	if ct != "" && !strings.HasPrefix(ct, "application/json") {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var req promoteUserRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if req.UserID <= 0 {
+		http.Error(w, "userId required", http.StatusBadRequest)
+		return
+	}
+
+	res, err := a.db.Exec(`UPDATE users SET is_admin = 1 WHERE id = ?`, req.UserID)
+	if err != nil {
+		log.Printf("handleAdminPromote: update error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	rows, _ := res.RowsAffected()
+	if rows == 0 {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"ok":     true,
+		"userId": req.UserID,
+	})
+}
 
-	return nil
+func (a *App) handleAdminDemote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ct := r.Header.Get("Content-Type")
+	if ct != "" && !strings.HasPrefix(ct, "application/json") {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	var req promoteUserRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if req.UserID <= 0 {
+		http.Error(w, "userId required", http.StatusBadRequest)
+		return
+	}
+
+	// Optional but sensible: don't let an admin demote themself
+	currentID, ok := a.getUserIDFromRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if currentID == req.UserID {
+		http.Error(w, "cannot demote your own admin status", http.StatusBadRequest)
+		return
+	}
+
+	res, err := a.db.Exec(`UPDATE users SET is_admin = 0 WHERE id = ?`, req.UserID)
+	if err != nil {
+		log.Printf("handleAdminDemote: update error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	rows, _ := res.RowsAffected()
+	if rows == 0 {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"ok":     true,
+		"userId": req.UserID,
+	})
 }
 
-func (a *App) getUserIDFromRequest(r *http.Request) (int64, bool) {
-	c, err := r.Cookie("session_id")
-	if err != nil || c.Value == "" {
+/* ======================================================
+   Invitations
+   ====================================================== */
+
+// Roles an invitation can give the account created from it.
+const (
+	userRoleUser     = "user"
+	userRoleReviewer = "reviewer"
+	userRoleAdmin    = "admin"
+)
+
+// Invitations expire after this many days unless the admin picks otherwise.
+const defaultInvitationDays = 7
+
+func validUserRole(role string) bool {
+	return role == userRoleUser || role == userRoleReviewer || role == userRoleAdmin
+}
+
+// Invitation lets one email address sign up once, with a preassigned role
+// and without waiting for approval, whatever the signup policy.
+// The invite code itself is only stored hashed, so it is returned once,
+// when the invitation is created, and never listed.
+type Invitation struct {
+	ID         int64      `json:"id"`
+	Email      string     `json:"email"`
+	Role       string     `json:"role"`
+	CreatedBy  string     `json:"created_by,omitempty"` // email
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	RedeemedAt *time.Time `json:"redeemed_at,omitempty"`
+	RedeemedBy string     `json:"redeemed_by,omitempty"` // email
+}
+
+type createInvitationRequest struct {
+	Email         string `json:"email"`
+	Role          string `json:"role"`          // default user
+	ExpiresInDays int    `json:"expiresInDays"` // 0 = defaultInvitationDays
+}
+
+// invitationURL opens the sign-up form with the invite code filled in.
+func invitationURL(token string) string {
+	return "/?invite=" + token
+}
+
+// invitationTokenHash is what invitations stores in place of the invite
+// code, like passwordResetTokenHash for reset links.
+func invitationTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ensureInvitationTokenHashes upgrades invitations from before invite codes
+// were hashed: the token column is renamed and its codes replaced by their
+// hashes, so links already sent out keep working.
+func ensureInvitationTokenHashes(db *sql.DB) error {
+	has, err := columnExists(db, "invitations", "token")
+	if err != nil || !has {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`ALTER TABLE invitations RENAME COLUMN token TO token_hash`); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT id, token_hash FROM invitations`)
+	if err != nil {
+		return err
+	}
+	tokens := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var token string
+		if err := rows.Scan(&id, &token); err != nil {
+			rows.Close()
+			return err
+		}
+		tokens[id] = token
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, token := range tokens {
+		if _, err := tx.Exec(`UPDATE invitations SET token_hash = ? WHERE id = ?`, invitationTokenHash(token), id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// handleInvitations lists every invitation (GET) or creates one (POST).
+// Admin only.
+// /admin/invitations
+func (a *App) handleInvitations(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := a.db.Query(`
+            SELECT i.id, i.email, i.role, COALESCE(c.email, ''), i.created_at, i.expires_at,
+                   i.revoked_at, i.redeemed_at, COALESCE(u.email, '')
+            FROM invitations i
+            LEFT JOIN users c ON c.id = i.created_by
+            LEFT JOIN users u ON u.id = i.redeemed_by
+            ORDER BY i.created_at DESC, i.id DESC
+        `)
 		if err != nil {
-			log.Printf("getUserIDFromRequest: no cookie: %v", err)
-		} else {
-			log.Printf("getUserIDFromRequest: empty session_id cookie")
+			log.Printf("handleInvitations: db error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
 		}
-		return 0, false
+		defer rows.Close()
+
+		out := []Invitation{}
+		for rows.Next() {
+			var inv Invitation
+			if err := rows.Scan(&inv.ID, &inv.Email, &inv.Role, &inv.CreatedBy, &inv.CreatedAt,
+				&inv.ExpiresAt, &inv.RevokedAt, &inv.RedeemedAt, &inv.RedeemedBy); err != nil {
+				log.Printf("handleInvitations: scan error: %v", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			out = append(out, inv)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("handleInvitations: rows error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+
+	case http.MethodPost:
+		ct := r.Header.Get("Content-Type")
+		if ct != "" && !strings.HasPrefix(ct, "application/json") {
+			http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req createInvitationRequest
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		req.Email = strings.TrimSpace(req.Email)
+		if !strings.Contains(req.Email, "@") {
+			http.Error(w, "email required", http.StatusBadRequest)
+			return
+		}
+		if req.Role == "" {
+			req.Role = userRoleUser
+		}
+		if !validUserRole(req.Role) {
+			http.Error(w, "role must be user, reviewer or admin", http.StatusBadRequest)
+			return
+		}
+		if req.ExpiresInDays < 0 {
+			http.Error(w, "expiresInDays must not be negative", http.StatusBadRequest)
+			return
+		}
+		if req.ExpiresInDays == 0 {
+			req.ExpiresInDays = defaultInvitationDays
+		}
+
+		var exists int
+		if err := a.db.QueryRow(`SELECT COUNT(*) FROM users WHERE email = ? COLLATE NOCASE`, req.Email).Scan(&exists); err != nil {
+			log.Printf("handleInvitations: lookup error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if exists > 0 {
+			http.Error(w, "a user with that email already exists", http.StatusConflict)
+			return
+		}
+
+		userID, _ := a.getUserIDFromRequest(r)
+
+		token, err := a.generateSessionID()
+		if err != nil {
+			log.Printf("handleInvitations: token error: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		expiresAt := time.Now().UTC().AddDate(0, 0, req.ExpiresInDays).Format("2006-01-02 15:04:05")
+
+		res, err := a.db.Exec(`
+            INSERT INTO invitations (token_hash, email, role, created_by, expires_at)
+            VALUES (?, ?, ?, ?, ?)
+        `, invitationTokenHash(token), req.Email, req.Role, userID, expiresAt)
+		if err != nil {
+			log.Printf("handleInvitations: insert error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		invID, _ := res.LastInsertId()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{
+			"ok":        true,
+			"id":        invID,
+			"token":     token,
+			"url":       invitationURL(token),
+			"email":     req.Email,
+			"role":      req.Role,
+			"expiresAt": expiresAt,
+		})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRevokeInvitation stops an unused invitation from being redeemed.
+// The row is kept so the list shows when it was revoked.
+// DELETE /admin/invitations/{id}
+func (a *App) handleRevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "use DELETE", http.StatusMethodNotAllowed)
+		return
 	}
 
-	var uid int64
-	err = a.db.QueryRow(`SELECT user_id FROM sessions WHERE id = ?`, c.Value).Scan(&uid)
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	res, err := a.db.Exec(`
+        UPDATE invitations SET revoked_at = CURRENT_TIMESTAMP
+        WHERE id = ? AND revoked_at IS NULL AND redeemed_at IS NULL
+    `, id)
+	if err != nil {
+		log.Printf("handleRevokeInvitation: update error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "invitation not found, already used or already revoked", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"ok": true,
+		"id": id,
+	})
+}
+
+// invitationForSignup looks up the invitation behind an invite code given
+// at sign-up by email. It returns nil, nil when the code is not an
+// invitation token, so the signup policy's own codes still work, and a
+// signupRefused error when the invitation cannot be used.
+func (a *App) invitationForSignup(code, email string) (*Invitation, error) {
+	var inv Invitation
+	err := a.db.QueryRow(`
+        SELECT id, email, role, expires_at, revoked_at, redeemed_at
+        FROM invitations
+        WHERE token_hash = ?
+    `, invitationTokenHash(code)).Scan(&inv.ID, &inv.Email, &inv.Role, &inv.ExpiresAt, &inv.RevokedAt, &inv.RedeemedAt)
 	if err == sql.ErrNoRows {
-		log.Printf("getUserIDFromRequest: session %s not found", c.Value)
-		return 0, false
+		return nil, nil
 	}
 	if err != nil {
-		log.Printf("getUserIDFromRequest: DB error for session %s: %v", c.Value, err)
-		return 0, false
+		return nil, err
 	}
 
-	log.Printf("getUserIDFromRequest: session %s -> user %d", c.Value, uid)
-	return uid, true
+	if inv.RevokedAt != nil || inv.RedeemedAt != nil || !time.Now().Before(inv.ExpiresAt) {
+		return nil, signupRefused("this invitation has expired or has already been used")
+	}
+	if !strings.EqualFold(inv.Email, strings.TrimSpace(email)) {
+		return nil, signupRefused("this invitation is for a different email address")
+	}
+	return &inv, nil
 }
 
-func (a *App) clearSession(w http.ResponseWriter, r *http.Request) {
-	c, err := r.Cookie("session_id")
-	if err == nil {
-		_, _ = a.db.Exec(`DELETE FROM sessions WHERE id = ?`, c.Value)
+/* ======================================================
+   Mail
+   ====================================================== */
+
+// Mailer sends a plain-text email. Configure SMTP with SMTP_HOST and
+// friends; without it mail goes to MAIL_DIR or the log, for local testing.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// mailerFromEnv picks the SMTP mailer when SMTP_HOST is set, otherwise one
+// that writes messages to MAIL_DIR (or the log when that is unset too).
+func mailerFromEnv() Mailer {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		if isProd() {
+			log.Printf("SMTP_HOST is not set; outgoing mail is only written locally")
+		}
+		return &fileMailer{dir: os.Getenv("MAIL_DIR")}
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session_id",
-		Value:    "",
-		Path:     "/",
-		MaxAge:   -1,
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-		Secure:   isProd(),
-	})
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		log.Fatal("MAIL_FROM is required when SMTP_HOST is set")
+	}
+
+	return &smtpMailer{
+		addr:     net.JoinHostPort(host, port),
+		host:     host,
+		username: os.Getenv("SMTP_USERNAME"),
+		password: os.Getenv("SMTP_PASSWORD"),
+		from:     from,
+	}
 }
 
-type promoteUserRequest struct {
-	UserID int64 `json:"userId"`
+// smtpMailer sends through an SMTP server, upgrading with STARTTLS when
+// the server offers it (so use the submission port, not 465).
+type smtpMailer struct {
+	addr     string // host:port
+	host     string
+	username string // no auth when empty
+	password string
+	from     string
 }
 
-func (a *App) handleAdminPromote(w http.ResponseWriter, r *http.Request) {
+func (m *smtpMailer) Send(to, subject, body string) error {
+	msg, err := buildMail(m.from, to, subject, body)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+	return smtp.SendMail(m.addr, auth, m.from, []string{to}, msg)
+}
+
+// fileMailer writes each message to its own .eml file in dir, or to the
+// log when dir is empty. It never delivers anything.
+type fileMailer struct {
+	dir string
+}
+
+func (m *fileMailer) Send(to, subject, body string) error {
+	msg, err := buildMail("protocolgen@localhost", to, subject, body)
+	if err != nil {
+		return err
+	}
+
+	if m.dir == "" {
+		log.Printf("mail (not sent):\n%s", msg)
+		return nil
+	}
+
+	if err := os.MkdirAll(m.dir, 0o700); err != nil {
+		return err
+	}
+	name := time.Now().UTC().Format("20060102-150405.000000000") + ".eml"
+	return os.WriteFile(filepath.Join(m.dir, name), msg, 0o600)
+}
+
+// buildMail formats a plain-text message. Addresses and subject come from
+// user input, so a line break in any of them is refused rather than let
+// it add headers.
+func buildMail(from, to, subject, body string) ([]byte, error) {
+	for _, v := range []string{from, to, subject} {
+		if strings.ContainsAny(v, "\r\n") {
+			return nil, fmt.Errorf("line break in mail header %q", v)
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return b.Bytes(), nil
+}
+
+/* ======================================================
+   Password reset
+   ====================================================== */
+
+const (
+	// A reset link works once, for this long after it was sent.
+	passwordResetTTL = time.Hour
+
+	// Asking again within this long does not send another email.
+	passwordResetResendInterval = time.Minute
+)
+
+type forgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type resetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+// passwordResetTokenHash is what password_resets stores in place of the
+// emailed token.
+func passwordResetTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// handleForgotPassword emails a reset link to the account with that
+// address. It answers at once and the same whether or not the account
+// exists; the lookup, token and email all happen in the background so
+// timing does not tell either.
+// POST /forgot-password
+func (a *App) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "use POST", http.StatusMethodNotAllowed)
 		return
@@ -1018,39 +5768,100 @@ func (a *App) handleAdminPromote(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req promoteUserRequest
+	var req forgotPasswordRequest
 	if err := decodeJSONBody(w, r, &req); err != nil {
 		http.Error(w, "invalid JSON", http.StatusBadRequest)
 		return
 	}
 
-	if req.UserID <= 0 {
-		http.Error(w, "userId required", http.StatusBadRequest)
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Email == "" {
+		http.Error(w, "email required", http.StatusBadRequest)
 		return
 	}
 
-	res, err := a.db.Exec(`UPDATE users SET is_admin = 1 WHERE id = ?`, req.UserID)
+	go func(email string) {
+		if err := a.sendPasswordReset(email); err != nil {
+			log.Printf("handleForgotPassword: %v", err)
+		}
+	}(req.Email)
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"ok": true,
+	})
+}
+
+// sendPasswordReset issues a new reset token for the account with email
+// (in any case) and mails the link to its stored address, replacing any
+// earlier unused token. Unknown addresses and Okta-only accounts (no
+// password) are silently skipped. It blocks until the mail is sent.
+func (a *App) sendPasswordReset(email string) error {
+	var userID int64
+	var passwordHash string
+	err := a.db.QueryRow(`
+        SELECT id, email, password_hash FROM users WHERE email = ? COLLATE NOCASE
+    `, email).Scan(&userID, &email, &passwordHash)
+	if err == sql.ErrNoRows || (err == nil && passwordHash == "") {
+		return nil
+	}
 	if err != nil {
-		log.Printf("handleAdminPromote: update error: %v", err)
-		http.Error(w, "db error", http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	rows, _ := res.RowsAffected()
-	if rows == 0 {
-		http.Error(w, "user not found", http.StatusNotFound)
-		return
+	now := time.Now().UTC()
+
+	var recent int
+	err = a.db.QueryRow(`
+        SELECT COUNT(*) FROM password_resets
+        WHERE user_id = ? AND used_at IS NULL AND created_at > ?
+    `, userID, now.Add(-passwordResetResendInterval).Format("2006-01-02 15:04:05")).Scan(&recent)
+	if err != nil {
+		return err
+	}
+	if recent > 0 {
+		return nil
 	}
 
-	json.NewEncoder(w).Encode(map[string]any{
-		"ok":     true,
-		"userId": req.UserID,
-	})
+	token, err := a.generateSessionID()
+	if err != nil {
+		return err
+	}
+
+	if _, err := a.db.Exec(`DELETE FROM password_resets WHERE user_id = ? AND used_at IS NULL`, userID); err != nil {
+		return err
+	}
+	_, err = a.db.Exec(`
+        INSERT INTO password_resets (token_hash, user_id, created_at, expires_at)
+        VALUES (?, ?, ?, ?)
+    `, passwordResetTokenHash(token), userID, now.Format("2006-01-02 15:04:05"),
+		now.Add(passwordResetTTL).Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return err
+	}
+
+	link := a.baseURL + "/reset-password?token=" + url.QueryEscape(token)
+	body := "Someone asked to reset the password for your ProtocolGen account.\n\n" +
+		fmt.Sprintf("To choose a new password, open this link within %d minutes:\n\n", int(passwordResetTTL.Minutes())) +
+		link + "\n\n" +
+		"If it wasn't you, ignore this email; your password has not changed.\n"
+
+	if err := a.mailer.Send(email, "Reset your ProtocolGen password", body); err != nil {
+		return fmt.Errorf("mail to user %d failed: %w", userID, err)
+	}
+	return nil
 }
 
-func (a *App) handleAdminDemote(w http.ResponseWriter, r *http.Request) {
+// handleResetPassword serves the reset page (GET) or sets a new password
+// from an emailed token (POST). The token works once; using it also
+// clears any lockout and signs the account out everywhere.
+// /reset-password
+func (a *App) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		http.ServeFile(w, r, "./static/reset-password.html")
+		return
+	}
 	if r.Method != http.MethodPost {
-		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		http.Error(w, "use GET or POST", http.StatusMethodNotAllowed)
 		return
 	}
 
@@ -1059,44 +5870,92 @@ func (a *App) handleAdminDemote(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
 		return
 	}
-	var req promoteUserRequest
+
+	var req resetPasswordRequest
 	if err := decodeJSONBody(w, r, &req); err != nil {
 		http.Error(w, "invalid JSON", http.StatusBadRequest)
 		return
 	}
 
-	if req.UserID <= 0 {
-		http.Error(w, "userId required", http.StatusBadRequest)
+	if req.Token == "" || req.NewPassword == "" {
+		http.Error(w, "token and newPassword required", http.StatusBadRequest)
 		return
 	}
 
-	// Optional but sensible: don't let an admin demote themself
-	currentID, ok := a.getUserIDFromRequest(r)
-	if !ok {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	if err := validatePassword(req.NewPassword); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if currentID == req.UserID {
-		http.Error(w, "cannot demote your own admin status", http.StatusBadRequest)
+
+	now := time.Now().UTC().Format("2006-01-02 15:04:05")
+
+	var resetID, userID int64
+	err := a.db.QueryRow(`
+        SELECT id, user_id FROM password_resets
+        WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?
+    `, passwordResetTokenHash(req.Token), now).Scan(&resetID, &userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "this reset link is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("handleResetPassword: lookup error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
 		return
 	}
 
-	res, err := a.db.Exec(`UPDATE users SET is_admin = 0 WHERE id = ?`, req.UserID)
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
 	if err != nil {
-		log.Printf("handleAdminDemote: update error: %v", err)
+		log.Printf("handleResetPassword: hash error: %v", err)
+		http.Error(w, "hash error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		log.Printf("handleResetPassword: begin tx error: %v", err)
 		http.Error(w, "db error", http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
 
-	rows, _ := res.RowsAffected()
-	if rows == 0 {
-		http.Error(w, "user not found", http.StatusNotFound)
+	// single use: if two resets race, only the first gets here
+	res, err := tx.Exec(`UPDATE password_resets SET used_at = ? WHERE id = ? AND used_at IS NULL`, now, resetID)
+	if err != nil {
+		log.Printf("handleResetPassword: mark used error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "this reset link is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+
+	_, err = tx.Exec(`
+        UPDATE users
+        SET password_hash = ?, failed_attempts = 0, lockout_until = NULL
+        WHERE id = ?
+    `, string(hash), userID)
+	if err != nil {
+		log.Printf("handleResetPassword: update error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID); err != nil {
+		log.Printf("handleResetPassword: delete sessions error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("handleResetPassword: commit error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
 		return
 	}
 
 	json.NewEncoder(w).Encode(map[string]any{
-		"ok":     true,
-		"userId": req.UserID,
+		"ok": true,
 	})
 }
 
@@ -1105,8 +5964,131 @@ func (a *App) handleAdminDemote(w http.ResponseWriter, r *http.Request) {
    ====================================================== */
 
 type signupRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email      string `json:"email"`
+	Password   string `json:"password"`
+	InviteCode string `json:"inviteCode"`
+}
+
+// Signup policies, chosen with SIGNUP_POLICY. They decide who may create an
+// account (by /signup or a first Okta sign-in) and whether it starts out
+// approved.
+const (
+	signupOpen     = "open"     // anyone, approved at once (the default)
+	signupApproval = "approval" // anyone, pending until an admin approves
+	signupInvite   = "invite"   // only with an invitation or one of SIGNUP_INVITE_CODES
+	signupDomain   = "domain"   // only emails under SIGNUP_ALLOWED_DOMAINS, pending until approved
+)
+
+type signupPolicy struct {
+	mode        string
+	domains     []string // lower case, without the "@"
+	subdomains  bool     // also accept subdomains of domains
+	inviteCodes []string
+}
+
+// signupPolicyFromEnv reads SIGNUP_POLICY, SIGNUP_ALLOWED_DOMAINS and
+// SIGNUP_INVITE_CODES (both comma separated). Subdomains of the allowed
+// domains are only accepted with SIGNUP_ALLOW_SUBDOMAINS=1. An unknown
+// policy falls back to approval rather than letting anyone in.
+func signupPolicyFromEnv() signupPolicy {
+	p := signupPolicy{mode: strings.ToLower(strings.TrimSpace(os.Getenv("SIGNUP_POLICY")))}
+	switch p.mode {
+	case "":
+		p.mode = signupOpen
+	case signupOpen, signupApproval, signupInvite, signupDomain:
+	default:
+		log.Printf("SIGNUP_POLICY=%q is not open, approval, invite or domain; using approval", p.mode)
+		p.mode = signupApproval
+	}
+
+	for _, d := range strings.Split(os.Getenv("SIGNUP_ALLOWED_DOMAINS"), ",") {
+		d = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(d)), "@")
+		if d != "" {
+			p.domains = append(p.domains, d)
+		}
+	}
+	p.subdomains = os.Getenv("SIGNUP_ALLOW_SUBDOMAINS") == "1"
+	for _, c := range strings.Split(os.Getenv("SIGNUP_INVITE_CODES"), ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			p.inviteCodes = append(p.inviteCodes, c)
+		}
+	}
+
+	if p.mode == signupDomain && len(p.domains) == 0 {
+		log.Printf("SIGNUP_POLICY=domain but SIGNUP_ALLOWED_DOMAINS is empty; nobody can sign up")
+	}
+	return p
+}
+
+// signupRefused is the reason a new account was turned away; it is safe to
+// show to the person signing up.
+type signupRefused string
+
+func (e signupRefused) Error() string { return string(e) }
+
+// admit decides whether an account may be created for email under the
+// policy and, if so, whether it starts out approved. inviteCode is empty
+// for Okta sign-ins, so invite-only servers never create Okta accounts.
+// emailVerified says the identity provider vouched for the address; a
+// /signup form only proves someone typed it, so domain sign-ups from it
+// wait for an admin.
+func (p signupPolicy) admit(email, inviteCode string, emailVerified bool) (approved bool, err error) {
+	switch p.mode {
+	case signupApproval:
+		return false, nil
+
+	case signupInvite:
+		if inviteCode == "" {
+			return false, signupRefused("an invite code is required to sign up")
+		}
+		for _, c := range p.inviteCodes {
+			if subtle.ConstantTimeCompare([]byte(c), []byte(inviteCode)) == 1 {
+				return true, nil
+			}
+		}
+		return false, signupRefused("invalid invite code")
+
+	case signupDomain:
+		if !p.allowsDomain(email) {
+			return false, signupRefused("sign-up is limited to approved email domains")
+		}
+		return emailVerified, nil
+	}
+
+	return true, nil
+}
+
+// allowsDomain reports whether email is at one of the allowed domains, or
+// a subdomain of one when subdomains are enabled.
+func (p signupPolicy) allowsDomain(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, d := range p.domains {
+		if domain == d || (p.subdomains && strings.HasSuffix(domain, "."+d)) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleSignupPolicy tells the sign-up form whether to ask for an invite
+// code and which domains are accepted.
+func (a *App) handleSignupPolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"policy":         a.signupPolicy.mode,
+		"inviteRequired": a.signupPolicy.mode == signupInvite,
+		"domains":        a.signupPolicy.domains,
+		"subdomains":     a.signupPolicy.subdomains,
+	})
 }
 
 func (a *App) handleSignup(w http.ResponseWriter, r *http.Request) {
@@ -1153,18 +6135,62 @@ func (a *App) handleSignup(w http.ResponseWriter, r *http.Request) {
 
 	isAdmin := 0
 	isApproved := 1
-	autoLogin := true
+	isReviewer := 0
+	inviteCode := strings.TrimSpace(req.InviteCode)
+
+	// an invitation skips the signup policy and brings its own role
+	var inv *Invitation
+	if count > 0 && inviteCode != "" {
+		inv, err = a.invitationForSignup(inviteCode, req.Email)
+		var refused signupRefused
+		if errors.As(err, &refused) {
+			http.Error(w, refused.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			log.Printf("handleSignup: invitation lookup error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+	}
 
-	if count == 0 {
-		// bootstrap: first user is admin + approved + auto login
+	switch {
+	case count == 0:
+		// bootstrap: first user is admin + approved + auto login,
+		// whatever the signup policy
 		isAdmin = 1
-		isApproved = 1
-		autoLogin = true
+	case inv != nil:
+		if inv.Role == userRoleAdmin {
+			isAdmin = 1
+		}
+		if inv.Role == userRoleReviewer {
+			isReviewer = 1
+		}
+	default:
+		approved, err := a.signupPolicy.admit(req.Email, inviteCode, false)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if !approved {
+			isApproved = 0
+		}
+	}
+
+	// pending accounts wait for an admin before they can sign in
+	autoLogin := isApproved == 1
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		log.Printf("handleSignup: begin tx error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
 	}
+	defer tx.Rollback()
 
-	res, err := a.db.Exec(
-		`INSERT INTO users (email, password_hash, is_admin, is_approved) VALUES (?, ?, ?, ?)`,
-		req.Email, string(hash), isAdmin, isApproved,
+	res, err := tx.Exec(
+		`INSERT INTO users (email, password_hash, is_admin, is_approved, is_reviewer) VALUES (?, ?, ?, ?, ?)`,
+		req.Email, string(hash), isAdmin, isApproved, isReviewer,
 	)
 	if err != nil {
 		http.Error(w, "email may already exist", http.StatusBadRequest)
@@ -1173,8 +6199,33 @@ func (a *App) handleSignup(w http.ResponseWriter, r *http.Request) {
 
 	userID, _ := res.LastInsertId()
 
+	if inv != nil {
+		// single use: only one sign-up can claim it, even two at once, and
+		// only before it expires, however long the sign-up took
+		now := time.Now().UTC().Format("2006-01-02 15:04:05")
+		res, err := tx.Exec(`
+            UPDATE invitations SET redeemed_at = ?, redeemed_by = ?
+            WHERE id = ? AND redeemed_at IS NULL AND revoked_at IS NULL AND expires_at > ?
+        `, now, userID, inv.ID, now)
+		if err != nil {
+			log.Printf("handleSignup: redeem invitation error: %v", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "this invitation has expired or has already been used", http.StatusForbidden)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("handleSignup: commit error: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+
 	if autoLogin {
-		_ = a.setSessionCookie(w, userID)
+		_ = a.setSessionCookie(w, r, userID)
 	}
 
 	json.NewEncoder(w).Encode(map[string]any{
@@ -1183,6 +6234,7 @@ func (a *App) handleSignup(w http.ResponseWriter, r *http.Request) {
 		"autoLogin":       autoLogin,
 		"is_admin":        isAdmin == 1,
 		"is_approved":     isApproved == 1,
+		"is_reviewer":     isReviewer == 1,
 		"pendingApproval": !autoLogin,
 	})
 
@@ -1264,7 +6316,7 @@ func (a *App) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_ = a.setSessionCookie(w, id)
+	_ = a.setSessionCookie(w, r, id)
 
 	json.NewEncoder(w).Encode(map[string]any{
 		"ok":          true,
@@ -1295,9 +6347,9 @@ func (a *App) handleMe(w http.ResponseWriter, r *http.Request) {
 	var isAdminInt, isApprovedInt int
 
 	err := a.db.QueryRow(
-		`SELECT id, email, created_at, is_admin, is_approved FROM users WHERE id = ?`,
+		`SELECT id, email, created_at, is_admin, is_approved, is_reviewer FROM users WHERE id = ?`,
 		userID,
-	).Scan(&u.ID, &u.Email, &u.CreatedAt, &isAdminInt, &isApprovedInt)
+	).Scan(&u.ID, &u.Email, &u.CreatedAt, &isAdminInt, &isApprovedInt, &u.IsReviewer)
 	if err != nil {
 		log.Printf("handleMe: DB error for user %d: %v", userID, err)
 		http.Error(w, "db error", http.StatusInternalServerError)
@@ -1440,7 +6492,7 @@ func (a *App) handleChangePassword(w http.ResponseWriter, r *http.Request) {
 		// not fatal; keep going
 	}
 
-	if err := a.setSessionCookie(w, userID); err != nil {
+	if err := a.setSessionCookie(w, r, userID); err != nil {
 		log.Printf("handleChangePassword: setSessionCookie error: %v", err)
 		// Still consider it mostly OK
 	}
@@ -1559,6 +6611,94 @@ func (a *App) requireAuth(next http.Handler) http.Handler {
 	})
 }
 
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// csrfExempt are the only paths that skip the CSRF check: the OAuth
+// callback arrives as a cross-site redirect from the identity provider and
+// is protected by its own state parameter.
+var csrfExempt = map[string]bool{
+	"/oauth/callback": true,
+}
+
+// requireCSRF guards every state-changing request (anything but GET, HEAD
+// and OPTIONS) with a double-submit token: the csrf_token cookie, which
+// this middleware hands out on any request that lacks it, must come back
+// in the X-CSRF-Token header. Browsers also have to send an Origin or
+// Referer from this host when they send either. It wraps the whole mux,
+// so it runs ahead of requireAuth on every route.
+func requireCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if csrfExempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := ""
+		if c, err := r.Cookie(csrfCookieName); err == nil {
+			token = c.Value
+		}
+		if token == "" {
+			b := make([]byte, 32)
+			if _, err := cryptoRand.Read(b); err != nil {
+				log.Printf("requireCSRF: token error: %v", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrfCookieName,
+				Value:    hex.EncodeToString(b),
+				Path:     "/",
+				HttpOnly: false, // page scripts copy it into the header
+				SameSite: http.SameSiteStrictMode,
+				Secure:   isProd(),
+			})
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !sameOriginRequest(r) {
+			log.Printf("requireCSRF: cross-origin %s %s (Origin %q, Referer %q)",
+				r.Method, r.URL.Path, r.Header.Get("Origin"), r.Header.Get("Referer"))
+			http.Error(w, "cross-origin request refused", http.StatusForbidden)
+			return
+		}
+
+		sent := r.Header.Get(csrfHeaderName)
+		if token == "" || sent == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			log.Printf("requireCSRF: missing or wrong token for %s %s", r.Method, r.URL.Path)
+			http.Error(w, "invalid CSRF token", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sameOriginRequest checks Origin, or Referer when there is no Origin,
+// against the Host the request was sent to. Requests with neither (scripts,
+// privacy-stripped browsers) pass here and rely on the token alone.
+func sameOriginRequest(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	if source == "" {
+		return true
+	}
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
 func (a *App) handleProtectedTest(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]any{
 		"ok":  true,
@@ -1587,7 +6727,7 @@ func ensureAdminUser(db *sql.DB, email string) error {
 	return err
 }
 
-func (a *App) findOrCreateOktaUser(email string) (*User, error) {
+func (a *App) findOrCreateOktaUser(email string, emailVerified bool) (*User, error) {
 	var u User
 	var isAdminInt, isApprovedInt int
 
@@ -1599,11 +6739,20 @@ func (a *App) findOrCreateOktaUser(email string) (*User, error) {
 
 	switch {
 	case err == sql.ErrNoRows:
-		// Create new user, auto-approved, not admin
+		// Create new user, not admin, approved if the signup policy says so
+		approved, err := a.signupPolicy.admit(email, "", emailVerified)
+		if err != nil {
+			return nil, err
+		}
+		isApprovedInt = 0
+		if approved {
+			isApprovedInt = 1
+		}
+
 		res, err := a.db.Exec(`
             INSERT INTO users (email, password_hash, is_admin, is_approved)
-            VALUES (?, ?, 0, 1)
-        `, email, "")
+            VALUES (?, ?, 0, ?)
+        `, email, "", isApprovedInt)
 		if err != nil {
 			return nil, err
 		}
@@ -1628,10 +6777,10 @@ func (a *App) findOrCreateOktaUser(email string) (*User, error) {
 	return &u, nil
 }
 
-func emailFromIDToken(rawIDToken string) (string, error) {
+func emailFromIDToken(rawIDToken string) (email string, verified bool, err error) {
 	parts := strings.Split(rawIDToken, ".")
 	if len(parts) < 2 {
-		return "", fmt.Errorf("invalid JWT")
+		return "", false, fmt.Errorf("invalid JWT")
 	}
 
 	payload := parts[1]
@@ -1648,19 +6797,20 @@ func emailFromIDToken(rawIDToken string) (string, error) {
 
 	decoded, err := base64.URLEncoding.DecodeString(payload)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
 	var claims struct {
-		Email string `json:"email"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
 	}
 	if err := json.Unmarshal(decoded, &claims); err != nil {
-		return "", err
+		return "", false, err
 	}
 	if claims.Email == "" {
-		return "", fmt.Errorf("missing email claim")
+		return "", false, fmt.Errorf("missing email claim")
 	}
-	return claims.Email, nil
+	return claims.Email, claims.EmailVerified, nil
 }
 
 // Map text tokens in the prompt to your column preset keys
@@ -2093,22 +7243,32 @@ func (a *App) handleOktaCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	email, err := emailFromIDToken(rawIDToken)
+	email, emailVerified, err := emailFromIDToken(rawIDToken)
 	if err != nil {
 		http.Error(w, "failed to parse id_token", http.StatusInternalServerError)
 		return
 	}
 
 	// Find or create the user in your users table
-	user, err := a.findOrCreateOktaUser(email)
+	user, err := a.findOrCreateOktaUser(email, emailVerified)
+	var refused signupRefused
+	if errors.As(err, &refused) {
+		http.Error(w, refused.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		log.Printf("handleOktaCallback: DB error: %v", err)
 		http.Error(w, "DB error", http.StatusInternalServerError)
 		return
 	}
 
+	if !user.IsApproved {
+		http.Error(w, "account pending approval", http.StatusForbidden)
+		return
+	}
+
 	// Reuse your existing session logic
-	if err := a.setSessionCookie(w, user.ID); err != nil {
+	if err := a.setSessionCookie(w, r, user.ID); err != nil {
 		log.Printf("handleOktaCallback: setSessionCookie error: %v", err)
 		http.Error(w, "session error", http.StatusInternalServerError)
 		return
@@ -2288,17 +7448,22 @@ type ColumnPresetDTO struct {
 	Label         string          `json:"label"`
 	Config        json.RawMessage `json:"config"`
 	StandardOrder *int            `json:"standardOrder,omitempty"`
+	TeamID        int64           `json:"teamId,omitempty"` // 0 = shared with everyone
 }
 
 func (a *App) handleColumnPresets(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		// List all presets (any logged-in user; route is already wrapped in requireAuth)
+		// List global presets plus those of the caller's teams
+		// (route is already wrapped in requireAuth)
+		userID, _ := a.getUserIDFromRequest(r)
 		rows, err := a.db.Query(`
-			SELECT preset_key, label, config_json, standard_order
+			SELECT preset_key, label, config_json, standard_order, COALESCE(team_id, 0)
 			FROM column_presets
+			WHERE team_id IS NULL
+			   OR team_id IN (SELECT team_id FROM team_members WHERE user_id = ?)
 			ORDER BY COALESCE(standard_order, 9999), preset_key
-		`)
+		`, userID)
 		if err != nil {
 			log.Println("column_presets select error:", err)
 			http.Error(w, "db error", http.StatusInternalServerError)
@@ -2312,8 +7477,9 @@ func (a *App) handleColumnPresets(w http.ResponseWriter, r *http.Request) {
 			var key, label string
 			var config []byte
 			var standardOrder sql.NullInt64
+			var teamID int64
 
-			if err := rows.Scan(&key, &label, &config, &standardOrder); err != nil {
+			if err := rows.Scan(&key, &label, &config, &standardOrder, &teamID); err != nil {
 				log.Println("column_presets scan error:", err)
 				http.Error(w, "scan error", http.StatusInternalServerError)
 				return
@@ -2324,6 +7490,7 @@ func (a *App) handleColumnPresets(w http.ResponseWriter, r *http.Request) {
 				Label: label,
 				// Store raw JSON exactly as in DB
 				Config: json.RawMessage(config),
+				TeamID: teamID,
 			}
 			if standardOrder.Valid {
 				v := int(standardOrder.Int64)
@@ -2341,7 +7508,8 @@ func (a *App) handleColumnPresets(w http.ResponseWriter, r *http.Request) {
 		}
 
 	case http.MethodPost:
-		// Create or update a preset (any logged-in user)
+		// Create or update a preset (any logged-in user; team presets need
+		// an owner or editor of that team)
 		var payload ColumnPresetDTO
 		if err := decodeJSONBody(w, r, &payload); err != nil {
 			log.Println("column_presets decode error:", err)
@@ -2357,37 +7525,67 @@ func (a *App) handleColumnPresets(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Upsert by preset_key
-		_, err := a.db.Exec(`
-			INSERT INTO column_presets (preset_key, label, config_json, standard_order)
-			VALUES (?, ?, ?, ?)
+		var teamID any
+		if payload.TeamID > 0 {
+			userID, _ := a.getUserIDFromRequest(r)
+			ok, err := a.canEditForTeam(payload.TeamID, userID)
+			if err != nil {
+				log.Println("column_presets team role error:", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.Error(w, "you must be an owner or editor of that team", http.StatusForbidden)
+				return
+			}
+			teamID = payload.TeamID
+		}
+
+		// Upsert by preset_key; a key owned by another team (or by nobody)
+		// is left alone
+		res, err := a.db.Exec(`
+			INSERT INTO column_presets (preset_key, label, config_json, standard_order, team_id)
+			VALUES (?, ?, ?, ?, ?)
 			ON CONFLICT(preset_key) DO UPDATE SET
 				label = excluded.label,
 				config_json = excluded.config_json,
 				standard_order = excluded.standard_order
+			WHERE column_presets.team_id IS excluded.team_id
 		`,
 			payload.Key,
 			payload.Label,
 			string(payload.Config),
 			payload.StandardOrder,
+			teamID,
 		)
 		if err != nil {
 			log.Println("column_presets upsert error:", err)
 			http.Error(w, "db error", http.StatusInternalServerError)
 			return
 		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "a preset with that key belongs to a different team", http.StatusConflict)
+			return
+		}
 
 		// No body needed; JS just checks success
 		w.WriteHeader(http.StatusNoContent)
 
 	case http.MethodDelete:
-		// DELETE is admin-only
+		// DELETE is admin-only, except team owners and editors may delete
+		// their team's presets
 		userID, ok := a.getUserIDFromRequest(r)
 		if !ok || userID == 0 {
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
 
+		key := strings.TrimSpace(r.URL.Query().Get("key"))
+		if key == "" {
+			http.Error(w, "missing key", http.StatusBadRequest)
+			return
+		}
+
 		var isAdminInt int
 		if err := a.db.QueryRow(`SELECT is_admin FROM users WHERE id = ?`, userID).Scan(&isAdminInt); err != nil {
 			log.Println("column_presets admin check error:", err)
@@ -2395,14 +7593,25 @@ func (a *App) handleColumnPresets(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if isAdminInt == 0 {
-			http.Error(w, "forbidden - admin only", http.StatusForbidden)
-			return
-		}
-
-		key := strings.TrimSpace(r.URL.Query().Get("key"))
-		if key == "" {
-			http.Error(w, "missing key", http.StatusBadRequest)
-			return
+			var teamID sql.NullInt64
+			err := a.db.QueryRow(`SELECT team_id FROM column_presets WHERE preset_key = ?`, key).Scan(&teamID)
+			if err != nil && err != sql.ErrNoRows {
+				log.Println("column_presets team lookup error:", err)
+				http.Error(w, "db error", http.StatusInternalServerError)
+				return
+			}
+			allowed := false
+			if teamID.Valid {
+				if allowed, err = a.canEditForTeam(teamID.Int64, userID); err != nil {
+					log.Println("column_presets team role error:", err)
+					http.Error(w, "db error", http.StatusInternalServerError)
+					return
+				}
+			}
+			if !allowed {
+				http.Error(w, "forbidden - admin only", http.StatusForbidden)
+				return
+			}
 		}
 
 		if _, err := a.db.Exec(`DELETE FROM column_presets WHERE preset_key = ?`, key); err != nil {
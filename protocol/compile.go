@@ -0,0 +1,230 @@
+package protocol
+
+import (
+	"regexp"
+	"strings"
+)
+
+// AutoFillFunction is the standard autoFill entry of namedFunctions
+// (AUTO_FILL_FUNCTION in builder.js). Note the \r\n line endings.
+const AutoFillFunction = "  if (row[committedColumnId] === null) {\r\n" +
+	"    return {\r\n" +
+	"      type: 'setValue',\r\n" +
+	"      value: columns[committedColumnIdx].autoFill.value,\r\n" +
+	"      columnId: columns[committedColumnIdx].id\r\n" +
+	"    }\r\n" +
+	"  }"
+
+var nonFunctionNameChars = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// SanitizeForFunctionName strips everything but ASCII letters and digits
+// (sanitizeForFunctionName in builder.js).
+func SanitizeForFunctionName(text string) string {
+	return nonFunctionNameChars.ReplaceAllString(text, "")
+}
+
+// Compile regenerates the Xtract parts of doc (namedFunctions and
+// calculationRules) from its columns and scoringConfigs, the same way
+// generateJson does in the browser, then appends any custom functions and
+// rules as they are. doc itself is not modified.
+func Compile(doc *Document) *Document {
+	out := *doc
+	out.NamedFunctions = NamedFunctions{{Name: "autoFill", Body: AutoFillFunction}}
+	out.CalculationRules = nil
+
+	for _, col := range doc.Columns {
+		out.CalculationRules = append(out.CalculationRules, FocusRule(col))
+	}
+
+	for _, cfg := range doc.ScoringConfigs {
+		if cfg.TriggerColumn == "" || len(cfg.Rules) == 0 {
+			continue
+		}
+		name, body := CompileScoringConfig(cfg)
+		out.NamedFunctions.Set(name, body)
+		out.CalculationRules = append(out.CalculationRules, CalculationRule{
+			Conditions: []Condition{{Type: ConditionChange, ColumnIDs: []string{cfg.TriggerColumn}}},
+			Results:    []Result{{Type: ResultRunCode, FunctionName: name}},
+		})
+	}
+
+	for _, fn := range doc.CustomFunctions {
+		if _, taken := out.NamedFunctions.Get(fn.Name); !taken {
+			out.NamedFunctions = append(out.NamedFunctions, NamedFunction{Name: fn.Name, Body: fn.Body})
+		}
+	}
+	out.CalculationRules = append(out.CalculationRules, doc.CustomRules...)
+
+	return &out
+}
+
+// FocusRule is the setFocus calculation rule generated from a column's tab
+// behaviour.
+func FocusRule(col Column) CalculationRule {
+	focus := Result{Type: ResultSetFocus}
+	switch col.TabBehavior {
+	case TabNextRow:
+		focus.RelativeRows = 1
+	case TabNextRowPrevColumn:
+		focus.RelativeRows = 1
+		focus.RelativeColumns = -1
+	default:
+		focus.RelativeColumns = 1
+	}
+
+	return CalculationRule{
+		Conditions: []Condition{{Type: ConditionChange, ColumnIDs: []string{col.ID}}},
+		Results:    []Result{focus},
+	}
+}
+
+// ScoringFunctionName is set{AllUpdatedCols}From{Trigger}.
+func ScoringFunctionName(cfg ScoringConfig) string {
+	var updated []string
+	for _, r := range cfg.Rules {
+		for _, u := range r.Updates {
+			safe := SanitizeForFunctionName(u.Col)
+			if safe == "" {
+				safe = "Col"
+			}
+			if !containsString(updated, safe) {
+				updated = append(updated, safe)
+			}
+		}
+	}
+
+	trigger := SanitizeForFunctionName(cfg.TriggerColumn)
+	if trigger == "" {
+		trigger = "Column"
+	}
+	return "set" + strings.Join(updated, "") + "From" + trigger
+}
+
+// CompileScoringConfig returns the function name and body for one scoring
+// config. The body is byte-for-byte what builder.js generates.
+func CompileScoringConfig(cfg ScoringConfig) (name, body string) {
+	var lines []string
+	add := func(l ...string) { lines = append(lines, l...) }
+
+	add("var rowUpdates = {};", "")
+
+	// Scope: score controls? positive / negative / neither
+	switch cfg.Scope {
+	case ScopeNegative:
+		add("if (!committedItemIsNegativeReference) {",
+			"  return { type: 'setValues', row: rowUpdates };",
+			"}",
+			"")
+	case ScopePositive:
+		add("if (!committedItemIsPositiveReference) {",
+			"  return { type: 'setValues', row: rowUpdates };",
+			"}",
+			"")
+	case ScopeNeither:
+		add("if (committedItemIsNegativeReference || committedItemIsPositiveReference) {",
+			"  return { type: 'setValues', row: rowUpdates };",
+			"}",
+			"")
+	}
+
+	trigEsc := escapeSingleQuotes(cfg.TriggerColumn)
+
+	if cfg.RequireNegative {
+		add("if (negativeReferenceRow === null) {",
+			`  this.displayMessage("This set must contain a negative reference.");`,
+			"  return { type: 'setValue', columnId: '"+trigEsc+"', value: null };",
+			"}",
+			"",
+			"if (!committedItemIsNegativeReference && (!negativeReferenceRow || negativeReferenceRow['"+trigEsc+"'] == null)) {",
+			`  this.displayMessage("You must first score the negative reference.");`,
+			"  return { type: 'setValue', columnId: '"+trigEsc+"', value: null };",
+			"}",
+			"")
+	}
+
+	if cfg.RequirePositive {
+		add("if (typeof positiveReferenceRow === 'undefined' || positiveReferenceRow === null) {",
+			`  this.displayMessage("This set must contain a positive reference.");`,
+			"  return { type: 'setValue', columnId: '"+trigEsc+"', value: null };",
+			"}",
+			"",
+			"if (!committedItemIsPositiveReference && (!positiveReferenceRow || positiveReferenceRow['"+trigEsc+"'] == null)) {",
+			`  this.displayMessage("You must first score the positive reference.");`,
+			"  return { type: 'setValue', columnId: '"+trigEsc+"', value: null };",
+			"}",
+			"")
+	}
+
+	for idx, rule := range cfg.Rules {
+		fullCond := "true"
+		if len(rule.Conditions) > 0 {
+			exprs := make([]string, len(rule.Conditions))
+			for i, c := range rule.Conditions {
+				exprs[i] = "(" + ConditionExpr(c) + ")"
+			}
+			fullCond = strings.Join(exprs, " && ")
+		}
+
+		prefix := "if"
+		if idx > 0 {
+			prefix = "else if"
+		}
+		add(prefix+" ("+fullCond+") {", "  rowUpdates = {")
+		for i, u := range rule.Updates {
+			comma := ""
+			if i < len(rule.Updates)-1 {
+				comma = ","
+			}
+			add("    '" + escapeSingleQuotes(u.Col) + "': " + valueLiteral(u.Val) + comma)
+		}
+		add("  };", "}", "")
+	}
+
+	add("return { type: 'setValues', row: rowUpdates };")
+
+	return ScoringFunctionName(cfg), strings.Join(lines, "\n")
+}
+
+// ConditionExpr builds the JS expression for one scoring condition
+// (buildConditionExpr in builder.js).
+func ConditionExpr(c ScoringCondition) string {
+	if c.Col == "" || c.Op == OpAlways {
+		return "true"
+	}
+
+	colEsc := escapeSingleQuotes(c.Col)
+
+	// String-style comparison (always strict === / !==)
+	if !numericPattern.MatchString(c.Thresh) {
+		op := c.Op
+		switch op {
+		case "==", "===":
+			op = "==="
+		case "!=", "!==":
+			op = "!=="
+		}
+		return "row['" + colEsc + "'] " + op + " '" + escapeSingleQuotes(c.Thresh) + "'"
+	}
+
+	var rhs string
+	switch c.Base {
+	case BaseNegative:
+		rhs = "parseInt(negativeReferenceRow['" + colEsc + "'], 10) + " + c.Thresh
+	case BasePositive:
+		rhs = "parseInt(positiveReferenceRow['" + colEsc + "'], 10) + " + c.Thresh
+	default:
+		rhs = c.Thresh
+	}
+	return "row['" + colEsc + "'] " + c.Op + " " + rhs
+}
+
+func valueLiteral(raw string) string {
+	if numericPattern.MatchString(raw) {
+		return raw
+	}
+	return "'" + escapeSingleQuotes(raw) + "'"
+}
+
+func escapeSingleQuotes(s string) string {
+	return strings.ReplaceAll(s, "'", `\'`)
+}
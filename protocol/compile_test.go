@@ -0,0 +1,118 @@
+package protocol
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The golden files in testdata/compile are written by gen.js, which runs
+// builder.js's own generateJson on the form inputs in cases.json. Each case
+// has <name>.json (the document the builder saves) and <name>.export.json
+// (what it puts in the output textarea for Xtract).
+
+func compileCases(t *testing.T) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join("testdata", "compile", "*.export.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no golden files in testdata/compile; run gen.js")
+	}
+	var names []string
+	for _, p := range paths {
+		names = append(names, strings.TrimSuffix(filepath.Base(p), ".export.json"))
+	}
+	return names
+}
+
+func readGolden(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", "compile", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// loadSaved parses a case's saved document with the generated parts
+// removed, so only columns and scoringConfigs can produce them again.
+func loadSaved(t *testing.T, name string) (doc, golden *Document) {
+	t.Helper()
+	raw := readGolden(t, name+".json")
+	golden, err := Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err = Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc.NamedFunctions = nil
+	doc.CalculationRules = nil
+	return doc, golden
+}
+
+// firstDiff describes the first line where got and want differ.
+func firstDiff(got, want string) string {
+	g, w := strings.Split(got, "\n"), strings.Split(want, "\n")
+	for i := 0; i < len(g) || i < len(w); i++ {
+		var gl, wl string
+		if i < len(g) {
+			gl = g[i]
+		}
+		if i < len(w) {
+			wl = w[i]
+		}
+		if gl != wl || i >= len(g) || i >= len(w) {
+			return fmt.Sprintf("line %d:\n got: %q\nwant: %q", i+1, gl, wl)
+		}
+	}
+	return "no line differs (trailing bytes?)"
+}
+
+func TestCompileScoringConfigMatchesBuilder(t *testing.T) {
+	for _, name := range compileCases(t) {
+		t.Run(name, func(t *testing.T) {
+			doc, golden := loadSaved(t, name)
+			for _, cfg := range doc.ScoringConfigs {
+				fn, body := CompileScoringConfig(cfg)
+				want, ok := golden.NamedFunctions.Get(fn)
+				if !ok {
+					t.Errorf("builder has no function %q for trigger %q", fn, cfg.TriggerColumn)
+					continue
+				}
+				if body != want {
+					t.Errorf("%s differs from builder.js at %s", fn, firstDiff(body, want))
+				}
+			}
+		})
+	}
+}
+
+func TestCompileMatchesBuilder(t *testing.T) {
+	for _, name := range compileCases(t) {
+		t.Run(name, func(t *testing.T) {
+			doc, _ := loadSaved(t, name)
+			got, err := MarshalIndent(StripUIMeta(Compile(doc)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := readGolden(t, name+".export.json")
+			if string(got) != string(want) {
+				t.Errorf("export differs from builder.js at %s", firstDiff(string(got), string(want)))
+			}
+		})
+	}
+}
+
+func TestCompileLeavesDocumentAlone(t *testing.T) {
+	doc, _ := loadSaved(t, "chains")
+	Compile(doc)
+	if doc.NamedFunctions != nil || doc.CalculationRules != nil {
+		t.Errorf("Compile modified its input: %d functions, %d rules", len(doc.NamedFunctions), len(doc.CalculationRules))
+	}
+}
@@ -0,0 +1,343 @@
+package protocol
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// Diff is a structured comparison of two protocol documents.
+type Diff struct {
+	ColumnsAdded     []Column       `json:"columnsAdded"`
+	ColumnsRemoved   []Column       `json:"columnsRemoved"`
+	ColumnsReordered []ColumnMove   `json:"columnsReordered"`
+	ColumnsChanged   []ColumnChange `json:"columnsChanged"`
+
+	RulesAdded   []ScoringRuleRef    `json:"rulesAdded"`
+	RulesRemoved []ScoringRuleRef    `json:"rulesRemoved"`
+	RulesChanged []ScoringRuleChange `json:"rulesChanged"`
+
+	// Trigger-level settings (scope, required references) that changed.
+	TriggersChanged []TriggerChange `json:"triggersChanged"`
+
+	FunctionsAdded   []string `json:"functionsAdded"`
+	FunctionsRemoved []string `json:"functionsRemoved"`
+	FunctionsChanged []string `json:"functionsChanged"`
+}
+
+// Empty reports whether the two documents were equivalent.
+func (d *Diff) Empty() bool {
+	return len(d.ColumnsAdded) == 0 && len(d.ColumnsRemoved) == 0 &&
+		len(d.ColumnsReordered) == 0 && len(d.ColumnsChanged) == 0 &&
+		len(d.RulesAdded) == 0 && len(d.RulesRemoved) == 0 && len(d.RulesChanged) == 0 &&
+		len(d.TriggersChanged) == 0 &&
+		len(d.FunctionsAdded) == 0 && len(d.FunctionsRemoved) == 0 && len(d.FunctionsChanged) == 0
+}
+
+// ColumnMove is a column whose position changed.
+type ColumnMove struct {
+	ID   string `json:"id"`
+	From int    `json:"from"`
+	To   int    `json:"to"`
+}
+
+// ColumnChange lists the fields that differ on a column present in both.
+type ColumnChange struct {
+	ID     string        `json:"id"`
+	Fields []FieldChange `json:"fields"`
+}
+
+// FieldChange is one field's before and after value.
+type FieldChange struct {
+	Field string `json:"field"`
+	From  any    `json:"from"`
+	To    any    `json:"to"`
+}
+
+// ScoringRuleRef identifies a scoring rule by trigger column and position
+// within that trigger's IF / ELSE IF chain.
+type ScoringRuleRef struct {
+	Trigger string      `json:"trigger"`
+	Index   int         `json:"index"`
+	Rule    ScoringRule `json:"rule"`
+}
+
+// ScoringRuleChange is a rule present in both versions whose conditions or
+// updates differ.
+type ScoringRuleChange struct {
+	Trigger           string             `json:"trigger"`
+	Index             int                `json:"index"`
+	ConditionsAdded   []ScoringCondition `json:"conditionsAdded,omitempty"`
+	ConditionsRemoved []ScoringCondition `json:"conditionsRemoved,omitempty"`
+	UpdatesAdded      []ScoringUpdate    `json:"updatesAdded,omitempty"`
+	UpdatesRemoved    []ScoringUpdate    `json:"updatesRemoved,omitempty"`
+	UpdatesChanged    []FieldChange      `json:"updatesChanged,omitempty"`
+}
+
+// TriggerChange is a setting of a scoring config that differs.
+type TriggerChange struct {
+	Trigger string        `json:"trigger"`
+	Fields  []FieldChange `json:"fields"`
+}
+
+// Compare returns the semantic difference from a to b. Columns are matched
+// by id and scoring configs by trigger column; rules within a trigger are
+// compared by position since their order is significant.
+func Compare(a, b *Document) *Diff {
+	d := &Diff{
+		ColumnsAdded:     []Column{},
+		ColumnsRemoved:   []Column{},
+		ColumnsReordered: []ColumnMove{},
+		ColumnsChanged:   []ColumnChange{},
+		RulesAdded:       []ScoringRuleRef{},
+		RulesRemoved:     []ScoringRuleRef{},
+		RulesChanged:     []ScoringRuleChange{},
+		TriggersChanged:  []TriggerChange{},
+		FunctionsAdded:   []string{},
+		FunctionsRemoved: []string{},
+		FunctionsChanged: []string{},
+	}
+
+	compareColumns(d, a.Columns, b.Columns)
+	compareScoring(d, a.ScoringConfigs, b.ScoringConfigs)
+	compareFunctions(d, a.NamedFunctions, b.NamedFunctions)
+	return d
+}
+
+func compareColumns(d *Diff, a, b []Column) {
+	oldIdx := map[string]int{}
+	for i, c := range a {
+		oldIdx[c.ID] = i
+	}
+	newIdx := map[string]int{}
+	for i, c := range b {
+		newIdx[c.ID] = i
+	}
+
+	for _, c := range a {
+		if _, ok := newIdx[c.ID]; !ok {
+			d.ColumnsRemoved = append(d.ColumnsRemoved, c)
+		}
+	}
+
+	// Relative order of the columns both versions share, so adding or
+	// removing one column doesn't report every later column as moved.
+	var keptOld, keptNew []string
+	for _, c := range a {
+		if _, ok := newIdx[c.ID]; ok {
+			keptOld = append(keptOld, c.ID)
+		}
+	}
+	for _, c := range b {
+		if _, ok := oldIdx[c.ID]; ok {
+			keptNew = append(keptNew, c.ID)
+		}
+	}
+	keptOldPos := map[string]int{}
+	for i, id := range keptOld {
+		keptOldPos[id] = i
+	}
+
+	for i, c := range b {
+		j, ok := oldIdx[c.ID]
+		if !ok {
+			d.ColumnsAdded = append(d.ColumnsAdded, c)
+			continue
+		}
+		if keptOldPos[c.ID] != indexOf(keptNew, c.ID) {
+			d.ColumnsReordered = append(d.ColumnsReordered, ColumnMove{ID: c.ID, From: j, To: i})
+		}
+		if fields := fieldChanges(a[j], c); len(fields) > 0 {
+			d.ColumnsChanged = append(d.ColumnsChanged, ColumnChange{ID: c.ID, Fields: fields})
+		}
+	}
+}
+
+// fieldChanges compares two structs field by field using their JSON names.
+func fieldChanges(a, b any) []FieldChange {
+	va := toJSONMap(a)
+	vb := toJSONMap(b)
+
+	var keys []string
+	seen := map[string]bool{}
+	for _, m := range []orderedMap{va, vb} {
+		for _, k := range m.keys {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+
+	var out []FieldChange
+	for _, k := range keys {
+		x, y := va.values[k], vb.values[k]
+		if !reflect.DeepEqual(x, y) {
+			out = append(out, FieldChange{Field: k, From: x, To: y})
+		}
+	}
+	return out
+}
+
+type orderedMap struct {
+	keys   []string
+	values map[string]any
+}
+
+// toJSONMap round-trips v through JSON so omitted fields and hint pointers
+// compare the way they are stored.
+func toJSONMap(v any) orderedMap {
+	raw, _ := json.Marshal(v)
+	m := orderedMap{values: map[string]any{}}
+	_ = json.Unmarshal(raw, &m.values)
+
+	// Field order from the struct, not map iteration.
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			m.keys = append(m.keys, name)
+		}
+	}
+	return m
+}
+
+func compareScoring(d *Diff, a, b []ScoringConfig) {
+	oldByTrigger := groupByTrigger(a)
+	newByTrigger := groupByTrigger(b)
+
+	var triggers []string
+	seen := map[string]bool{}
+	for _, cfgs := range [][]ScoringConfig{a, b} {
+		for _, c := range cfgs {
+			if !seen[c.TriggerColumn] {
+				seen[c.TriggerColumn] = true
+				triggers = append(triggers, c.TriggerColumn)
+			}
+		}
+	}
+
+	for _, trig := range triggers {
+		oldCfg, inOld := oldByTrigger[trig]
+		newCfg, inNew := newByTrigger[trig]
+
+		if inOld && inNew {
+			settingsOld := ScoringConfig{Scope: oldCfg.Scope, RequireNegative: oldCfg.RequireNegative, RequirePositive: oldCfg.RequirePositive}
+			settingsNew := ScoringConfig{Scope: newCfg.Scope, RequireNegative: newCfg.RequireNegative, RequirePositive: newCfg.RequirePositive}
+			if fields := fieldChanges(settingsOld, settingsNew); len(fields) > 0 {
+				d.TriggersChanged = append(d.TriggersChanged, TriggerChange{Trigger: trig, Fields: fields})
+			}
+		}
+
+		n := len(oldCfg.Rules)
+		if len(newCfg.Rules) > n {
+			n = len(newCfg.Rules)
+		}
+		for i := 0; i < n; i++ {
+			switch {
+			case i >= len(newCfg.Rules):
+				d.RulesRemoved = append(d.RulesRemoved, ScoringRuleRef{Trigger: trig, Index: i, Rule: oldCfg.Rules[i]})
+			case i >= len(oldCfg.Rules):
+				d.RulesAdded = append(d.RulesAdded, ScoringRuleRef{Trigger: trig, Index: i, Rule: newCfg.Rules[i]})
+			default:
+				if ch, changed := compareRule(oldCfg.Rules[i], newCfg.Rules[i]); changed {
+					ch.Trigger = trig
+					ch.Index = i
+					d.RulesChanged = append(d.RulesChanged, ch)
+				}
+			}
+		}
+	}
+}
+
+// groupByTrigger merges configs that share a trigger column, which the
+// builder allows, into one rule chain.
+func groupByTrigger(cfgs []ScoringConfig) map[string]ScoringConfig {
+	out := map[string]ScoringConfig{}
+	for _, c := range cfgs {
+		if prev, ok := out[c.TriggerColumn]; ok {
+			prev.Rules = append(append([]ScoringRule{}, prev.Rules...), c.Rules...)
+			out[c.TriggerColumn] = prev
+			continue
+		}
+		out[c.TriggerColumn] = c
+	}
+	return out
+}
+
+func compareRule(a, b ScoringRule) (ScoringRuleChange, bool) {
+	var ch ScoringRuleChange
+
+	for _, c := range a.Conditions {
+		if !containsCondition(b.Conditions, c) {
+			ch.ConditionsRemoved = append(ch.ConditionsRemoved, c)
+		}
+	}
+	for _, c := range b.Conditions {
+		if !containsCondition(a.Conditions, c) {
+			ch.ConditionsAdded = append(ch.ConditionsAdded, c)
+		}
+	}
+
+	oldVals := map[string]string{}
+	for _, u := range a.Updates {
+		oldVals[u.Col] = u.Val
+	}
+	newVals := map[string]string{}
+	for _, u := range b.Updates {
+		newVals[u.Col] = u.Val
+	}
+	for _, u := range a.Updates {
+		if _, ok := newVals[u.Col]; !ok {
+			ch.UpdatesRemoved = append(ch.UpdatesRemoved, u)
+		}
+	}
+	for _, u := range b.Updates {
+		old, ok := oldVals[u.Col]
+		switch {
+		case !ok:
+			ch.UpdatesAdded = append(ch.UpdatesAdded, u)
+		case old != u.Val:
+			ch.UpdatesChanged = append(ch.UpdatesChanged, FieldChange{Field: u.Col, From: old, To: u.Val})
+		}
+	}
+
+	changed := len(ch.ConditionsAdded) > 0 || len(ch.ConditionsRemoved) > 0 ||
+		len(ch.UpdatesAdded) > 0 || len(ch.UpdatesRemoved) > 0 || len(ch.UpdatesChanged) > 0
+	return ch, changed
+}
+
+func containsCondition(list []ScoringCondition, c ScoringCondition) bool {
+	for _, x := range list {
+		if x == c {
+			return true
+		}
+	}
+	return false
+}
+
+func compareFunctions(d *Diff, a, b NamedFunctions) {
+	for _, f := range a {
+		if _, ok := b.Get(f.Name); !ok {
+			d.FunctionsRemoved = append(d.FunctionsRemoved, f.Name)
+		}
+	}
+	for _, f := range b {
+		old, ok := a.Get(f.Name)
+		switch {
+		case !ok:
+			d.FunctionsAdded = append(d.FunctionsAdded, f.Name)
+		case old != f.Body:
+			d.FunctionsChanged = append(d.FunctionsChanged, f.Name)
+		}
+	}
+}
+
+func indexOf(list []string, s string) int {
+	for i, x := range list {
+		if x == s {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareIdentical(t *testing.T) {
+	for _, name := range compileCases(t) {
+		_, a := loadSaved(t, name)
+		_, b := loadSaved(t, name)
+		if d := Compare(a, b); !d.Empty() {
+			t.Errorf("%s: identical documents differ: %+v", name, d)
+		}
+	}
+}
+
+func TestCompareColumns(t *testing.T) {
+	col := func(id string) Column { return Column{ID: id, Name: id, Abbr: id[:1]} }
+	a := &Document{Columns: []Column{col("A"), col("B"), col("C"), col("D")}}
+	b := &Document{Columns: []Column{col("A"), col("C"), col("B"), col("E")}}
+	b.Columns[0].BackgroundColor = "#FFFFFF"
+
+	d := Compare(a, b)
+
+	if got := columnIDs(d.ColumnsAdded); !reflect.DeepEqual(got, []string{"E"}) {
+		t.Errorf("added = %v, want [E]", got)
+	}
+	if got := columnIDs(d.ColumnsRemoved); !reflect.DeepEqual(got, []string{"D"}) {
+		t.Errorf("removed = %v, want [D]", got)
+	}
+	wantMoves := []ColumnMove{{ID: "C", From: 2, To: 1}, {ID: "B", From: 1, To: 2}}
+	if !reflect.DeepEqual(d.ColumnsReordered, wantMoves) {
+		t.Errorf("reordered = %+v, want %+v", d.ColumnsReordered, wantMoves)
+	}
+	wantChanged := []ColumnChange{{ID: "A", Fields: []FieldChange{{Field: "backgroundColor", From: "", To: "#FFFFFF"}}}}
+	if !reflect.DeepEqual(d.ColumnsChanged, wantChanged) {
+		t.Errorf("changed = %+v, want %+v", d.ColumnsChanged, wantChanged)
+	}
+}
+
+func TestCompareRemovalIsNotAReorder(t *testing.T) {
+	col := func(id string) Column { return Column{ID: id} }
+	a := &Document{Columns: []Column{col("A"), col("B"), col("C")}}
+	b := &Document{Columns: []Column{col("B"), col("C")}}
+
+	if d := Compare(a, b); len(d.ColumnsReordered) != 0 {
+		t.Errorf("removing the first column reported moves: %+v", d.ColumnsReordered)
+	}
+}
+
+func TestCompareScoring(t *testing.T) {
+	_, a := loadSaved(t, "chains")
+	_, b := loadSaved(t, "chains")
+
+	wheal := &b.ScoringConfigs[0]
+	wheal.Scope = ScopePositive
+	wheal.Rules[0].Conditions[1].Thresh = "12"
+	wheal.Rules[1].Updates[0].Val = "Moderate"
+	wheal.Rules = append(wheal.Rules, ScoringRule{Updates: []ScoringUpdate{{Col: "Note", Val: "late"}}})
+	b.ScoringConfigs = b.ScoringConfigs[:1]
+
+	d := Compare(a, b)
+
+	wantTrigger := []TriggerChange{{Trigger: "Wheal", Fields: []FieldChange{{Field: "scope", From: ScopeNeither, To: ScopePositive}}}}
+	if !reflect.DeepEqual(d.TriggersChanged, wantTrigger) {
+		t.Errorf("triggers changed = %+v, want %+v", d.TriggersChanged, wantTrigger)
+	}
+
+	if len(d.RulesChanged) != 2 {
+		t.Fatalf("got %d changed rules, want 2: %+v", len(d.RulesChanged), d.RulesChanged)
+	}
+	cond := d.RulesChanged[0]
+	if cond.Index != 0 || len(cond.ConditionsAdded) != 1 || len(cond.ConditionsRemoved) != 1 ||
+		cond.ConditionsAdded[0].Thresh != "12" || cond.ConditionsRemoved[0].Thresh != "10" {
+		t.Errorf("rule 0 change = %+v", cond)
+	}
+	upd := d.RulesChanged[1]
+	wantUpd := []FieldChange{{Field: "Class", From: "Mild", To: "Moderate"}}
+	if upd.Index != 1 || !reflect.DeepEqual(upd.UpdatesChanged, wantUpd) {
+		t.Errorf("rule 1 change = %+v", upd)
+	}
+
+	if len(d.RulesAdded) != 1 || d.RulesAdded[0].Trigger != "Wheal" || d.RulesAdded[0].Index != 4 {
+		t.Errorf("rules added = %+v, want Wheal rule 4", d.RulesAdded)
+	}
+	if len(d.RulesRemoved) != 1 || d.RulesRemoved[0].Trigger != "Flare" || d.RulesRemoved[0].Index != 0 {
+		t.Errorf("rules removed = %+v, want Flare rule 0", d.RulesRemoved)
+	}
+}
+
+func TestCompareMergesConfigsSharingATrigger(t *testing.T) {
+	rule := func(val string) ScoringRule {
+		return ScoringRule{Updates: []ScoringUpdate{{Col: "S", Val: val}}}
+	}
+	a := &Document{ScoringConfigs: []ScoringConfig{
+		{TriggerColumn: "W", Rules: []ScoringRule{rule("1")}},
+		{TriggerColumn: "W", Rules: []ScoringRule{rule("2")}},
+	}}
+	b := &Document{ScoringConfigs: []ScoringConfig{
+		{TriggerColumn: "W", Rules: []ScoringRule{rule("1"), rule("2")}},
+	}}
+
+	if d := Compare(a, b); !d.Empty() {
+		t.Errorf("splitting a chain across cards reported changes: %+v", d)
+	}
+}
+
+func TestCompareFunctions(t *testing.T) {
+	a := &Document{NamedFunctions: NamedFunctions{{"autoFill", "x"}, {"old", "y"}, {"kept", "z"}}}
+	b := &Document{NamedFunctions: NamedFunctions{{"autoFill", "x"}, {"kept", "z2"}, {"new", "w"}}}
+
+	d := Compare(a, b)
+	if !reflect.DeepEqual(d.FunctionsAdded, []string{"new"}) ||
+		!reflect.DeepEqual(d.FunctionsRemoved, []string{"old"}) ||
+		!reflect.DeepEqual(d.FunctionsChanged, []string{"kept"}) {
+		t.Errorf("functions: added %v, removed %v, changed %v", d.FunctionsAdded, d.FunctionsRemoved, d.FunctionsChanged)
+	}
+}
+
+func columnIDs(cols []Column) []string {
+	var ids []string
+	for _, c := range cols {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
@@ -0,0 +1,411 @@
+package protocol
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Row is one grid row keyed by column id. Missing cells are null.
+type Row map[string]Value
+
+func (r Row) clone() Row {
+	out := make(Row, len(r))
+	for k, v := range r {
+		out[k] = v
+	}
+	return out
+}
+
+// Grid is the starting state for a simulation. NegativeRow and PositiveRow
+// are indexes into Rows, or nil when the set has no such reference.
+type Grid struct {
+	Rows        []Row `json:"rows"`
+	NegativeRow *int  `json:"negativeRow,omitempty"`
+	PositiveRow *int  `json:"positiveRow,omitempty"`
+}
+
+// Edit is one committed cell edit.
+type Edit struct {
+	Row    int    `json:"row"`
+	Column string `json:"column"`
+	Value  Value  `json:"value"`
+}
+
+// FocusMove is where a setFocus result sends the cursor. Column is empty
+// when the target index falls outside the grid.
+type FocusMove struct {
+	Row         int    `json:"row"`
+	ColumnIndex int    `json:"columnIndex"`
+	Column      string `json:"column,omitempty"`
+}
+
+// Step is the outcome of one edit.
+type Step struct {
+	Edit     Edit        `json:"edit"`
+	Focus    []FocusMove `json:"focus,omitempty"`
+	Updates  Row         `json:"updates,omitempty"`
+	Messages []string    `json:"messages,omitempty"`
+	Warnings []string    `json:"warnings,omitempty"`
+	Row      Row         `json:"row"`
+}
+
+// Simulation is the result of running a sequence of edits.
+type Simulation struct {
+	Steps []Step `json:"steps"`
+	Rows  []Row  `json:"rows"`
+}
+
+// Simulate applies edits to grid one at a time and runs the protocol's
+// calculation rules after each, the way the grid app does on commit.
+//
+// runCode results are evaluated from the scoring config that compiles to
+// the named function, not by executing JavaScript, so hand-written
+// functions are reported as warnings and skipped. Values set by a
+// function do not fire further change rules.
+func Simulate(doc *Document, grid Grid, edits []Edit) (*Simulation, error) {
+	colIndex := map[string]int{}
+	for i, c := range doc.Columns {
+		colIndex[c.ID] = i
+	}
+
+	configs := map[string]ScoringConfig{}
+	for _, cfg := range doc.ScoringConfigs {
+		configs[ScoringFunctionName(cfg)] = cfg
+	}
+
+	rows := make([]Row, len(grid.Rows))
+	for i, r := range grid.Rows {
+		rows[i] = r.clone()
+	}
+	for _, ref := range []*int{grid.NegativeRow, grid.PositiveRow} {
+		if ref != nil && (*ref < 0 || *ref >= len(rows)) {
+			return nil, fmt.Errorf("reference row %d is outside the grid", *ref)
+		}
+	}
+
+	sim := &Simulation{}
+	for i, e := range edits {
+		if e.Row < 0 || e.Row >= len(rows) {
+			return nil, fmt.Errorf("edits[%d]: row %d is outside the grid", i, e.Row)
+		}
+		if _, ok := colIndex[e.Column]; !ok {
+			return nil, fmt.Errorf("edits[%d]: unknown column '%s'", i, e.Column)
+		}
+
+		rows[e.Row][e.Column] = e.Value
+		step := Step{Edit: e}
+
+		for _, rule := range doc.CalculationRules {
+			if !ruleFires(rule, e.Column) {
+				continue
+			}
+			for _, res := range rule.Results {
+				switch res.Type {
+				case ResultSetFocus:
+					idx := colIndex[e.Column] + res.RelativeColumns
+					move := FocusMove{Row: e.Row + res.RelativeRows, ColumnIndex: idx}
+					if idx >= 0 && idx < len(doc.Columns) {
+						move.Column = doc.Columns[idx].ID
+					}
+					step.Focus = append(step.Focus, move)
+
+				case ResultRunCode:
+					cfg, ok := configs[res.FunctionName]
+					if !ok {
+						step.Warnings = append(step.Warnings,
+							fmt.Sprintf("function '%s' is custom code and was not run", res.FunctionName))
+						continue
+					}
+					env := &evalEnv{rows: rows, row: e.Row, grid: grid}
+					out := env.run(cfg)
+					step.Messages = append(step.Messages, out.messages...)
+					if out.err != "" {
+						step.Warnings = append(step.Warnings, out.err)
+					}
+					for col, v := range out.updates {
+						rows[e.Row][col] = v
+						if step.Updates == nil {
+							step.Updates = Row{}
+						}
+						step.Updates[col] = v
+					}
+
+				default:
+					step.Warnings = append(step.Warnings,
+						fmt.Sprintf("result type '%s' is not simulated", res.Type))
+				}
+			}
+		}
+
+		step.Row = rows[e.Row].clone()
+		sim.Steps = append(sim.Steps, step)
+	}
+
+	sim.Rows = rows
+	return sim, nil
+}
+
+func ruleFires(rule CalculationRule, column string) bool {
+	if len(rule.Conditions) == 0 {
+		return false
+	}
+	for _, c := range rule.Conditions {
+		if c.Type != ConditionChange || !containsString(c.ColumnIDs, column) {
+			return false
+		}
+	}
+	return true
+}
+
+/* ======================================================
+   Scoring function evaluation
+   ====================================================== */
+
+type evalEnv struct {
+	rows []Row
+	row  int
+	grid Grid
+}
+
+type evalResult struct {
+	updates  Row
+	messages []string
+	err      string
+}
+
+func (e *evalEnv) refRow(idx *int) Row {
+	if idx == nil {
+		return nil
+	}
+	return e.rows[*idx]
+}
+
+// run mirrors the body CompileScoringConfig generates, guard by guard.
+func (e *evalEnv) run(cfg ScoringConfig) evalResult {
+	isNeg := e.grid.NegativeRow != nil && e.row == *e.grid.NegativeRow
+	isPos := e.grid.PositiveRow != nil && e.row == *e.grid.PositiveRow
+	neg := e.refRow(e.grid.NegativeRow)
+	pos := e.refRow(e.grid.PositiveRow)
+
+	switch cfg.Scope {
+	case ScopeNegative:
+		if !isNeg {
+			return evalResult{}
+		}
+	case ScopePositive:
+		if !isPos {
+			return evalResult{}
+		}
+	case ScopeNeither:
+		if isNeg || isPos {
+			return evalResult{}
+		}
+	}
+
+	clearTrigger := func(msg string) evalResult {
+		return evalResult{
+			updates:  Row{cfg.TriggerColumn: Null()},
+			messages: []string{msg},
+		}
+	}
+
+	if cfg.RequireNegative {
+		if neg == nil {
+			return clearTrigger("This set must contain a negative reference.")
+		}
+		if !isNeg && neg[cfg.TriggerColumn].IsNull() {
+			return clearTrigger("You must first score the negative reference.")
+		}
+	}
+	if cfg.RequirePositive {
+		if pos == nil {
+			return clearTrigger("This set must contain a positive reference.")
+		}
+		if !isPos && pos[cfg.TriggerColumn].IsNull() {
+			return clearTrigger("You must first score the positive reference.")
+		}
+	}
+
+	row := e.rows[e.row]
+	for _, rule := range cfg.Rules {
+		matched := true
+		for _, c := range rule.Conditions {
+			ok, err := conditionHolds(c, row, neg, pos)
+			if err != "" {
+				return evalResult{err: err}
+			}
+			if !ok {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		updates := Row{}
+		for _, u := range rule.Updates {
+			if numericPattern.MatchString(u.Val) {
+				f, _ := strconv.ParseFloat(u.Val, 64)
+				updates[u.Col] = Number(f)
+			} else {
+				updates[u.Col] = String(u.Val)
+			}
+		}
+		return evalResult{updates: updates}
+	}
+
+	return evalResult{}
+}
+
+// conditionHolds evaluates ConditionExpr with JavaScript comparison
+// semantics. A non-empty string is the TypeError the generated code would
+// throw (reading a column of a missing reference row).
+func conditionHolds(c ScoringCondition, row, neg, pos Row) (bool, string) {
+	if c.Col == "" || c.Op == OpAlways {
+		return true, ""
+	}
+
+	lhs := row[c.Col]
+
+	if !numericPattern.MatchString(c.Thresh) {
+		rhs := String(c.Thresh)
+		switch c.Op {
+		case "==", "===":
+			return strictEquals(lhs, rhs), ""
+		case "!=", "!==":
+			return !strictEquals(lhs, rhs), ""
+		default:
+			return jsCompare(c.Op, lhs, rhs), ""
+		}
+	}
+
+	thresh, _ := strconv.ParseFloat(c.Thresh, 64)
+	rhs := thresh
+	switch c.Base {
+	case BaseNegative:
+		if neg == nil {
+			return false, "Cannot read properties of null (reading '" + c.Col + "')"
+		}
+		rhs = jsParseInt(neg[c.Col]) + thresh
+	case BasePositive:
+		if pos == nil {
+			return false, "Cannot read properties of null (reading '" + c.Col + "')"
+		}
+		rhs = jsParseInt(pos[c.Col]) + thresh
+	}
+
+	return jsCompare(c.Op, lhs, Number(rhs)), ""
+}
+
+func strictEquals(a, b Value) bool {
+	if a.kind != b.kind {
+		return false
+	}
+	switch a.kind {
+	case kindNumber:
+		return a.num == b.num
+	case kindString:
+		return a.str == b.str
+	default:
+		return true
+	}
+}
+
+// jsCompare implements the JS relational and loose equality operators for
+// the value types a grid cell can hold.
+func jsCompare(op string, a, b Value) bool {
+	switch op {
+	case "==":
+		return looseEquals(a, b)
+	case "!=":
+		return !looseEquals(a, b)
+	case "===":
+		return strictEquals(a, b)
+	case "!==":
+		return !strictEquals(a, b)
+	}
+
+	// Two strings compare lexically; anything else compares as numbers.
+	if a.IsString() && b.IsString() {
+		switch op {
+		case "<":
+			return a.str < b.str
+		case "<=":
+			return a.str <= b.str
+		case ">":
+			return a.str > b.str
+		case ">=":
+			return a.str >= b.str
+		}
+		return false
+	}
+
+	x, y := jsToNumber(a), jsToNumber(b)
+	switch op {
+	case "<":
+		return x < y
+	case "<=":
+		return x <= y
+	case ">":
+		return x > y
+	case ">=":
+		return x >= y
+	}
+	return false
+}
+
+func looseEquals(a, b Value) bool {
+	if a.IsNull() || b.IsNull() {
+		return a.IsNull() && b.IsNull()
+	}
+	if a.kind == b.kind {
+		return strictEquals(a, b)
+	}
+	return jsToNumber(a) == jsToNumber(b)
+}
+
+func jsToNumber(v Value) float64 {
+	switch v.kind {
+	case kindNumber:
+		return v.num
+	case kindString:
+		s := strings.TrimSpace(v.str)
+		if s == "" {
+			return 0
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return f
+	default:
+		return 0
+	}
+}
+
+// jsParseInt is parseInt(String(v), 10).
+func jsParseInt(v Value) float64 {
+	if v.IsNull() {
+		return math.NaN()
+	}
+	s := strings.TrimSpace(v.String())
+	end := 0
+	if end < len(s) && (s[end] == '-' || s[end] == '+') {
+		end++
+	}
+	digits := end
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	if end == digits {
+		return math.NaN()
+	}
+	n, err := strconv.ParseFloat(s[:end], 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return n
+}
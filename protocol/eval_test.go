@@ -0,0 +1,185 @@
+package protocol
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func intPtr(i int) *int { return &i }
+
+// chainsGrid is a set whose first row is the negative reference, scored
+// with the given wheal (null to leave it unscored).
+func chainsGrid(negWheal Value) Grid {
+	return Grid{
+		Rows:        []Row{{"Wheal": negWheal}, {"Flare": Number(10)}, {}},
+		NegativeRow: intPtr(0),
+	}
+}
+
+func TestSimulateScoringChain(t *testing.T) {
+	doc, _ := loadSaved(t, "chains")
+	doc = Compile(doc)
+
+	tests := []struct {
+		wheal float64
+		want  Row
+	}{
+		{8, Row{"Class": String("Severe"), "Note": String("check"), "Flare": Number(10)}},
+		{5, Row{"Class": String("Mild")}},
+		{3, Row{"Class": String("None")}},
+	}
+	for _, tt := range tests {
+		sim, err := Simulate(doc, chainsGrid(Number(1)), []Edit{{Row: 1, Column: "Wheal", Value: Number(tt.wheal)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		step := sim.Steps[0]
+		if !reflect.DeepEqual(step.Updates, tt.want) {
+			t.Errorf("Wheal %v: updates = %v, want %v", tt.wheal, step.Updates, tt.want)
+		}
+		if want := []FocusMove{{Row: 2, ColumnIndex: 0, Column: "Wheal"}}; !reflect.DeepEqual(step.Focus, want) {
+			t.Errorf("Wheal %v: focus = %+v, want %+v", tt.wheal, step.Focus, want)
+		}
+		if len(step.Warnings) != 0 {
+			t.Errorf("Wheal %v: unexpected warnings %v", tt.wheal, step.Warnings)
+		}
+	}
+}
+
+func TestSimulateReferenceGuards(t *testing.T) {
+	doc, _ := loadSaved(t, "chains")
+	doc = Compile(doc)
+	edit := []Edit{{Row: 1, Column: "Wheal", Value: Number(8)}}
+
+	noRef := chainsGrid(Null())
+	noRef.NegativeRow = nil
+
+	tests := []struct {
+		name string
+		grid Grid
+		msg  string
+	}{
+		{"no negative reference", noRef, "This set must contain a negative reference."},
+		{"negative reference unscored", chainsGrid(Null()), "You must first score the negative reference."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sim, err := Simulate(doc, tt.grid, edit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			step := sim.Steps[0]
+			if want := []string{tt.msg}; !reflect.DeepEqual(step.Messages, want) {
+				t.Errorf("messages = %v, want %v", step.Messages, want)
+			}
+			if got := step.Row["Wheal"]; !got.IsNull() {
+				t.Errorf("trigger cell = %v, want it cleared", got)
+			}
+		})
+	}
+
+	// Edits on the reference row itself are out of scope for "neither".
+	sim, err := Simulate(doc, chainsGrid(Null()), []Edit{{Row: 0, Column: "Wheal", Value: Number(2)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step := sim.Steps[0]; step.Updates != nil || step.Messages != nil {
+		t.Errorf("reference row edit ran the scoring function: %+v", step)
+	}
+}
+
+func TestSimulateWarnsAboutCustomCode(t *testing.T) {
+	doc, _ := loadSaved(t, "chains")
+	doc.CustomFunctions = []CustomFunction{{Name: "handWritten", Body: "return null;"}}
+	doc.CustomRules = []CalculationRule{{
+		Conditions: []Condition{{Type: ConditionChange, ColumnIDs: []string{"Note"}}},
+		Results:    []Result{{Type: ResultRunCode, FunctionName: "handWritten"}},
+	}}
+	doc = Compile(doc)
+
+	sim, err := Simulate(doc, chainsGrid(Null()), []Edit{{Row: 1, Column: "Note", Value: String("x")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"function 'handWritten' is custom code and was not run"}
+	if got := sim.Steps[0].Warnings; !reflect.DeepEqual(got, want) {
+		t.Errorf("warnings = %v, want %v", got, want)
+	}
+}
+
+func TestSimulateRejectsBadEdits(t *testing.T) {
+	doc, _ := loadSaved(t, "chains")
+	tests := []struct {
+		name string
+		grid Grid
+		edit Edit
+	}{
+		{"row outside grid", chainsGrid(Null()), Edit{Row: 3, Column: "Wheal"}},
+		{"unknown column", chainsGrid(Null()), Edit{Row: 1, Column: "Nope"}},
+		{"reference outside grid", Grid{Rows: []Row{{}}, PositiveRow: intPtr(1)}, Edit{Row: 0, Column: "Wheal"}},
+	}
+	for _, tt := range tests {
+		if _, err := Simulate(doc, tt.grid, []Edit{tt.edit}); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestConditionHolds(t *testing.T) {
+	neg := Row{"W": String("4px")}
+	tests := []struct {
+		name string
+		cond ScoringCondition
+		row  Row
+		want bool
+	}{
+		{"string equality", ScoringCondition{Col: "G", Op: "==", Thresh: "High"}, Row{"G": String("High")}, true},
+		{"string equality is strict", ScoringCondition{Col: "G", Op: "===", Thresh: "High"}, Row{"G": Null()}, false},
+		{"number against string threshold", ScoringCondition{Col: "G", Op: ">", Thresh: "M"}, Row{"G": Number(5)}, false},
+		{"strings compare lexically", ScoringCondition{Col: "G", Op: ">", Thresh: "M"}, Row{"G": String("N")}, true},
+		{"numeric string against number", ScoringCondition{Col: "S", Op: "<=", Thresh: "2.5"}, Row{"S": String("2")}, true},
+		{"loose equality coerces", ScoringCondition{Col: "S", Op: "==", Thresh: "7"}, Row{"S": String("7")}, true},
+		{"strict equality does not", ScoringCondition{Col: "S", Op: "===", Thresh: "7"}, Row{"S": String("7")}, false},
+		{"null is zero in relations", ScoringCondition{Col: "S", Op: ">=", Thresh: "0"}, Row{}, true},
+		{"null is not zero in equality", ScoringCondition{Col: "S", Op: "==", Thresh: "0"}, Row{}, false},
+		{"empty threshold is a string", ScoringCondition{Col: "S", Op: ">", Thresh: ""}, Row{"S": Number(1)}, true},
+		{"negative base uses parseInt", ScoringCondition{Col: "W", Op: ">", Thresh: "2", Base: BaseNegative}, Row{"W": Number(7)}, true},
+		{"negative base offset", ScoringCondition{Col: "W", Op: ">", Thresh: "3", Base: BaseNegative}, Row{"W": Number(7)}, false},
+		{"always", ScoringCondition{Op: OpAlways}, Row{}, true},
+	}
+	for _, tt := range tests {
+		got, err := conditionHolds(tt.cond, tt.row, neg, nil)
+		if err != "" {
+			t.Errorf("%s: unexpected error %q", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	_, err := conditionHolds(ScoringCondition{Col: "W", Op: ">", Thresh: "0", Base: BasePositive}, Row{}, neg, nil)
+	if want := "Cannot read properties of null (reading 'W')"; err != want {
+		t.Errorf("missing positive reference: error = %q, want %q", err, want)
+	}
+}
+
+func TestJSParseInt(t *testing.T) {
+	tests := []struct {
+		in   Value
+		want float64
+	}{
+		{Number(12), 12},
+		{String(" 42abc"), 42},
+		{String("-7"), -7},
+		{String("abc"), math.NaN()},
+		{Null(), math.NaN()},
+	}
+	for _, tt := range tests {
+		got := jsParseInt(tt.in)
+		if got != tt.want && !(math.IsNaN(got) && math.IsNaN(tt.want)) {
+			t.Errorf("jsParseInt(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Export is the protocol as Xtract consumes it: the saved document with the
+// builder-only meta stripped (stripUiMeta in protocols.js). Field order is
+// the order stripUiMeta builds its object in.
+type Export struct {
+	ProtocolID       int64             `json:"protocol_id"`
+	VersionNumber    int               `json:"version_number"`
+	Columns          []ExportColumn    `json:"columns"`
+	NamedFunctions   NamedFunctions    `json:"namedFunctions"`
+	CalculationRules []CalculationRule `json:"calculationRules"`
+}
+
+// ExportColumn is a column without the builder's allowInt / allowStr /
+// range / tab hints. Empty optional settings are left out, as in the
+// browser.
+type ExportColumn struct {
+	ID                    string          `json:"id"`
+	Name                  string          `json:"name"`
+	Abbr                  string          `json:"abbr"`
+	BackgroundColor       string          `json:"backgroundColor"`
+	AutoFill              *AutoFill       `json:"autoFill,omitempty"`
+	ShowWhenPrescribing   bool            `json:"showWhenPrescribing,omitempty"`
+	PossibleValues        []PossibleValue `json:"possibleValues,omitempty"`
+	UseAsStartingDilution bool            `json:"useAsStartingDilution,omitempty"`
+	PositiveValues        []PossibleValue `json:"positiveValues,omitempty"`
+}
+
+// StripUIMeta returns the export form of doc. doc itself is not modified.
+func StripUIMeta(doc *Document) *Export {
+	out := &Export{
+		ProtocolID:       doc.ProtocolID,
+		VersionNumber:    doc.VersionNumber,
+		Columns:          make([]ExportColumn, 0, len(doc.Columns)),
+		NamedFunctions:   doc.NamedFunctions,
+		CalculationRules: doc.CalculationRules,
+	}
+	if out.CalculationRules == nil {
+		out.CalculationRules = []CalculationRule{}
+	}
+
+	for _, c := range doc.Columns {
+		out.Columns = append(out.Columns, ExportColumn{
+			ID:                    c.ID,
+			Name:                  c.Name,
+			Abbr:                  c.Abbr,
+			BackgroundColor:       c.BackgroundColor,
+			AutoFill:              c.AutoFill,
+			ShowWhenPrescribing:   c.ShowWhenPrescribing,
+			PossibleValues:        c.PossibleValues,
+			UseAsStartingDilution: c.UseAsStartingDilution,
+			PositiveValues:        c.PositiveValues,
+		})
+	}
+	return out
+}
+
+// Canonical encodes e compactly with keys in the fixed order above and no
+// HTML escaping, and returns the bytes with their SHA-256 in hex. The same
+// document always encodes to the same bytes, so downstream systems can use
+// the hash to tell whether a protocol really changed.
+func (e *Export) Canonical() ([]byte, string, error) {
+	b, err := Marshal(e)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(b)
+	return b, hex.EncodeToString(sum[:]), nil
+}
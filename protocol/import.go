@@ -0,0 +1,446 @@
+package protocol
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ImportReport describes what Import made of a hand-written protocol.
+type ImportReport struct {
+	// Scoring functions read back into scoring configs.
+	ScoringConfigs int `json:"scoringConfigs"`
+	// Functions kept as opaque custom code; each says why.
+	CustomFunctions []CustomFunction `json:"customFunctions"`
+	// Calculation rules kept as they were because the builder does not
+	// generate anything like them.
+	CustomRules int `json:"customRules"`
+	// Anything else that changed or needs a look.
+	Warnings []string `json:"warnings"`
+}
+
+// Import turns an Xtract protocol that only has columns, calculationRules
+// and namedFunctions into one the builder can edit. Focus rules become
+// column tab behaviours and set...From... functions become scoring configs
+// when their bodies are exactly what CompileScoringConfig would emit for
+// the rules read out of them. Everything else is kept as custom code, so
+// Compile(result) still produces every function and rule of the input.
+func Import(doc *Document) (*Document, *ImportReport) {
+	out := *doc
+	out.Columns = append([]Column(nil), doc.Columns...)
+	out.ScoringConfigs = nil
+	out.CustomFunctions = nil
+	out.CustomRules = nil
+
+	report := &ImportReport{CustomFunctions: []CustomFunction{}, Warnings: []string{}}
+
+	colIndex := map[string]int{}
+	for i, c := range out.Columns {
+		colIndex[c.ID] = i
+	}
+
+	// How many rules call each function; one shared by several triggers
+	// can't be a single scoring config.
+	calls := map[string]int{}
+	for _, rule := range doc.CalculationRules {
+		for _, res := range rule.Results {
+			if res.Type == ResultRunCode {
+				calls[res.FunctionName]++
+			}
+		}
+	}
+
+	hasFocus := map[string]bool{}
+	converted := map[string]bool{}
+	custom := map[string]string{} // function name -> reason
+
+	for i, rule := range doc.CalculationRules {
+		trigger, ok := singleChangeColumn(rule)
+		if !ok || len(rule.Results) != 1 {
+			out.CustomRules = append(out.CustomRules, rule)
+			report.Warnings = append(report.Warnings,
+				fmt.Sprintf("calculationRules[%d] is not a single-column rule with one result and was kept as is", i))
+			markCustom(custom, rule, "called from a rule the builder does not generate")
+			continue
+		}
+
+		res := rule.Results[0]
+		switch res.Type {
+		case ResultSetFocus:
+			idx, known := colIndex[trigger]
+			tab, recognised := tabBehaviorFor(res)
+			if !known || !recognised || hasFocus[trigger] {
+				out.CustomRules = append(out.CustomRules, rule)
+				report.Warnings = append(report.Warnings,
+					fmt.Sprintf("calculationRules[%d] moves focus in a way the builder does not generate and was kept as is", i))
+				continue
+			}
+			hasFocus[trigger] = true
+			out.Columns[idx].TabBehavior = tab
+
+		case ResultRunCode:
+			name := res.FunctionName
+			body, exists := doc.NamedFunctions.Get(name)
+			if !exists {
+				out.CustomRules = append(out.CustomRules, rule)
+				report.Warnings = append(report.Warnings,
+					fmt.Sprintf("calculationRules[%d] calls missing function '%s' and was kept as is", i, name))
+				continue
+			}
+			if converted[name] || custom[name] != "" {
+				out.CustomRules = append(out.CustomRules, rule)
+				if custom[name] == "" {
+					custom[name] = "called from more than one rule"
+				}
+				continue
+			}
+			if calls[name] > 1 {
+				out.CustomRules = append(out.CustomRules, rule)
+				custom[name] = "called from more than one rule"
+				continue
+			}
+
+			cfg, reason := DecompileScoringFunction(trigger, body)
+			if reason != "" {
+				out.CustomRules = append(out.CustomRules, rule)
+				custom[name] = reason
+				continue
+			}
+
+			converted[name] = true
+			out.ScoringConfigs = append(out.ScoringConfigs, cfg)
+			report.ScoringConfigs++
+			if generated := ScoringFunctionName(cfg); generated != name {
+				report.Warnings = append(report.Warnings,
+					fmt.Sprintf("function '%s' will be saved as '%s', the name the builder gives it", name, generated))
+			}
+
+		default:
+			out.CustomRules = append(out.CustomRules, rule)
+			report.Warnings = append(report.Warnings,
+				fmt.Sprintf("calculationRules[%d] has result type '%s' and was kept as is", i, res.Type))
+		}
+	}
+
+	for _, c := range out.Columns {
+		if !hasFocus[c.ID] {
+			report.Warnings = append(report.Warnings,
+				fmt.Sprintf("column '%s' had no focus rule; the builder adds one that moves to the next column", c.ID))
+		}
+	}
+
+	for _, fn := range doc.NamedFunctions {
+		switch {
+		case fn.Name == "autoFill":
+			if fn.Body != AutoFillFunction {
+				report.Warnings = append(report.Warnings,
+					"autoFill differs from the standard function and will be replaced by it")
+			}
+		case converted[fn.Name]:
+		default:
+			reason := custom[fn.Name]
+			if reason == "" {
+				reason = "not called by any calculation rule"
+			}
+			cf := CustomFunction{Name: fn.Name, Body: fn.Body, Reason: reason}
+			out.CustomFunctions = append(out.CustomFunctions, cf)
+			report.CustomFunctions = append(report.CustomFunctions, cf)
+		}
+	}
+
+	report.CustomRules = len(out.CustomRules)
+	return &out, report
+}
+
+// markCustom records a reason for every function rule calls that has not
+// been given one yet.
+func markCustom(custom map[string]string, rule CalculationRule, reason string) {
+	for _, res := range rule.Results {
+		if res.Type == ResultRunCode && custom[res.FunctionName] == "" {
+			custom[res.FunctionName] = reason
+		}
+	}
+}
+
+// singleChangeColumn returns the column of a rule with exactly one change
+// condition on exactly one column, the only shape the builder emits.
+func singleChangeColumn(rule CalculationRule) (string, bool) {
+	if len(rule.Conditions) != 1 {
+		return "", false
+	}
+	c := rule.Conditions[0]
+	if c.Type != ConditionChange || len(c.ColumnIDs) != 1 {
+		return "", false
+	}
+	return c.ColumnIDs[0], true
+}
+
+// tabBehaviorFor is the inverse of FocusRule.
+func tabBehaviorFor(res Result) (string, bool) {
+	switch {
+	case res.FunctionName != "":
+		return "", false
+	case res.RelativeRows == 0 && res.RelativeColumns == 1:
+		return TabNextColumn, true
+	case res.RelativeRows == 1 && res.RelativeColumns == 0:
+		return TabNextRow, true
+	case res.RelativeRows == 1 && res.RelativeColumns == -1:
+		return TabNextRowPrevColumn, true
+	}
+	return "", false
+}
+
+/* ======================================================
+   Scoring function decompiler
+   ====================================================== */
+
+var (
+	ruleHeadPattern   = regexp.MustCompile(`^(if|else if) \((.*)\) \{$`)
+	updateLinePattern = regexp.MustCompile(`^'((?:[^'\\]|\\.)*)': (.+?),?$`)
+	compareOpPattern  = `(===|!==|==|!=|>=|<=|>|<)`
+	stringCondPattern = regexp.MustCompile(`^row\['((?:[^'\\]|\\.)*)'\] ` + compareOpPattern + ` '((?:[^'\\]|\\.)*)'$`)
+	refCondPattern    = regexp.MustCompile(`^row\['((?:[^'\\]|\\.)*)'\] ` + compareOpPattern +
+		` parseInt\((negative|positive)ReferenceRow\['((?:[^'\\]|\\.)*)'\], 10\) \+ (-?\d+(?:\.\d+)?)$`)
+	numCondPattern = regexp.MustCompile(`^row\['((?:[^'\\]|\\.)*)'\] ` + compareOpPattern + ` (\S+)$`)
+)
+
+// DecompileScoringFunction reads the scoring config back out of a function
+// body that CompileScoringConfig generated for trigger. It returns a reason
+// instead when the body is anything else; the result is only accepted if
+// compiling it gives the same body again (ignoring indentation and blank
+// lines).
+func DecompileScoringFunction(trigger, body string) (ScoringConfig, string) {
+	cfg := ScoringConfig{TriggerColumn: trigger}
+
+	lines := codeLines(body)
+	p := &lineReader{lines: lines}
+
+	if !p.take("var rowUpdates = {};") {
+		return cfg, "does not start with 'var rowUpdates = {};'"
+	}
+
+	earlyReturn := []string{"return { type: 'setValues', row: rowUpdates };", "}"}
+	switch {
+	case p.takeAll(append([]string{"if (!committedItemIsNegativeReference) {"}, earlyReturn...)...):
+		cfg.Scope = ScopeNegative
+	case p.takeAll(append([]string{"if (!committedItemIsPositiveReference) {"}, earlyReturn...)...):
+		cfg.Scope = ScopePositive
+	case p.takeAll(append([]string{"if (committedItemIsNegativeReference || committedItemIsPositiveReference) {"}, earlyReturn...)...):
+		cfg.Scope = ScopeNeither
+	default:
+		return cfg, "has no reference scope guard"
+	}
+
+	// The reference requirement blocks are fixed text around the trigger.
+	_, probeBody := CompileScoringConfig(ScoringConfig{TriggerColumn: trigger, RequireNegative: true, RequirePositive: true})
+	guards := codeLines(probeBody)
+	guards = guards[1 : len(guards)-1] // drop the header and the final return
+	negGuard, posGuard := guards[:len(guards)/2], guards[len(guards)/2:]
+	if p.takeAll(negGuard...) {
+		cfg.RequireNegative = true
+	}
+	if p.takeAll(posGuard...) {
+		cfg.RequirePositive = true
+	}
+
+	for idx := 0; !p.done() && !p.peek("return { type: 'setValues', row: rowUpdates };"); idx++ {
+		m := ruleHeadPattern.FindStringSubmatch(p.next())
+		if m == nil || (idx == 0) != (m[1] == "if") {
+			return cfg, fmt.Sprintf("rule %d is not an if / else if branch", idx+1)
+		}
+		conds, ok := parseConditions(m[2])
+		if !ok {
+			return cfg, fmt.Sprintf("rule %d has a condition the builder does not generate", idx+1)
+		}
+
+		if !p.take("rowUpdates = {") {
+			return cfg, fmt.Sprintf("rule %d does not set rowUpdates", idx+1)
+		}
+		var updates []ScoringUpdate
+		for !p.done() && !p.peek("};") {
+			u := updateLinePattern.FindStringSubmatch(p.next())
+			if u == nil {
+				return cfg, fmt.Sprintf("rule %d has an update the builder does not generate", idx+1)
+			}
+			val, ok := parseValueLiteral(u[2])
+			if !ok {
+				return cfg, fmt.Sprintf("rule %d sets a value that is not a plain number or string", idx+1)
+			}
+			updates = append(updates, ScoringUpdate{Col: unescapeSingleQuotes(u[1]), Val: val})
+		}
+		if !p.takeAll("};", "}") {
+			return cfg, fmt.Sprintf("rule %d is not closed the way the builder closes it", idx+1)
+		}
+		cfg.Rules = append(cfg.Rules, ScoringRule{Conditions: conds, Updates: updates})
+	}
+
+	if !p.take("return { type: 'setValues', row: rowUpdates };") || !p.done() {
+		return cfg, "does not end with the builder's return statement"
+	}
+	if len(cfg.Rules) == 0 {
+		return cfg, "has no scoring rules"
+	}
+
+	_, again := CompileScoringConfig(cfg)
+	if strings.Join(codeLines(again), "\n") != strings.Join(lines, "\n") {
+		return cfg, "differs from what the builder would generate for the same rules"
+	}
+	return cfg, ""
+}
+
+// parseConditions splits "(a) && (b)" back into scoring conditions. "true"
+// on its own is a rule without conditions.
+func parseConditions(full string) ([]ScoringCondition, bool) {
+	if full == "true" {
+		return nil, true
+	}
+
+	var exprs []string
+	rest := full
+	for {
+		expr, after, ok := cutParenthesized(rest)
+		if !ok {
+			return nil, false
+		}
+		exprs = append(exprs, expr)
+		if after == "" {
+			break
+		}
+		if !strings.HasPrefix(after, " && ") {
+			return nil, false
+		}
+		rest = after[len(" && "):]
+	}
+
+	conds := make([]ScoringCondition, 0, len(exprs))
+	for _, e := range exprs {
+		c, ok := parseCondition(e)
+		if !ok {
+			return nil, false
+		}
+		conds = append(conds, c)
+	}
+	return conds, true
+}
+
+func parseCondition(expr string) (ScoringCondition, bool) {
+	if expr == "true" {
+		return ScoringCondition{Op: OpAlways, Base: BaseZero}, true
+	}
+	if m := refCondPattern.FindStringSubmatch(expr); m != nil {
+		if m[1] != m[4] {
+			return ScoringCondition{}, false
+		}
+		base := BaseNegative
+		if m[3] == "positive" {
+			base = BasePositive
+		}
+		return ScoringCondition{Col: unescapeSingleQuotes(m[1]), Op: m[2], Thresh: m[5], Base: base}, true
+	}
+	if m := numCondPattern.FindStringSubmatch(expr); m != nil && numericPattern.MatchString(m[3]) {
+		return ScoringCondition{Col: unescapeSingleQuotes(m[1]), Op: m[2], Thresh: m[3], Base: BaseZero}, true
+	}
+	if m := stringCondPattern.FindStringSubmatch(expr); m != nil {
+		// String comparisons are emitted strict; the builder stores == / !=.
+		op := m[2]
+		switch op {
+		case "===":
+			op = "=="
+		case "!==":
+			op = "!="
+		}
+		return ScoringCondition{Col: unescapeSingleQuotes(m[1]), Op: op, Thresh: unescapeSingleQuotes(m[3]), Base: BaseZero}, true
+	}
+	return ScoringCondition{}, false
+}
+
+// cutParenthesized takes "(expr)rest" apart, skipping parentheses inside
+// single-quoted strings.
+func cutParenthesized(s string) (expr, rest string, ok bool) {
+	if !strings.HasPrefix(s, "(") {
+		return "", "", false
+	}
+	depth, inString := 0, false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case inString && c == '\\':
+			i++
+		case c == '\'':
+			inString = !inString
+		case inString:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return s[1:i], s[i+1:], true
+			}
+		}
+	}
+	return "", "", false
+}
+
+func parseValueLiteral(lit string) (string, bool) {
+	if numericPattern.MatchString(lit) {
+		return lit, true
+	}
+	if len(lit) >= 2 && lit[0] == '\'' && lit[len(lit)-1] == '\'' {
+		return unescapeSingleQuotes(lit[1 : len(lit)-1]), true
+	}
+	return "", false
+}
+
+func unescapeSingleQuotes(s string) string {
+	return strings.ReplaceAll(s, `\'`, "'")
+}
+
+// codeLines is body without blank lines, indentation or \r, which is all a
+// hand edit of generated code usually changes.
+func codeLines(body string) []string {
+	var out []string
+	for _, l := range strings.Split(body, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+type lineReader struct {
+	lines []string
+	pos   int
+}
+
+func (r *lineReader) done() bool { return r.pos >= len(r.lines) }
+
+func (r *lineReader) peek(line string) bool { return !r.done() && r.lines[r.pos] == line }
+
+func (r *lineReader) next() string {
+	if r.done() {
+		return ""
+	}
+	r.pos++
+	return r.lines[r.pos-1]
+}
+
+func (r *lineReader) take(line string) bool {
+	if r.peek(line) {
+		r.pos++
+		return true
+	}
+	return false
+}
+
+// takeAll consumes lines only if all of them come next, in order.
+func (r *lineReader) takeAll(lines ...string) bool {
+	if r.pos+len(lines) > len(r.lines) {
+		return false
+	}
+	for i, l := range lines {
+		if r.lines[r.pos+i] != l {
+			return false
+		}
+	}
+	r.pos += len(lines)
+	return true
+}
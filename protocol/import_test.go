@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+// loadExport parses a case's exported JSON: what Xtract has, with no
+// scoringConfigs or tab behaviours to go on.
+func loadExport(t *testing.T, name string) *Document {
+	t.Helper()
+	doc, err := Parse(readGolden(t, name+".export.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestImportRoundTrip(t *testing.T) {
+	for _, name := range compileCases(t) {
+		t.Run(name, func(t *testing.T) {
+			imported, report := Import(loadExport(t, name))
+			if len(report.CustomFunctions) != 0 || report.CustomRules != 0 {
+				t.Fatalf("builder output kept as custom code: %+v", report)
+			}
+
+			got, err := MarshalIndent(StripUIMeta(Compile(imported)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := readGolden(t, name+".export.json")
+			if string(got) != string(want) {
+				t.Errorf("Compile(Import(x)) differs from x at %s", firstDiff(string(got), string(want)))
+			}
+		})
+	}
+}
+
+func TestImportRecoversBuilderSettings(t *testing.T) {
+	_, saved := loadSaved(t, "chains")
+	imported, report := Import(loadExport(t, "chains"))
+
+	if report.ScoringConfigs != len(saved.ScoringConfigs) {
+		t.Errorf("got %d scoring configs, want %d", report.ScoringConfigs, len(saved.ScoringConfigs))
+	}
+	for i, want := range saved.ScoringConfigs {
+		if i >= len(imported.ScoringConfigs) {
+			break
+		}
+		if d := Compare(&Document{ScoringConfigs: []ScoringConfig{want}}, &Document{ScoringConfigs: imported.ScoringConfigs[i : i+1]}); !d.Empty() {
+			t.Errorf("scoringConfigs[%d] for %q read back differently: %+v", i, want.TriggerColumn, d)
+		}
+	}
+	for i, c := range imported.Columns {
+		if want := saved.Columns[i].TabBehavior; c.TabBehavior != want {
+			t.Errorf("column %q tab behaviour = %q, want %q", c.ID, c.TabBehavior, want)
+		}
+	}
+}
+
+func TestImportKeepsUnrecognisedCode(t *testing.T) {
+	doc := loadExport(t, "chains")
+
+	edited, _ := doc.NamedFunctions.Get("setClassFromFlare")
+	doc.NamedFunctions.Set("setClassFromFlare", strings.Replace(edited, "'Class': 4", "'Class': 4 + 1", 1))
+	doc.NamedFunctions.Set("helper", "return null;")
+	doc.NamedFunctions.Set("shared", "return null;")
+	for _, col := range []string{"Wheal", "Flare"} {
+		doc.CalculationRules = append(doc.CalculationRules, CalculationRule{
+			Conditions: []Condition{{Type: ConditionChange, ColumnIDs: []string{col}}},
+			Results:    []Result{{Type: ResultRunCode, FunctionName: "shared"}},
+		})
+	}
+	doc.CalculationRules = append(doc.CalculationRules, CalculationRule{
+		Conditions: []Condition{{Type: ConditionChange, ColumnIDs: []string{"Wheal", "Flare"}}},
+		Results:    []Result{{Type: ResultSetValue}},
+	})
+
+	imported, report := Import(doc)
+
+	wantReasons := map[string]string{
+		"setClassFromFlare": "rule 1 sets a value that is not a plain number or string",
+		"helper":            "not called by any calculation rule",
+		"shared":            "called from more than one rule",
+	}
+	if len(imported.CustomFunctions) != len(wantReasons) {
+		t.Errorf("got %d custom functions, want %d: %+v", len(imported.CustomFunctions), len(wantReasons), imported.CustomFunctions)
+	}
+	for _, cf := range imported.CustomFunctions {
+		want, ok := wantReasons[cf.Name]
+		if !ok {
+			t.Errorf("unexpected custom function %q", cf.Name)
+			continue
+		}
+		if cf.Reason != want {
+			t.Errorf("%s: reason = %q, want %q", cf.Name, cf.Reason, want)
+		}
+		if body, _ := doc.NamedFunctions.Get(cf.Name); cf.Body != body {
+			t.Errorf("%s: body was not kept as is", cf.Name)
+		}
+	}
+	if report.ScoringConfigs != 1 {
+		t.Errorf("got %d scoring configs, want 1", report.ScoringConfigs)
+	}
+	if report.CustomRules != 4 {
+		t.Errorf("got %d custom rules, want 4", report.CustomRules)
+	}
+
+	// Every function and rule of the input still comes out of Compile.
+	out := Compile(imported)
+	for _, fn := range doc.NamedFunctions {
+		if body, ok := out.NamedFunctions.Get(fn.Name); !ok || body != fn.Body {
+			t.Errorf("function %q did not survive Compile(Import(x))", fn.Name)
+		}
+	}
+	if len(out.CalculationRules) != len(doc.CalculationRules) {
+		t.Errorf("got %d calculation rules, want %d", len(out.CalculationRules), len(doc.CalculationRules))
+	}
+}
+
+func TestDecompileScoringFunctionRejectsOtherBodies(t *testing.T) {
+	tests := []struct {
+		name, body, reason string
+	}{
+		{"empty", "", "does not start with 'var rowUpdates = {};'"},
+		{"no guard", "var rowUpdates = {};\nreturn { type: 'setValues', row: rowUpdates };", "has no reference scope guard"},
+		{"no rules", "var rowUpdates = {};\nif (!committedItemIsNegativeReference) {\nreturn { type: 'setValues', row: rowUpdates };\n}\nreturn { type: 'setValues', row: rowUpdates };", "has no scoring rules"},
+		{"loose condition", "var rowUpdates = {};\nif (!committedItemIsNegativeReference) {\nreturn { type: 'setValues', row: rowUpdates };\n}\nif (row.W > 1) {\nrowUpdates = {\n'S': 1\n};\n}\nreturn { type: 'setValues', row: rowUpdates };", "rule 1 has a condition the builder does not generate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, reason := DecompileScoringFunction("W", tt.body); reason != tt.reason {
+				t.Errorf("reason = %q, want %q", reason, tt.reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package protocol
+
+// FormatVersion is the shape of a protocol document this package writes.
+// Documents saved before format_version existed count as version 0.
+const FormatVersion = 1
+
+// migrations[i] upgrades a document from format i to i+1. Append to the
+// end and bump FormatVersion; never change an entry once released.
+var migrations = []func(doc *Document){
+	backfillColumnHints, // 0 -> 1
+}
+
+// Migrate upgrades doc in place to FormatVersion, running each step from
+// its format_version on, and reports whether anything ran. Documents from
+// a newer server are left as they are; a negative format_version (which
+// the schema rejects) is treated as 0.
+func Migrate(doc *Document) bool {
+	if doc.FormatVersion >= FormatVersion {
+		return false
+	}
+	for v := max(doc.FormatVersion, 0); v < FormatVersion; v++ {
+		migrations[v](doc)
+	}
+	doc.FormatVersion = FormatVersion
+	return true
+}
+
+// backfillColumnHints gives old saves the allowInt / allowStr / range /
+// options / tab hints the builder now always writes, derived from
+// possibleValues the way applyProtocolToUI used to guess them.
+func backfillColumnHints(doc *Document) {
+	for i := range doc.Columns {
+		c := &doc.Columns[i]
+
+		if c.AllowInt == nil || c.AllowStr == nil {
+			a := c.Allowed()
+			if c.AllowInt == nil {
+				c.AllowInt = &a.Int
+			}
+			if c.AllowStr == nil {
+				c.AllowStr = &a.Str
+			}
+			c.IntMin = a.IntMin
+			c.IntMax = a.IntMax
+			c.StrOptions = a.StrOptions
+		}
+
+		if c.TabBehavior == "" {
+			c.TabBehavior = TabNextColumn
+		}
+	}
+}
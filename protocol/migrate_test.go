@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+const unversionedDoc = `{
+  "columns": [
+    {"id": "W", "name": "Wheal", "possibleValues": [{"type": "integer", "min": 0, "max": 20}]},
+    {"id": "R", "name": "Result", "possibleValues": [{"type": "string", "options": ["Pos", "Neg"]}]}
+  ],
+  "namedFunctions": {},
+  "calculationRules": []
+}`
+
+func TestMigrateBackfillsColumnHints(t *testing.T) {
+	doc, err := Parse([]byte(unversionedDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.FormatVersion != FormatVersion {
+		t.Errorf("format_version = %d, want %d", doc.FormatVersion, FormatVersion)
+	}
+
+	w, r := doc.Columns[0], doc.Columns[1]
+	if w.AllowInt == nil || !*w.AllowInt || w.AllowStr == nil || *w.AllowStr {
+		t.Errorf("W: allowInt/allowStr = %v/%v, want true/false", w.AllowInt, w.AllowStr)
+	}
+	if w.IntMin == nil || *w.IntMin != 0 || w.IntMax == nil || *w.IntMax != 20 {
+		t.Errorf("W: range = %v-%v, want 0-20", w.IntMin, w.IntMax)
+	}
+	if r.AllowStr == nil || !*r.AllowStr || !reflect.DeepEqual(r.StrOptions, []string{"Pos", "Neg"}) {
+		t.Errorf("R: allowStr = %v, options = %v", r.AllowStr, r.StrOptions)
+	}
+	for _, c := range doc.Columns {
+		if c.TabBehavior != TabNextColumn {
+			t.Errorf("%s: tabBehavior = %q, want %q", c.ID, c.TabBehavior, TabNextColumn)
+		}
+	}
+}
+
+func TestMigrateLeavesCurrentAndNewerAlone(t *testing.T) {
+	for _, v := range []int{FormatVersion, FormatVersion + 1} {
+		doc := &Document{FormatVersion: v, Columns: []Column{{ID: "W"}}}
+		if Migrate(doc) {
+			t.Errorf("format %d: Migrate reported a change", v)
+		}
+		if doc.FormatVersion != v || doc.Columns[0].TabBehavior != "" {
+			t.Errorf("format %d: document was modified: %+v", v, doc)
+		}
+	}
+}
+
+func TestMigrateNegativeFormatVersion(t *testing.T) {
+	doc := &Document{FormatVersion: -1, Columns: []Column{{ID: "W"}}}
+	if !Migrate(doc) {
+		t.Fatal("Migrate did not upgrade a negative format_version")
+	}
+	if doc.FormatVersion != FormatVersion || doc.Columns[0].TabBehavior != TabNextColumn {
+		t.Errorf("not upgraded like format 0: %+v", doc)
+	}
+
+	if _, err := Parse([]byte(`{"format_version": -5, "columns": [], "namedFunctions": {}, "calculationRules": []}`)); err != nil {
+		t.Errorf("Parse: %v", err)
+	}
+}
+
+func TestCheckSchemaRejectsNegativeFormatVersion(t *testing.T) {
+	raw := `{"format_version": -1, "columns": [{"id": "W", "name": "Wheal"}], "namedFunctions": {}, "calculationRules": []}`
+	want := []Problem{{Path: "format_version", Message: "must be at least 0"}}
+	if got := CheckSchema([]byte(raw)); !reflect.DeepEqual(got, want) {
+		t.Errorf("CheckSchema = %+v, want %+v", got, want)
+	}
+
+	raw = `{"format_version": 0, "columns": [{"id": "W", "name": "Wheal"}], "namedFunctions": {}, "calculationRules": []}`
+	if got := CheckSchema([]byte(raw)); got != nil {
+		t.Errorf("format_version 0 rejected: %+v", got)
+	}
+}
@@ -0,0 +1,406 @@
+// Package protocol is the server-side model of a LogicGrid protocol: the
+// columns, calculation rules and named functions that Xtract consumes, plus
+// the scoringConfigs the builder keeps alongside them.
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+/* ======================================================
+   Document
+   ====================================================== */
+
+// Document is the full protocol as the builder saves it (generateJson in
+// builder.js). Field order matches the JS object so re-encoding a parsed
+// document produces the same key order the browser does.
+type Document struct {
+	ProtocolID       int64             `json:"protocol_id"`
+	VersionNumber    int               `json:"version_number"`
+	FormatVersion    int               `json:"format_version,omitempty"` // see Migrate
+	Columns          []Column          `json:"columns"`
+	NamedFunctions   NamedFunctions    `json:"namedFunctions"`
+	CalculationRules []CalculationRule `json:"calculationRules"`
+
+	// UI-only meta: kept in the DB, stripped from the exported JSON.
+	ScoringConfigs []ScoringConfig `json:"scoringConfigs,omitempty"`
+
+	// Hand-written code Import could not turn into builder settings. It is
+	// carried through Compile unchanged, so it still reaches namedFunctions
+	// and calculationRules; these lists only remember what it was.
+	CustomFunctions []CustomFunction  `json:"customFunctions,omitempty"`
+	CustomRules     []CalculationRule `json:"customRules,omitempty"`
+}
+
+// CustomFunction is a named function kept as opaque code, with the reason
+// it could not be read back as a scoring config.
+type CustomFunction struct {
+	Name   string `json:"name"`
+	Body   string `json:"body"`
+	Reason string `json:"reason"`
+}
+
+// Column is one grid column.
+type Column struct {
+	ID              string          `json:"id"`
+	Name            string          `json:"name"`
+	Abbr            string          `json:"abbr"`
+	BackgroundColor string          `json:"backgroundColor"`
+	PossibleValues  []PossibleValue `json:"possibleValues"`
+
+	// Extra hints so the builder can rebuild its cards. Pointers because
+	// old saves may not have them at all.
+	AllowInt    *bool    `json:"allowInt,omitempty"`
+	AllowStr    *bool    `json:"allowStr,omitempty"`
+	IntMin      *int     `json:"intMin,omitempty"`
+	IntMax      *int     `json:"intMax,omitempty"`
+	StrOptions  []string `json:"strOptions,omitempty"`
+	TabBehavior string   `json:"tabBehavior,omitempty"`
+
+	ShowWhenPrescribing   bool            `json:"showWhenPrescribing,omitempty"`
+	AutoFill              *AutoFill       `json:"autoFill,omitempty"`
+	UseAsStartingDilution bool            `json:"useAsStartingDilution,omitempty"`
+	PositiveValues        []PossibleValue `json:"positiveValues,omitempty"`
+}
+
+// Value types used in possibleValues / positiveValues.
+const (
+	ValueTypeInteger = "integer"
+	ValueTypeString  = "string"
+)
+
+// PossibleValue is one entry of possibleValues or positiveValues: either an
+// integer range or a list of string options.
+type PossibleValue struct {
+	Type    string   `json:"type"`
+	Min     *int     `json:"min,omitempty"`
+	Max     *int     `json:"max,omitempty"`
+	Options []string `json:"options,omitempty"`
+}
+
+// AutoFill is the per-column autofill setting.
+type AutoFill struct {
+	Value              Value `json:"value"`
+	Overwrite          bool  `json:"overwrite"`
+	SetNegativeControl bool  `json:"setNegativeControl"`
+	SetPositiveControl bool  `json:"setPositiveControl"`
+}
+
+// Tab behaviours (column.tabBehavior).
+const (
+	TabNextColumn        = "nextColumn"
+	TabNextRow           = "nextRow"
+	TabNextRowPrevColumn = "nextRowPrevColumn"
+)
+
+/* ======================================================
+   Calculation rules
+   ====================================================== */
+
+// Condition and result types understood by the grid.
+const (
+	ConditionChange = "change"
+
+	ResultSetFocus  = "setFocus"
+	ResultRunCode   = "runCode"
+	ResultSetValue  = "setValue"
+	ResultSetValues = "setValues"
+)
+
+// CalculationRule fires its results when all of its conditions match.
+type CalculationRule struct {
+	Conditions []Condition `json:"conditions"`
+	Results    []Result    `json:"results"`
+}
+
+// Condition of a calculation rule. Only "change" is generated today.
+type Condition struct {
+	Type      string   `json:"type"`
+	ColumnIDs []string `json:"columnIds"`
+}
+
+// Result of a calculation rule: a focus move or a call into namedFunctions.
+type Result struct {
+	Type            string `json:"type"`
+	RelativeRows    int    `json:"relativeRows,omitempty"`
+	RelativeColumns int    `json:"relativeColumns,omitempty"`
+	FunctionName    string `json:"functionName,omitempty"`
+}
+
+/* ======================================================
+   Scoring configs (builder UI meta)
+   ====================================================== */
+
+// Scoring scopes: which rows a scoring config applies to.
+const (
+	ScopeNeither  = "neither"
+	ScopePositive = "positive"
+	ScopeNegative = "negative"
+)
+
+// Comparison bases for a numeric threshold.
+const (
+	BaseZero     = "zero"
+	BaseNegative = "negative"
+	BasePositive = "positive"
+)
+
+// OpAlways marks an unconditional scoring condition.
+const OpAlways = "always"
+
+// ScoringConfig is one "Scoring Rules for Trigger" card.
+type ScoringConfig struct {
+	TriggerColumn   string        `json:"triggerColumn"`
+	Scope           string        `json:"scope"`
+	RequireNegative bool          `json:"requireNegative"`
+	RequirePositive bool          `json:"requirePositive"`
+	Rules           []ScoringRule `json:"rules"`
+}
+
+// ScoringRule is one IF / ELSE IF branch: ANDed conditions and the updates
+// applied when they hold.
+type ScoringRule struct {
+	Conditions []ScoringCondition `json:"conditions"`
+	Updates    []ScoringUpdate    `json:"updates"`
+}
+
+// ScoringCondition compares a column to a threshold, optionally offset by
+// the negative or positive reference row.
+type ScoringCondition struct {
+	Col    string `json:"col"`
+	Op     string `json:"op"`
+	Thresh string `json:"thresh"`
+	Base   string `json:"base"`
+}
+
+// ScoringUpdate sets Col to Val on the committed row.
+type ScoringUpdate struct {
+	Col string `json:"col"`
+	Val string `json:"val"`
+}
+
+/* ======================================================
+   Named functions (ordered)
+   ====================================================== */
+
+// NamedFunction is one entry of namedFunctions.
+type NamedFunction struct {
+	Name string
+	Body string
+}
+
+// NamedFunctions keeps namedFunctions in insertion order, the way a JS
+// object does, so autoFill stays first and generated functions follow in
+// scoring-card order.
+type NamedFunctions []NamedFunction
+
+// Get returns the body of the named function.
+func (nf NamedFunctions) Get(name string) (string, bool) {
+	for _, f := range nf {
+		if f.Name == name {
+			return f.Body, true
+		}
+	}
+	return "", false
+}
+
+// Set replaces the body of an existing function in place, or appends it.
+func (nf *NamedFunctions) Set(name, body string) {
+	for i := range *nf {
+		if (*nf)[i].Name == name {
+			(*nf)[i].Body = body
+			return
+		}
+	}
+	*nf = append(*nf, NamedFunction{Name: name, Body: body})
+}
+
+func (nf NamedFunctions) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range nf {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := writeJSONString(&buf, f.Name); err != nil {
+			return nil, err
+		}
+		buf.WriteByte(':')
+		if err := writeJSONString(&buf, f.Body); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (nf *NamedFunctions) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*nf = nil
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return fmt.Errorf("namedFunctions must be an object")
+	}
+
+	out := NamedFunctions{}
+	for dec.More() {
+		keyTok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var body string
+		if err := dec.Decode(&body); err != nil {
+			return fmt.Errorf("namedFunctions.%v: %w", keyTok, err)
+		}
+		out.Set(keyTok.(string), body)
+	}
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+
+	*nf = out
+	return nil
+}
+
+/* ======================================================
+   Cell values
+   ====================================================== */
+
+type valueKind int
+
+const (
+	kindNull valueKind = iota
+	kindNumber
+	kindString
+)
+
+// Value is a grid cell value: null, a number or a string. autoFill values,
+// reference rows and setValue results all use it.
+type Value struct {
+	kind valueKind
+	num  float64
+	str  string
+}
+
+// Null returns the null value.
+func Null() Value { return Value{} }
+
+// Number returns a numeric value.
+func Number(f float64) Value { return Value{kind: kindNumber, num: f} }
+
+// String returns a string value.
+func String(s string) Value { return Value{kind: kindString, str: s} }
+
+func (v Value) IsNull() bool   { return v.kind == kindNull }
+func (v Value) IsNumber() bool { return v.kind == kindNumber }
+func (v Value) IsString() bool { return v.kind == kindString }
+
+// Num returns the numeric value (0 unless IsNumber).
+func (v Value) Num() float64 { return v.num }
+
+// Str returns the string value ("" unless IsString).
+func (v Value) Str() string { return v.str }
+
+// String formats the value the way JS String(value) would.
+func (v Value) String() string {
+	switch v.kind {
+	case kindNumber:
+		return strconv.FormatFloat(v.num, 'f', -1, 64)
+	case kindString:
+		return v.str
+	default:
+		return "null"
+	}
+}
+
+func (v Value) MarshalJSON() ([]byte, error) {
+	switch v.kind {
+	case kindNumber:
+		return []byte(strconv.FormatFloat(v.num, 'f', -1, 64)), nil
+	case kindString:
+		var buf bytes.Buffer
+		if err := writeJSONString(&buf, v.str); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return []byte("null"), nil
+	}
+}
+
+func (v *Value) UnmarshalJSON(data []byte) error {
+	var raw any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	switch t := raw.(type) {
+	case nil:
+		*v = Null()
+	case float64:
+		*v = Number(t)
+	case string:
+		*v = String(t)
+	default:
+		return fmt.Errorf("value must be a number, string or null")
+	}
+	return nil
+}
+
+/* ======================================================
+   Parse / Marshal
+   ====================================================== */
+
+// Parse decodes a stored or submitted protocol document and migrates it to
+// the current FormatVersion, so callers never see an old shape.
+func Parse(data []byte) (*Document, error) {
+	var doc Document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	Migrate(&doc)
+	return &doc, nil
+}
+
+// Marshal encodes a document without HTML escaping, so function bodies keep
+// their literal && and < like JSON.stringify produces.
+func Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// MarshalIndent is Marshal with JSON.stringify(v, null, 2) formatting.
+func MarshalIndent(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) error {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(s); err != nil {
+		return err
+	}
+	buf.Truncate(buf.Len() - 1) // drop Encode's trailing newline
+	return nil
+}
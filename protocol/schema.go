@@ -0,0 +1,503 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// SchemaID is where the server publishes the protocol schema.
+const SchemaID = "/api/schema/protocol.json"
+
+// JSONSchema is the subset of JSON Schema (draft 2020-12) the protocol
+// schema uses. CheckSchema understands exactly these keywords.
+type JSONSchema struct {
+	Schema               string        `json:"$schema,omitempty"`
+	ID                   string        `json:"$id,omitempty"`
+	Ref                  string        `json:"$ref,omitempty"`
+	Title                string        `json:"title,omitempty"`
+	Description          string        `json:"description,omitempty"`
+	Type                 schemaTypes   `json:"type,omitempty"`
+	Const                any           `json:"const,omitempty"`
+	Enum                 []any         `json:"enum,omitempty"`
+	MinLength            int           `json:"minLength,omitempty"`
+	MinItems             int           `json:"minItems,omitempty"`
+	Minimum              *float64      `json:"minimum,omitempty"`
+	Items                *JSONSchema   `json:"items,omitempty"`
+	Properties           schemaMembers `json:"properties,omitempty"`
+	Required             []string      `json:"required,omitempty"`
+	AdditionalProperties *JSONSchema   `json:"additionalProperties,omitempty"`
+	OneOf                []*JSONSchema `json:"oneOf,omitempty"`
+	Defs                 schemaMembers `json:"$defs,omitempty"`
+}
+
+// schemaTypes encodes as a single string when there is one type.
+type schemaTypes []string
+
+func (t schemaTypes) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+	return json.Marshal([]string(t))
+}
+
+// schemaMember is one entry of properties or $defs.
+type schemaMember struct {
+	Name   string
+	Schema *JSONSchema
+}
+
+// schemaMembers keeps properties in struct field order, so the published
+// schema reads in the same order as a saved protocol.
+type schemaMembers []schemaMember
+
+func (m schemaMembers) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, p := range m {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := writeJSONString(&buf, p.Name); err != nil {
+			return nil, err
+		}
+		buf.WriteByte(':')
+		b, err := Marshal(p.Schema)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (m schemaMembers) get(name string) *JSONSchema {
+	for _, p := range m {
+		if p.Name == name {
+			return p.Schema
+		}
+	}
+	return nil
+}
+
+/* ======================================================
+   Generation
+   ====================================================== */
+
+// schemaType holds what the Go types can't say about a definition.
+type schemaType struct {
+	description string
+	required    []string
+	enums       map[string][]any // field -> allowed values
+	minItems    map[string]int
+	minimum     map[string]float64
+	variants    func(def *JSONSchema) []*JSONSchema
+}
+
+var scoringOps = []any{OpAlways, ">", ">=", "<", "<=", "==", "!="}
+
+var schemaTypeInfo = map[string]schemaType{
+	"Document": {
+		description: "A LogicGrid protocol as the builder saves it. Xtract reads columns, namedFunctions and calculationRules; the other fields are builder metadata.",
+		required:    []string{"columns", "namedFunctions", "calculationRules"},
+		minItems:    map[string]int{"columns": 1},
+		minimum:     map[string]float64{"format_version": 0},
+	},
+	"Column": {
+		description: "One grid column.",
+		required:    []string{"id", "name"},
+		enums:       map[string][]any{"tabBehavior": {"", TabNextColumn, TabNextRow, TabNextRowPrevColumn}},
+	},
+	"PossibleValue": {
+		description: "An integer range or a list of string options a column accepts.",
+		required:    []string{"type"},
+		enums:       map[string][]any{"type": {ValueTypeInteger, ValueTypeString}},
+		variants: func(def *JSONSchema) []*JSONSchema {
+			return []*JSONSchema{
+				variant(def, ValueTypeInteger, nil, "min", "max"),
+				variant(def, ValueTypeString, []string{"options"}, "options"),
+			}
+		},
+		minItems: map[string]int{"options": 1},
+	},
+	"AutoFill": {
+		description: "Value written into an empty cell of the column.",
+		required:    []string{"value"},
+	},
+	"CalculationRule": {
+		description: "Fires its results when all of its conditions match.",
+		required:    []string{"conditions", "results"},
+		minItems:    map[string]int{"conditions": 1, "results": 1},
+	},
+	"Condition": {
+		description: "A calculation rule condition.",
+		required:    []string{"type", "columnIds"},
+		enums:       map[string][]any{"type": {ConditionChange}},
+		minItems:    map[string]int{"columnIds": 1},
+	},
+	"Result": {
+		description: "A calculation rule result: a focus move or a call into namedFunctions.",
+		required:    []string{"type"},
+		enums:       map[string][]any{"type": {ResultSetFocus, ResultRunCode}},
+		variants: func(def *JSONSchema) []*JSONSchema {
+			return []*JSONSchema{
+				variant(def, ResultSetFocus, nil, "relativeRows", "relativeColumns"),
+				variant(def, ResultRunCode, []string{"functionName"}, "functionName"),
+			}
+		},
+	},
+	"ScoringConfig": {
+		description: "One builder scoring card: the rules run when the trigger column changes.",
+		required:    []string{"triggerColumn", "scope", "rules"},
+		enums:       map[string][]any{"scope": {ScopeNeither, ScopePositive, ScopeNegative}},
+		minItems:    map[string]int{"rules": 1},
+	},
+	"ScoringRule": {
+		description: "One IF / ELSE IF branch of a scoring card.",
+		required:    []string{"conditions", "updates"},
+		minItems:    map[string]int{"updates": 1},
+	},
+	"ScoringCondition": {
+		description: "Compares a column to a threshold, optionally offset by a reference row.",
+		required:    []string{"op"},
+		enums: map[string][]any{
+			"op":   scoringOps,
+			"base": {"", BaseZero, BaseNegative, BasePositive},
+		},
+	},
+	"ScoringUpdate": {
+		description: "Sets a column on the committed row.",
+		required:    []string{"col", "val"},
+	},
+	"CustomFunction": {
+		description: "Hand-written function kept from an import.",
+		required:    []string{"name", "body"},
+	},
+}
+
+// variant is def narrowed to one value of its "type" discriminator, keeping
+// only the listed fields besides type.
+func variant(def *JSONSchema, typ string, required []string, fields ...string) *JSONSchema {
+	v := &JSONSchema{
+		Type:       schemaTypes{"object"},
+		Properties: schemaMembers{{Name: "type", Schema: &JSONSchema{Const: typ}}},
+		Required:   append([]string{"type"}, required...),
+	}
+	for _, f := range fields {
+		v.Properties = append(v.Properties, schemaMember{Name: f, Schema: def.Properties.get(f)})
+	}
+	return v
+}
+
+var (
+	namedFunctionsType = reflect.TypeOf(NamedFunctions{})
+	valueType          = reflect.TypeOf(Value{})
+)
+
+// Schema generates the JSON Schema of a protocol document from the Go
+// types Parse decodes into, so the two can't drift apart.
+func Schema() *JSONSchema {
+	g := &schemaGenerator{defs: map[string]*JSONSchema{}}
+	root := g.define(reflect.TypeOf(Document{}))
+
+	doc := *g.defs[root]
+	doc.Schema = "https://json-schema.org/draft/2020-12/schema"
+	doc.ID = SchemaID
+	doc.Title = "LogicGrid protocol"
+
+	names := make([]string, 0, len(g.defs))
+	for name := range g.defs {
+		if name != root {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		doc.Defs = append(doc.Defs, schemaMember{Name: name, Schema: g.defs[name]})
+	}
+	return &doc
+}
+
+// SchemaJSON is the published form of Schema.
+func SchemaJSON() ([]byte, error) {
+	return MarshalIndent(Schema())
+}
+
+type schemaGenerator struct {
+	defs map[string]*JSONSchema
+}
+
+func (g *schemaGenerator) define(t reflect.Type) string {
+	name := t.Name()
+	if _, done := g.defs[name]; done {
+		return name
+	}
+	info := schemaTypeInfo[name]
+
+	def := &JSONSchema{Type: schemaTypes{"object"}, Description: info.description, Required: info.required}
+	g.defs[name] = def
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		field, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if field == "" || field == "-" {
+			continue
+		}
+		prop := g.schemaFor(f.Type)
+		if enum, ok := info.enums[field]; ok {
+			prop = &JSONSchema{Type: prop.Type, Enum: enum}
+		}
+		if n, ok := info.minItems[field]; ok {
+			withMin := *prop
+			withMin.MinItems = n
+			prop = &withMin
+		}
+		if n, ok := info.minimum[field]; ok {
+			withMin := *prop
+			withMin.Minimum = &n
+			prop = &withMin
+		}
+		def.Properties = append(def.Properties, schemaMember{Name: field, Schema: prop})
+	}
+
+	if info.variants != nil {
+		def.OneOf = info.variants(def)
+	}
+	return name
+}
+
+func (g *schemaGenerator) schemaFor(t reflect.Type) *JSONSchema {
+	switch t {
+	case namedFunctionsType:
+		return &JSONSchema{
+			Type:                 schemaTypes{"object"},
+			Description:          "Function bodies by name, in the order Xtract should define them.",
+			AdditionalProperties: &JSONSchema{Type: schemaTypes{"string"}},
+		}
+	case valueType:
+		return &JSONSchema{Type: schemaTypes{"number", "string", "null"}}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := *g.schemaFor(t.Elem())
+		if s.Ref != "" {
+			return &JSONSchema{OneOf: []*JSONSchema{&s, {Type: schemaTypes{"null"}}}}
+		}
+		s.Type = append(append(schemaTypes{}, s.Type...), "null")
+		return &s
+	case reflect.Slice:
+		return &JSONSchema{Type: schemaTypes{"array"}, Items: g.schemaFor(t.Elem())}
+	case reflect.Struct:
+		return &JSONSchema{Ref: "#/$defs/" + g.define(t)}
+	case reflect.String:
+		return &JSONSchema{Type: schemaTypes{"string"}}
+	case reflect.Bool:
+		return &JSONSchema{Type: schemaTypes{"boolean"}}
+	case reflect.Int, reflect.Int64:
+		return &JSONSchema{Type: schemaTypes{"integer"}}
+	case reflect.Float64:
+		return &JSONSchema{Type: schemaTypes{"number"}}
+	}
+	panic("protocol: no schema for " + t.String())
+}
+
+/* ======================================================
+   Checking
+   ====================================================== */
+
+var protocolSchema = Schema()
+
+// CheckSchema checks raw protocol JSON against Schema and returns one
+// problem per violation, using the same paths as Validate. It returns nil
+// when the document conforms.
+func CheckSchema(raw []byte) []Problem {
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return []Problem{{Path: "data", Message: err.Error()}}
+	}
+
+	c := &schemaChecker{root: protocolSchema}
+	c.check("", protocolSchema, v)
+	return c.problems
+}
+
+type schemaChecker struct {
+	root     *JSONSchema
+	problems []Problem
+}
+
+func (c *schemaChecker) addf(path, format string, args ...any) {
+	if path == "" {
+		path = "data"
+	}
+	c.problems = append(c.problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (c *schemaChecker) check(path string, s *JSONSchema, v any) {
+	if s.Ref != "" {
+		c.check(path, c.root.Defs.get(strings.TrimPrefix(s.Ref, "#/$defs/")), v)
+		return
+	}
+
+	before := len(c.problems)
+	if len(s.Type) > 0 && !containsString(s.Type, jsonType(v)) &&
+		!(jsonType(v) == "integer" && containsString(s.Type, "number")) {
+		c.addf(path, "expected %s, got %s", strings.Join(s.Type, " or "), describeJSONType(v))
+		return
+	}
+	if s.Const != nil && !jsonEqual(v, s.Const) {
+		c.addf(path, "must be '%v'", s.Const)
+		return
+	}
+	if len(s.Enum) > 0 && !enumContains(s.Enum, v) {
+		c.addf(path, "'%v' is not one of: %s", v, joinEnum(s.Enum))
+		return
+	}
+
+	switch t := v.(type) {
+	case json.Number:
+		if f, err := t.Float64(); err == nil && s.Minimum != nil && f < *s.Minimum {
+			c.addf(path, "must be at least %v", *s.Minimum)
+		}
+	case string:
+		if len(t) < s.MinLength {
+			c.addf(path, "must not be empty")
+		}
+	case []any:
+		if len(t) < s.MinItems {
+			c.addf(path, "needs at least %d item(s)", s.MinItems)
+		}
+		if s.Items != nil {
+			for i, item := range t {
+				c.check(fmt.Sprintf("%s[%d]", path, i), s.Items, item)
+			}
+		}
+	case map[string]any:
+		c.checkObject(path, s, t)
+	}
+
+	// Variants only narrow what already matched; don't report twice.
+	if len(s.OneOf) > 0 && len(c.problems) == before {
+		c.checkOneOf(path, s.OneOf, v)
+	}
+}
+
+func (c *schemaChecker) checkObject(path string, s *JSONSchema, obj map[string]any) {
+	for _, name := range s.Required {
+		if _, ok := obj[name]; !ok {
+			c.addf(joinPath(path, name), "is required")
+		}
+	}
+	for _, p := range s.Properties {
+		if val, ok := obj[p.Name]; ok {
+			c.check(joinPath(path, p.Name), p.Schema, val)
+		}
+	}
+	if s.AdditionalProperties != nil {
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			if s.Properties.get(k) == nil {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			c.check(joinPath(path, k), s.AdditionalProperties, obj[k])
+		}
+	}
+}
+
+// checkOneOf reports the problems of the variant picked by the object's
+// "type", or of the closest variant, when none match.
+func (c *schemaChecker) checkOneOf(path string, variants []*JSONSchema, v any) {
+	var best []Problem
+	for i, alt := range variants {
+		sub := &schemaChecker{root: c.root}
+		sub.check(path, alt, v)
+		if len(sub.problems) == 0 {
+			return
+		}
+		if i == 0 || len(sub.problems) < len(best) || discriminates(alt, v) {
+			best = sub.problems
+		}
+		if discriminates(alt, v) {
+			break
+		}
+	}
+	c.problems = append(c.problems, best...)
+}
+
+// discriminates reports whether v's "type" is the one alt is for.
+func discriminates(alt *JSONSchema, v any) bool {
+	obj, ok := v.(map[string]any)
+	typ := alt.Properties.get("type")
+	return ok && typ != nil && typ.Const != nil && jsonEqual(obj["type"], typ.Const)
+}
+
+func joinPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// jsonType is the JSON Schema type of a decoded value; whole numbers are
+// "integer".
+func jsonType(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if f, err := t.Float64(); err == nil && f == math.Trunc(f) && !strings.ContainsAny(t.String(), ".eE") {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func describeJSONType(v any) string {
+	if t := jsonType(v); t != "integer" {
+		return t
+	}
+	return "number"
+}
+
+func jsonEqual(v, want any) bool {
+	if n, ok := v.(json.Number); ok {
+		return n.String() == fmt.Sprint(want)
+	}
+	return v == want
+}
+
+func enumContains(enum []any, v any) bool {
+	for _, e := range enum {
+		if jsonEqual(v, e) {
+			return true
+		}
+	}
+	return false
+}
+
+func joinEnum(enum []any) string {
+	parts := make([]string, len(enum))
+	for i, e := range enum {
+		parts[i] = fmt.Sprintf("'%v'", e)
+	}
+	return strings.Join(parts, ", ")
+}
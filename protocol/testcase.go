@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+)
+
+// TestCase is a named scenario stored with a protocol: a starting grid, the
+// edits to make, and the cell values expected afterwards.
+type TestCase struct {
+	Name     string        `json:"name"`
+	Grid     Grid          `json:"grid"`
+	Edits    []Edit        `json:"edits"`
+	Expected []ExpectedRow `json:"expected"`
+}
+
+// ExpectedRow lists the cells to check on one row. Columns not listed are
+// not checked.
+type ExpectedRow struct {
+	Row    int `json:"row"`
+	Values Row `json:"values"`
+}
+
+// TestResult is the outcome of running one TestCase.
+type TestResult struct {
+	Name     string   `json:"name"`
+	Passed   bool     `json:"passed"`
+	Failures []string `json:"failures,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// RunTestCase simulates tc against doc and compares the final rows.
+func RunTestCase(doc *Document, tc TestCase) TestResult {
+	res := TestResult{Name: tc.Name}
+
+	sim, err := Simulate(doc, tc.Grid, tc.Edits)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	for _, exp := range tc.Expected {
+		if exp.Row < 0 || exp.Row >= len(sim.Rows) {
+			res.Failures = append(res.Failures, fmt.Sprintf("row %d is outside the grid", exp.Row))
+			continue
+		}
+
+		cols := make([]string, 0, len(exp.Values))
+		for col := range exp.Values {
+			cols = append(cols, col)
+		}
+		sort.Strings(cols)
+
+		got := sim.Rows[exp.Row]
+		for _, col := range cols {
+			want := exp.Values[col]
+			if !strictEquals(got[col], want) {
+				res.Failures = append(res.Failures, fmt.Sprintf("row %d, column '%s': expected %s, got %s",
+					exp.Row, col, describeValue(want), describeValue(got[col])))
+			}
+		}
+	}
+
+	res.Passed = len(res.Failures) == 0
+	return res
+}
+
+func describeValue(v Value) string {
+	if v.IsString() {
+		return "'" + v.str + "'"
+	}
+	return v.String()
+}
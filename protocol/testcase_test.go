@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRunTestCase(t *testing.T) {
+	doc, _ := loadSaved(t, "chains")
+	doc = Compile(doc)
+
+	scoreWheal := func(expected ...ExpectedRow) TestCase {
+		return TestCase{
+			Name:     "severe wheal",
+			Grid:     chainsGrid(Number(1)),
+			Edits:    []Edit{{Row: 1, Column: "Wheal", Value: Number(8)}},
+			Expected: expected,
+		}
+	}
+
+	tests := []struct {
+		name string
+		tc   TestCase
+		want TestResult
+	}{
+		{
+			name: "pass",
+			tc:   scoreWheal(ExpectedRow{Row: 1, Values: Row{"Class": String("Severe"), "Note": String("check")}}),
+			want: TestResult{Name: "severe wheal", Passed: true},
+		},
+		{
+			name: "mismatched value",
+			tc:   scoreWheal(ExpectedRow{Row: 1, Values: Row{"Class": String("Mild"), "Flare": String("10"), "Note": String("check")}}),
+			want: TestResult{Name: "severe wheal", Failures: []string{
+				"row 1, column 'Class': expected 'Mild', got 'Severe'",
+				"row 1, column 'Flare': expected '10', got 10",
+			}},
+		},
+		{
+			name: "expected row outside the grid",
+			tc:   scoreWheal(ExpectedRow{Row: 5, Values: Row{"Class": String("Severe")}}),
+			want: TestResult{Name: "severe wheal", Failures: []string{"row 5 is outside the grid"}},
+		},
+		{
+			name: "simulation error",
+			tc: TestCase{
+				Name:  "bad edit",
+				Grid:  chainsGrid(Null()),
+				Edits: []Edit{{Row: 0, Column: "Nope", Value: Number(1)}},
+			},
+			want: TestResult{Name: "bad edit", Error: "edits[0]: unknown column 'Nope'"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RunTestCase(doc, tt.tc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+// gen.js regenerates the compile golden files from the browser code itself:
+// it lifts generateJson (static/builder.js) and stripUiMeta
+// (static/protocols.js) into a sandbox, fills stub builder cards from
+// cases.json, and writes what generateJson returns and what it puts in the
+// output textarea.
+//
+//   node protocol/testdata/compile/gen.js
+//
+// Rerun it whenever builder.js changes how it generates code; compile_test.go
+// then checks the Go compiler still matches byte for byte.
+"use strict";
+
+const fs = require("fs");
+const path = require("path");
+const vm = require("vm");
+
+const here = __dirname;
+const staticDir = path.join(here, "..", "..", "..", "static");
+
+// extract returns the source of one top-level declaration, from its first
+// line up to the matching closing brace or semicolon.
+function extract(src, header) {
+  const start = src.indexOf(header);
+  if (start < 0) throw new Error("not found: " + header);
+  if (header.startsWith("const ")) {
+    return src.slice(start, src.indexOf(";", start) + 1);
+  }
+  let depth = 0;
+  for (let i = src.indexOf("{", start); i < src.length; i++) {
+    if (src[i] === "{") depth++;
+    if (src[i] === "}" && --depth === 0) return src.slice(start, i + 1);
+  }
+  throw new Error("unbalanced: " + header);
+}
+
+const builder = fs.readFileSync(path.join(staticDir, "builder.js"), "utf8");
+const protocols = fs.readFileSync(path.join(staticDir, "protocols.js"), "utf8");
+const code = [
+  extract(builder, "const PROTOCOL_FORMAT_VERSION"),
+  extract(builder, "const AUTO_FILL_FUNCTION"),
+  extract(builder, "function sanitizeForFunctionName("),
+  extract(builder, "function generateJson("),
+  extract(protocols, "function stripUiMeta("),
+  "result = generateJson();",
+].join("\n\n");
+
+// Stub DOM: an element answers querySelector with a {value, checked} field
+// and querySelectorAll with a list of child elements.
+function el(fields, lists) {
+  return {
+    querySelector: (sel) => (sel in fields ? fields[sel] : null),
+    querySelectorAll: (sel) => (lists && lists[sel]) || [],
+  };
+}
+const value = (v) => ({ value: v == null ? "" : String(v) });
+const checked = (c) => ({ checked: !!c });
+
+function columnCard(c) {
+  return el({
+    ".col-id": value(c.id),
+    ".col-name": value(c.name),
+    ".col-abbr": value(c.abbr),
+    ".col-bg": value(c.bg),
+    ".col-allowint": checked(c.allowInt),
+    ".col-allowstr": checked(c.allowStr),
+    ".col-intmax": value(c.intMax),
+    ".col-stropts": value(c.strOptions),
+    ".col-tab": value(c.tab || "nextColumn"),
+    ".col-use-start-dil": value(c.useStartDil ? "yes" : "no"),
+    ".col-show-when-prescribing": value(c.showWhen ? "yes" : "no"),
+    ".col-autofill-enabled": checked(c.autoFill),
+    ".col-autofill-value": value(c.autoFill ? c.autoFill.value : ""),
+    ".col-autofill-overwrite-mode": value(c.autoFill && c.autoFill.overwrite ? "yes" : "no"),
+    ".col-autofill-control-mode": value(c.autoFill ? c.autoFill.controls || "none" : "none"),
+    ".col-has-positive": checked(c.positive),
+    ".col-positive-intmin": value(c.positive ? c.positive.intMin : ""),
+    ".col-positive-stropts": value(c.positive ? c.positive.strOptions : ""),
+  });
+}
+
+function scoringCard(s) {
+  const rows = s.rules.map((r) =>
+    el({}, {
+      ".score-condition-row": r.conditions.map((c) =>
+        el({
+          ".score-cond-col": value(c.col),
+          ".score-op": value(c.op),
+          ".score-thresh": value(c.thresh),
+          ".score-thresh-base": value(c.base || "zero"),
+        })
+      ),
+      ".score-update-row": r.updates.map((u) =>
+        el({ ".score-update-col": value(u.col), ".score-update-val": value(u.val) })
+      ),
+    })
+  );
+  return el({
+    ".score-trigger-col": value(s.trigger),
+    ".score-scope": value(s.scope),
+    ".score-require-controls": value(s.controls || "none"),
+  }, { ".score-rule-row": rows });
+}
+
+const cases = JSON.parse(fs.readFileSync(path.join(here, "cases.json"), "utf8"));
+for (const [name, spec] of Object.entries(cases)) {
+  const output = { value: "" };
+  const sandbox = {
+    columnsContainer: el({}, { ".column-card": spec.columns.map(columnCard) }),
+    scoringContainer: el({}, { ".score-card": spec.scoring.map(scoringCard) }),
+    output,
+    customFunctions: [],
+    customRules: [],
+    alert: (msg) => { throw new Error(name + ": " + msg); },
+    result: null,
+  };
+  vm.runInNewContext(code, sandbox);
+
+  fs.writeFileSync(path.join(here, name + ".json"), JSON.stringify(sandbox.result, null, 2));
+  fs.writeFileSync(path.join(here, name + ".export.json"), output.value);
+  console.log("wrote", name);
+}
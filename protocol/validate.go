@@ -0,0 +1,409 @@
+package protocol
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Problem is one validation failure. Path points into the document using
+// JS-style accessors, e.g. "scoringConfigs[0].rules[1].updates[0].val".
+type Problem struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// ValidationError wraps the problems found by Validate.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0].Path + ": " + e.Problems[0].Message
+	}
+	return fmt.Sprintf("%d protocol problems (first: %s: %s)",
+		len(e.Problems), e.Problems[0].Path, e.Problems[0].Message)
+}
+
+var (
+	intPattern     = regexp.MustCompile(`^-?\d+$`)
+	numericPattern = regexp.MustCompile(`^-?\d+(\.\d+)?$`)
+)
+
+var validOps = map[string]bool{
+	OpAlways: true,
+	">":      true,
+	">=":     true,
+	"<":      true,
+	"<=":     true,
+	"==":     true,
+	"!=":     true,
+}
+
+// Allowed is the value policy of a column: which value types it accepts
+// and the integer range / string options. It mirrors the column metadata
+// generateJson builds for assertValidUpdate.
+type Allowed struct {
+	Int        bool
+	Str        bool
+	IntMin     *int
+	IntMax     *int
+	StrOptions []string
+}
+
+// Allowed returns the column's value policy, falling back to possibleValues
+// when the allowInt/allowStr hints are missing. Parsed documents always have
+// them (see Migrate); the fallback is what the migration back-fills from.
+func (c Column) Allowed() Allowed {
+	var ints, strs *PossibleValue
+	for i := range c.PossibleValues {
+		switch c.PossibleValues[i].Type {
+		case ValueTypeInteger:
+			if ints == nil {
+				ints = &c.PossibleValues[i]
+			}
+		case ValueTypeString:
+			if strs == nil {
+				strs = &c.PossibleValues[i]
+			}
+		}
+	}
+
+	a := Allowed{
+		IntMin:     c.IntMin,
+		IntMax:     c.IntMax,
+		StrOptions: c.StrOptions,
+	}
+	if c.AllowInt != nil {
+		a.Int = *c.AllowInt
+	} else {
+		a.Int = ints != nil
+	}
+	if c.AllowStr != nil {
+		a.Str = *c.AllowStr
+	} else {
+		a.Str = strs != nil
+	}
+	if c.AllowInt == nil || c.AllowStr == nil {
+		if a.IntMin == nil && ints != nil {
+			a.IntMin = ints.Min
+		}
+		if a.IntMax == nil && ints != nil {
+			a.IntMax = ints.Max
+		}
+		if a.StrOptions == nil && strs != nil {
+			a.StrOptions = strs.Options
+		}
+	}
+	return a
+}
+
+// CheckValue reports why raw is not a valid value for the column, or ""
+// when it is. Same rules and wording as assertValidUpdate in builder.js.
+func (a Allowed) CheckValue(colID, raw string) string {
+	trimmed := strings.TrimSpace(raw)
+
+	if intPattern.MatchString(trimmed) {
+		v, err := strconv.Atoi(trimmed)
+		if err != nil {
+			return fmt.Sprintf("Invalid update value '%s' for column '%s'. Value is out of range.", trimmed, colID)
+		}
+		if !a.Int {
+			return fmt.Sprintf("Invalid update value '%s' for column '%s'. Allowed strings are: %s.",
+				trimmed, colID, strings.Join(a.StrOptions, ", "))
+		}
+		if (a.IntMin != nil && v < *a.IntMin) || (a.IntMax != nil && v > *a.IntMax) {
+			var rangeText string
+			switch {
+			case a.IntMin != nil && a.IntMax != nil:
+				rangeText = fmt.Sprintf("%d–%d", *a.IntMin, *a.IntMax)
+			case a.IntMin != nil:
+				rangeText = fmt.Sprintf("%d+", *a.IntMin)
+			default:
+				rangeText = fmt.Sprintf("≤ %d", *a.IntMax)
+			}
+			return fmt.Sprintf("Invalid update value '%s' for column '%s'. Allowed integer range is %s.",
+				trimmed, colID, rangeText)
+		}
+		return ""
+	}
+
+	if !a.Str {
+		return fmt.Sprintf("Invalid update value '%s' for column '%s'. This column only allows numeric values.", trimmed, colID)
+	}
+	if len(a.StrOptions) > 0 && !containsString(a.StrOptions, trimmed) {
+		return fmt.Sprintf("Invalid update value '%s' for column '%s'. Allowed strings are: %s.",
+			trimmed, colID, strings.Join(a.StrOptions, ", "))
+	}
+	return ""
+}
+
+// Validate checks a document for the mistakes generateJson guards against
+// in the browser, plus structural checks the browser never made, and that
+// its namedFunctions and calculationRules are what Compile makes of it. It
+// returns nil when the document is valid.
+func Validate(doc *Document) error {
+	v := &validator{}
+	v.run(doc)
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: v.problems}
+}
+
+type validator struct {
+	problems []Problem
+}
+
+func (v *validator) addf(path, format string, args ...any) {
+	v.problems = append(v.problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) run(doc *Document) {
+	if len(doc.Columns) == 0 {
+		v.addf("columns", "protocol must have at least one column")
+	}
+
+	columns := map[string]Column{}
+	names := map[string]bool{}
+
+	for i, col := range doc.Columns {
+		path := fmt.Sprintf("columns[%d]", i)
+
+		if strings.TrimSpace(col.ID) == "" {
+			v.addf(path+".id", "column id is required")
+		} else if _, dup := columns[col.ID]; dup {
+			v.addf(path+".id", "Duplicate column id '%s'. Column IDs must be unique.", col.ID)
+		} else {
+			columns[col.ID] = col
+		}
+
+		if col.Name != "" {
+			if names[col.Name] {
+				v.addf(path+".name", "Duplicate column name '%s'. Column names must be unique.", col.Name)
+			}
+			names[col.Name] = true
+		}
+
+		if col.IntMin != nil && col.IntMax != nil && *col.IntMin > *col.IntMax {
+			v.addf(path+".intMax", "intMin (%d) is above intMax (%d)", *col.IntMin, *col.IntMax)
+		}
+
+		switch col.TabBehavior {
+		case "", TabNextColumn, TabNextRow, TabNextRowPrevColumn:
+		default:
+			v.addf(path+".tabBehavior", "unknown tab behavior '%s'", col.TabBehavior)
+		}
+
+		v.possibleValues(path+".possibleValues", col.PossibleValues)
+		v.possibleValues(path+".positiveValues", col.PositiveValues)
+	}
+
+	for i, rule := range doc.CalculationRules {
+		v.calculationRule(fmt.Sprintf("calculationRules[%d]", i), rule, columns, doc.NamedFunctions)
+	}
+
+	for i, cfg := range doc.ScoringConfigs {
+		v.scoringConfig(fmt.Sprintf("scoringConfigs[%d]", i), cfg, columns)
+	}
+
+	// Only worth comparing once the parts Compile reads are sound.
+	if len(v.problems) == 0 {
+		v.generated(doc)
+	}
+}
+
+// generated reports where the document's Xtract parts differ from what
+// its columns, scoringConfigs and custom code compile to, so a client
+// can't save (and later export) functions that don't match its rules.
+func (v *validator) generated(doc *Document) {
+	want := Compile(doc)
+
+	for _, fn := range want.NamedFunctions {
+		body, ok := doc.NamedFunctions.Get(fn.Name)
+		switch {
+		case !ok:
+			v.addf("namedFunctions."+fn.Name, "is missing; the scoring configs compile to it")
+		case body != fn.Body:
+			v.addf("namedFunctions."+fn.Name, "does not match what the scoring configs compile to")
+		}
+	}
+	for _, fn := range doc.NamedFunctions {
+		if _, ok := want.NamedFunctions.Get(fn.Name); !ok {
+			v.addf("namedFunctions."+fn.Name, "is not generated from the scoring configs; list hand-written code in customFunctions")
+		}
+	}
+	if len(v.problems) == 0 && !reflect.DeepEqual(doc.NamedFunctions, want.NamedFunctions) {
+		v.addf("namedFunctions", "are not in the order the scoring configs compile them")
+	}
+
+	if len(doc.CalculationRules) != len(want.CalculationRules) {
+		v.addf("calculationRules", "has %d rules; the columns and scoring configs compile to %d",
+			len(doc.CalculationRules), len(want.CalculationRules))
+		return
+	}
+	for i, rule := range doc.CalculationRules {
+		if !reflect.DeepEqual(rule, want.CalculationRules[i]) {
+			v.addf(fmt.Sprintf("calculationRules[%d]", i), "does not match the rule the columns and scoring configs compile to")
+		}
+	}
+}
+
+func (v *validator) possibleValues(path string, vals []PossibleValue) {
+	for i, pv := range vals {
+		p := fmt.Sprintf("%s[%d]", path, i)
+		switch pv.Type {
+		case ValueTypeInteger:
+			if pv.Min != nil && pv.Max != nil && *pv.Min > *pv.Max {
+				v.addf(p+".max", "min (%d) is above max (%d)", *pv.Min, *pv.Max)
+			}
+		case ValueTypeString:
+			if len(pv.Options) == 0 {
+				v.addf(p+".options", "string values need at least one option")
+			}
+		default:
+			v.addf(p+".type", "unknown value type '%s'", pv.Type)
+		}
+	}
+}
+
+func (v *validator) calculationRule(path string, rule CalculationRule, columns map[string]Column, fns NamedFunctions) {
+	if len(rule.Conditions) == 0 {
+		v.addf(path+".conditions", "rule has no conditions")
+	}
+	if len(rule.Results) == 0 {
+		v.addf(path+".results", "rule has no results")
+	}
+
+	focus := false
+	for _, res := range rule.Results {
+		if res.Type == ResultSetFocus {
+			focus = true
+		}
+	}
+
+	for i, cond := range rule.Conditions {
+		p := fmt.Sprintf("%s.conditions[%d]", path, i)
+		if cond.Type != ConditionChange {
+			v.addf(p+".type", "unknown condition type '%s'", cond.Type)
+			continue
+		}
+		if len(cond.ColumnIDs) == 0 {
+			v.addf(p+".columnIds", "change condition needs at least one column")
+		}
+		for j, id := range cond.ColumnIDs {
+			if _, ok := columns[id]; ok {
+				continue
+			}
+			if focus {
+				v.addf(fmt.Sprintf("%s.columnIds[%d]", p, j), "focus rule points to missing column '%s'", id)
+			} else {
+				v.addf(fmt.Sprintf("%s.columnIds[%d]", p, j), "unknown column '%s'", id)
+			}
+		}
+	}
+
+	for i, res := range rule.Results {
+		p := fmt.Sprintf("%s.results[%d]", path, i)
+		switch res.Type {
+		case ResultSetFocus:
+			if res.RelativeRows == 0 && res.RelativeColumns == 0 {
+				v.addf(p, "setFocus does not move focus")
+			}
+		case ResultRunCode:
+			if res.FunctionName == "" {
+				v.addf(p+".functionName", "runCode needs a functionName")
+			} else if _, ok := fns.Get(res.FunctionName); !ok {
+				v.addf(p+".functionName", "unknown named function '%s'", res.FunctionName)
+			}
+		default:
+			v.addf(p+".type", "unknown result type '%s'", res.Type)
+		}
+	}
+}
+
+func (v *validator) scoringConfig(path string, cfg ScoringConfig, columns map[string]Column) {
+	if _, ok := columns[cfg.TriggerColumn]; !ok {
+		v.addf(path+".triggerColumn", "unknown trigger column '%s'", cfg.TriggerColumn)
+	}
+
+	switch cfg.Scope {
+	case ScopeNeither, ScopePositive, ScopeNegative:
+	default:
+		v.addf(path+".scope", "unknown scope '%s'", cfg.Scope)
+	}
+
+	if len(cfg.Rules) == 0 {
+		v.addf(path+".rules", "scoring config has no rules")
+	}
+
+	for i, rule := range cfg.Rules {
+		rp := fmt.Sprintf("%s.rules[%d]", path, i)
+
+		for j, c := range rule.Conditions {
+			cp := fmt.Sprintf("%s.conditions[%d]", rp, j)
+			if !validOps[c.Op] {
+				v.addf(cp+".op", "unknown operator '%s'", c.Op)
+				continue
+			}
+			if c.Op == OpAlways {
+				continue
+			}
+			if _, ok := columns[c.Col]; !ok {
+				v.addf(cp+".col", "unknown column '%s'", c.Col)
+			}
+			if c.Thresh == "" {
+				v.addf(cp+".thresh", "threshold is required")
+			}
+			switch c.Base {
+			case "", BaseZero:
+			case BaseNegative, BasePositive:
+				if !numericPattern.MatchString(c.Thresh) {
+					v.addf(cp+".base", "a %s reference base needs a numeric threshold", c.Base)
+				}
+			default:
+				v.addf(cp+".base", "unknown base '%s'", c.Base)
+			}
+		}
+
+		if len(rule.Updates) == 0 {
+			v.addf(rp+".updates", "rule has no updates")
+		}
+
+		seen := map[string]bool{}
+		for j, u := range rule.Updates {
+			up := fmt.Sprintf("%s.updates[%d]", rp, j)
+			if seen[u.Col] {
+				v.addf(up+".col", "In scoring trigger for column '%s', one rule updates column '%s' more than once. "+
+					"Each scoring rule row can only update a given column once.", cfg.TriggerColumn, u.Col)
+				continue
+			}
+			seen[u.Col] = true
+
+			col, ok := columns[u.Col]
+			if !ok {
+				v.addf(up+".col", "unknown column '%s'", u.Col)
+				continue
+			}
+			if u.Val == "" {
+				v.addf(up+".val", "update value is required")
+				continue
+			}
+			if msg := col.Allowed().CheckValue(u.Col, u.Val); msg != "" {
+				v.addf(up+".val", "%s", msg)
+			}
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package protocol
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// validProblems runs Validate and returns its problems, failing on any
+// other kind of error.
+func validProblems(t *testing.T, doc *Document) []Problem {
+	t.Helper()
+	err := Validate(doc)
+	if err == nil {
+		return nil
+	}
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Validate returned %T: %v", err, err)
+	}
+	return verr.Problems
+}
+
+func hasProblem(problems []Problem, path, message string) bool {
+	for _, p := range problems {
+		if p.Path == path && strings.Contains(p.Message, message) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestValidateAcceptsBuilderOutput(t *testing.T) {
+	for _, name := range compileCases(t) {
+		_, saved := loadSaved(t, name)
+		if problems := validProblems(t, saved); problems != nil {
+			t.Errorf("%s: builder output rejected: %+v", name, problems)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(doc *Document)
+		path    string
+		message string
+	}{
+		{
+			name:    "duplicate column id",
+			change:  func(doc *Document) { doc.Columns[1].ID = doc.Columns[0].ID },
+			path:    "columns[1].id",
+			message: "Duplicate column id 'Wheal'",
+		},
+		{
+			name:    "duplicate column name",
+			change:  func(doc *Document) { doc.Columns[1].Name = doc.Columns[0].Name },
+			path:    "columns[1].name",
+			message: "Duplicate column name 'Wheal'",
+		},
+		{
+			name:    "unknown trigger column",
+			change:  func(doc *Document) { doc.ScoringConfigs[0].TriggerColumn = "Nope" },
+			path:    "scoringConfigs[0].triggerColumn",
+			message: "unknown trigger column 'Nope'",
+		},
+		{
+			name: "intMin above intMax",
+			change: func(doc *Document) {
+				lo, hi := 9, 3
+				doc.Columns[0].IntMin, doc.Columns[0].IntMax = &lo, &hi
+			},
+			path:    "columns[0].intMax",
+			message: "intMin (9) is above intMax (3)",
+		},
+		{
+			name:    "update value outside the column's range",
+			change:  func(doc *Document) { doc.ScoringConfigs[1].Rules[0].Updates[0].Val = "9" },
+			path:    "scoringConfigs[1].rules[0].updates[0].val",
+			message: "Allowed integer range is 0–4",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, doc := loadSaved(t, "chains")
+			tt.change(doc)
+			doc = Compile(doc)
+
+			problems := validProblems(t, doc)
+			if !hasProblem(problems, tt.path, tt.message) {
+				t.Errorf("want %s: %q, got %+v", tt.path, tt.message, problems)
+			}
+		})
+	}
+}
+
+func TestValidateFocusRuleToMissingColumn(t *testing.T) {
+	_, doc := loadSaved(t, "chains")
+	doc.CalculationRules[0].Conditions[0].ColumnIDs = []string{"Gone"}
+
+	problems := validProblems(t, doc)
+	if !hasProblem(problems, "calculationRules[0].conditions[0].columnIds[0]", "focus rule points to missing column 'Gone'") {
+		t.Errorf("got %+v", problems)
+	}
+}
+
+func TestValidateRejectsFunctionsThatDontMatchScoring(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(doc *Document)
+		path    string
+		message string
+	}{
+		{
+			name:    "edited function",
+			change:  func(doc *Document) { doc.NamedFunctions.Set("autoFill", "x") },
+			path:    "namedFunctions.autoFill",
+			message: "does not match",
+		},
+		{
+			name: "missing function and rules",
+			change: func(doc *Document) {
+				doc.NamedFunctions = NamedFunctions{{Name: "autoFill", Body: AutoFillFunction}}
+				doc.CalculationRules = doc.CalculationRules[:len(doc.Columns)]
+			},
+			path:    "namedFunctions.setClassNoteFlareFromWheal",
+			message: "is missing",
+		},
+		{
+			name:    "undeclared hand-written function",
+			change:  func(doc *Document) { doc.NamedFunctions.Set("helper", "return null;") },
+			path:    "namedFunctions.helper",
+			message: "customFunctions",
+		},
+		{
+			name:    "changed rule",
+			change:  func(doc *Document) { doc.CalculationRules[0].Results[0].RelativeRows = 2 },
+			path:    "calculationRules[0]",
+			message: "does not match",
+		},
+		{
+			name: "missing rules",
+			change: func(doc *Document) {
+				doc.CalculationRules = doc.CalculationRules[:len(doc.Columns)]
+			},
+			path:    "calculationRules",
+			message: "has 4 rules; the columns and scoring configs compile to 6",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, doc := loadSaved(t, "chains")
+			tt.change(doc)
+
+			problems := validProblems(t, doc)
+			if !hasProblem(problems, tt.path, tt.message) {
+				t.Errorf("want %s: %q, got %+v", tt.path, tt.message, problems)
+			}
+		})
+	}
+}
+
+func TestValidateAcceptsDeclaredCustomCode(t *testing.T) {
+	_, doc := loadSaved(t, "chains")
+	doc.CustomFunctions = []CustomFunction{{Name: "helper", Body: "return null;", Reason: "not called by any calculation rule"}}
+	doc = Compile(doc)
+
+	if problems := validProblems(t, doc); problems != nil {
+		t.Errorf("got %+v", problems)
+	}
+}
@@ -9,10 +9,31 @@ const currentPasswordInput = document.getElementById("currentPassword");
 const newPasswordInput = document.getElementById("newPassword");
 const confirmNewPasswordInput = document.getElementById("confirmNewPassword");
 
+const sessionListEl = document.getElementById("sessionList");
+const revokeOtherSessionsBtn = document.getElementById("revokeOtherSessionsBtn");
+
 const protocolListEl = document.getElementById("protocolList");
 const noProtocolsMessage = document.getElementById("noProtocolsMessage");
 
+const sharedListEl = document.getElementById("sharedList");
+const noSharedMessage = document.getElementById("noSharedMessage");
+
+const trashListEl = document.getElementById("trashList");
+const noTrashMessage = document.getElementById("noTrashMessage");
+
+const teamListEl = document.getElementById("teamList");
+const noTeamsMessage = document.getElementById("noTeamsMessage");
+const newTeamForm = document.getElementById("newTeamForm");
+const newTeamNameInput = document.getElementById("newTeamName");
+
+// Teams the current user belongs to (filled by loadTeams)
+let myTeams = [];
+
+const reviewSection = document.getElementById("reviewSection");
+const reviewListEl = document.getElementById("reviewList");
+
 let currentUserIsAdmin = false;
+let currentUserId = 0;
 
 // Column preset DOM refs
 const presetList = document.getElementById("presetList");
@@ -20,6 +41,7 @@ const presetForm = document.getElementById("presetForm");
 const presetKeyInput = document.getElementById("presetKeyInput");
 const presetLabelInput = document.getElementById("presetLabelInput");
 const presetOrderInput = document.getElementById("presetOrderInput");
+const presetTeamSelect = document.getElementById("presetTeamSelect");
 const presetConfigInput = document.getElementById("presetConfigInput");
 const presetFormResetBtn = document.getElementById("presetFormResetBtn");
 const presetFormError = document.getElementById("presetFormError");
@@ -96,10 +118,20 @@ function showAccountLoggedIn(user) {
   accountAuthStatus.style.display = "flex";
   accountUserEmail.textContent = user.email || "";
   currentUserIsAdmin = !!user.is_admin;
+  currentUserId = user.id;
 
-  // Correct function
-  loadAccountProtocols();
-  loadAccountColumnPresets();
+  // Teams first so protocol and preset rows can show them
+  loadTeams().then(() => {
+    loadAccountProtocols();
+    loadAccountColumnPresets();
+  });
+  loadSessions();
+  loadSharedProtocols();
+  loadProtocolTrash();
+
+  if (user.is_admin || user.is_reviewer) {
+    loadReviewQueue();
+  }
 }
 
 
@@ -173,6 +205,787 @@ if (changePasswordForm) {
   });
 }
 
+// ---------- Protocol visibility ----------
+
+const VISIBILITY_OPTIONS = [
+  ["private", "Private"],
+  ["team", "Team"],
+  ["organization", "Organization"],
+  ["public", "Public (no sign-in)"],
+];
+
+// ---------- Teams ----------
+
+const TEAM_ROLES = ["owner", "editor", "viewer"];
+
+async function loadTeams() {
+  try {
+    const res = await fetch("/api/teams", { credentials: "include" });
+    if (!res.ok) {
+      console.error("loadTeams status:", res.status);
+      return;
+    }
+
+    const data = await res.json();
+    myTeams = Array.isArray(data) ? data : [];
+    renderTeams();
+  } catch (err) {
+    console.error("loadTeams error:", err);
+  }
+}
+
+function renderTeams() {
+  // Presets can be saved for any team the user can edit in
+  if (presetTeamSelect) {
+    const current = presetTeamSelect.value;
+    presetTeamSelect.innerHTML = '<option value="0">Everyone</option>';
+    myTeams
+      .filter((t) => t.role !== "viewer")
+      .forEach((t) => {
+        const opt = document.createElement("option");
+        opt.value = String(t.id);
+        opt.textContent = t.name;
+        presetTeamSelect.appendChild(opt);
+      });
+    presetTeamSelect.value = current || "0";
+  }
+
+  if (!teamListEl) return;
+
+  teamListEl.innerHTML = "";
+  if (noTeamsMessage) {
+    noTeamsMessage.textContent = myTeams.length ? "" : "You are not in any team yet.";
+  }
+
+  myTeams.forEach((t) => {
+    const block = document.createElement("div");
+    block.style.padding = "6px 0";
+    block.style.borderBottom = "1px solid #1f2937";
+
+    const header = document.createElement("div");
+    header.style.display = "flex";
+    header.style.justifyContent = "space-between";
+    header.style.alignItems = "center";
+
+    const title = document.createElement("strong");
+    title.textContent = t.name;
+    const role = document.createElement("span");
+    role.textContent = ` · ${t.role}`;
+    role.style.fontSize = "11px";
+    role.style.color = "#9ca3af";
+    title.appendChild(role);
+
+    const membersBtn = document.createElement("button");
+    membersBtn.type = "button";
+    membersBtn.textContent = "Members";
+
+    const membersEl = document.createElement("div");
+    membersEl.style.display = "none";
+    membersEl.style.marginTop = "6px";
+
+    membersBtn.addEventListener("click", async () => {
+      if (membersEl.style.display === "none") {
+        membersEl.style.display = "block";
+        await loadTeamMembers(t, membersEl);
+      } else {
+        membersEl.style.display = "none";
+      }
+    });
+
+    header.appendChild(title);
+    header.appendChild(membersBtn);
+    block.appendChild(header);
+    block.appendChild(membersEl);
+    teamListEl.appendChild(block);
+  });
+}
+
+function teamName(id) {
+  const t = myTeams.find((t) => t.id === id);
+  return t ? t.name : `#${id}`;
+}
+
+function canEditTeam(id) {
+  return !!id && myTeams.some((t) => t.id === id && t.role !== "viewer");
+}
+
+async function teamRequest(url, method, body) {
+  const res = await fetch(url, {
+    method,
+    headers: { "Content-Type": "application/json" },
+    credentials: "include",
+    body: body ? JSON.stringify(body) : undefined,
+  });
+
+  if (!res.ok) {
+    const text = await res.text();
+    console.error(`${method} ${url} error:`, res.status, text);
+    alert(text || "Request failed (see console).");
+    return false;
+  }
+  return true;
+}
+
+async function loadTeamMembers(team, container) {
+  container.textContent = "Loading members...";
+
+  let members = [];
+  try {
+    const res = await fetch(`/api/teams/${encodeURIComponent(team.id)}/members`, {
+      credentials: "include",
+    });
+    if (!res.ok) {
+      container.textContent = "Failed to load members.";
+      return;
+    }
+    members = await res.json();
+  } catch (err) {
+    console.error("loadTeamMembers error:", err);
+    container.textContent = "Failed to load members (network error).";
+    return;
+  }
+
+  const isOwner = team.role === "owner";
+  const membersUrl = `/api/teams/${encodeURIComponent(team.id)}/members`;
+  container.innerHTML = "";
+
+  members.forEach((m) => {
+    const row = document.createElement("div");
+    row.style.display = "flex";
+    row.style.justifyContent = "space-between";
+    row.style.gap = "6px";
+    row.style.padding = "3px 0 3px 12px";
+
+    const label = document.createElement("span");
+    label.textContent = m.email;
+    row.appendChild(label);
+
+    const controls = document.createElement("div");
+    controls.style.display = "flex";
+    controls.style.gap = "6px";
+
+    if (isOwner) {
+      const roleSelect = document.createElement("select");
+      TEAM_ROLES.forEach((r) => {
+        const opt = document.createElement("option");
+        opt.value = r;
+        opt.textContent = r;
+        roleSelect.appendChild(opt);
+      });
+      roleSelect.value = m.role;
+      roleSelect.addEventListener("change", async () => {
+        const ok = await teamRequest(membersUrl, "POST", { email: m.email, role: roleSelect.value });
+        if (!ok) roleSelect.value = m.role;
+        await loadTeams();
+      });
+      controls.appendChild(roleSelect);
+    } else {
+      const role = document.createElement("span");
+      role.textContent = m.role;
+      role.style.color = "#9ca3af";
+      controls.appendChild(role);
+    }
+
+    if (isOwner) {
+      const removeBtn = document.createElement("button");
+      removeBtn.type = "button";
+      removeBtn.textContent = "Remove";
+      removeBtn.addEventListener("click", async () => {
+        if (!confirm(`Remove ${m.email} from "${team.name}"?`)) return;
+        if (await teamRequest(`${membersUrl}/${encodeURIComponent(m.user_id)}`, "DELETE")) {
+          await loadTeams();
+          await loadAccountProtocols();
+        }
+      });
+      controls.appendChild(removeBtn);
+    }
+
+    row.appendChild(controls);
+    container.appendChild(row);
+  });
+
+  if (isOwner) {
+    const addForm = document.createElement("form");
+    addForm.style.display = "flex";
+    addForm.style.gap = "6px";
+    addForm.style.padding = "6px 0 0 12px";
+
+    const emailInput = document.createElement("input");
+    emailInput.type = "email";
+    emailInput.placeholder = "member@example.com";
+
+    const roleSelect = document.createElement("select");
+    TEAM_ROLES.forEach((r) => {
+      const opt = document.createElement("option");
+      opt.value = r;
+      opt.textContent = r;
+      roleSelect.appendChild(opt);
+    });
+    roleSelect.value = "editor";
+
+    const addBtn = document.createElement("button");
+    addBtn.type = "submit";
+    addBtn.textContent = "Add member";
+
+    addForm.addEventListener("submit", async (e) => {
+      e.preventDefault();
+      const email = emailInput.value.trim();
+      if (!email) return;
+      if (await teamRequest(membersUrl, "POST", { email, role: roleSelect.value })) {
+        await loadTeamMembers(team, container);
+      }
+    });
+
+    addForm.appendChild(emailInput);
+    addForm.appendChild(roleSelect);
+    addForm.appendChild(addBtn);
+    container.appendChild(addForm);
+  }
+}
+
+if (newTeamForm) {
+  newTeamForm.addEventListener("submit", async (e) => {
+    e.preventDefault();
+    const name = newTeamNameInput.value.trim();
+    if (!name) return;
+    if (await teamRequest("/api/teams", "POST", { name })) {
+      newTeamForm.reset();
+      await loadTeams();
+      await loadAccountProtocols();
+    }
+  });
+}
+
+// ---------- Protocol forks ----------
+
+async function showProtocolForks(p) {
+  try {
+    const res = await fetch(`/api/protocols/${encodeURIComponent(p.id)}/forks`, {
+      credentials: "include",
+    });
+
+    if (!res.ok) {
+      const text = await res.text();
+      console.error("showProtocolForks error:", res.status, text);
+      alert("Failed to load forks (see console).");
+      return;
+    }
+
+    const forks = await res.json();
+    const lines = (Array.isArray(forks) ? forks : []).map(
+      (f) =>
+        `• ${f.owner_email} — "${f.name}" (from v${f.from_version}, ${new Date(f.created_at).toLocaleDateString()})`
+    );
+    alert(`Forks of "${p.name}":\n${lines.join("\n") || "none"}`);
+  } catch (err) {
+    console.error("showProtocolForks error:", err);
+    alert("Failed to load forks (network error).");
+  }
+}
+
+// ---------- Protocol sharing ----------
+
+async function manageProtocolShares(p) {
+  const sharesUrl = `/api/protocols/${encodeURIComponent(p.id)}/shares`;
+
+  let shares = [];
+  try {
+    const res = await fetch(sharesUrl, { credentials: "include" });
+    if (!res.ok) {
+      const text = await res.text();
+      console.error("manageProtocolShares error:", res.status, text);
+      alert("Failed to load shares (see console).");
+      return;
+    }
+    shares = await res.json();
+  } catch (err) {
+    console.error("manageProtocolShares error:", err);
+    alert("Failed to load shares (network error).");
+    return;
+  }
+
+  const lines = shares.map((s) => `• ${s.email} (${s.permission === "edit" ? "can edit" : "read-only"})`);
+  const input = prompt(
+    `"${p.name}" is shared with:\n${lines.join("\n") || "nobody"}\n\n` +
+      "Enter an email to share with (add \" edit\" to allow editing),\n" +
+      "or \"-email\" to stop sharing with someone:"
+  );
+  if (!input || !input.trim()) return;
+
+  const value = input.trim();
+  if (value.startsWith("-")) {
+    const email = value.slice(1).trim().toLowerCase();
+    const share = shares.find((s) => s.email.toLowerCase() === email);
+    if (!share) {
+      alert(`"${p.name}" is not shared with ${email}.`);
+      return;
+    }
+    await teamRequest(`${sharesUrl}/${encodeURIComponent(share.user_id)}`, "DELETE");
+    return;
+  }
+
+  const [email, perm] = value.split(/\s+/);
+  const permission = perm === "edit" ? "edit" : "read";
+  if (await teamRequest(sharesUrl, "POST", { email, permission })) {
+    alert(`Shared "${p.name}" with ${email} (${permission === "edit" ? "can edit" : "read-only"}).`);
+  }
+}
+
+// Share links: read-only URLs for people without an account
+async function manageShareLinks(p) {
+  const linksUrl = `/api/protocols/${encodeURIComponent(p.id)}/links`;
+
+  let links = [];
+  try {
+    const res = await fetch(linksUrl, { credentials: "include" });
+    if (!res.ok) {
+      const text = await res.text();
+      console.error("manageShareLinks error:", res.status, text);
+      alert("Failed to load share links (see console).");
+      return;
+    }
+    links = await res.json();
+  } catch (err) {
+    console.error("manageShareLinks error:", err);
+    alert("Failed to load share links (network error).");
+    return;
+  }
+
+  const now = new Date();
+  const active = links.filter((l) => !l.revoked_at && (!l.expires_at || new Date(l.expires_at) > now));
+  const lines = active.map(
+    (l) =>
+      `#${l.id}: ${window.location.origin}${l.url}` +
+      (l.expires_at ? ` (expires ${new Date(l.expires_at).toLocaleDateString()})` : "")
+  );
+  const input = prompt(
+    `Active share links for "${p.name}":\n${lines.join("\n") || "none"}\n\n` +
+      "Enter \"new\" for a link that never expires, \"new 7\" for one that expires in 7 days,\n" +
+      "or \"-#id\" to revoke a link:"
+  );
+  if (!input || !input.trim()) return;
+
+  const value = input.trim();
+  if (value.startsWith("-")) {
+    const id = value.replace(/^-#?/, "");
+    if (await teamRequest(`${linksUrl}/${encodeURIComponent(id)}`, "DELETE")) {
+      alert(`Link #${id} revoked.`);
+    }
+    return;
+  }
+
+  const [cmd, days] = value.split(/\s+/);
+  if (cmd !== "new") return;
+  const res = await fetch(linksUrl, {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    credentials: "include",
+    body: JSON.stringify({ expiresInDays: Number(days) || 0 }),
+  });
+  if (!res.ok) {
+    const text = await res.text();
+    console.error("create share link error:", res.status, text);
+    alert(text || "Failed to create share link (see console).");
+    return;
+  }
+  const link = await res.json();
+  prompt("Share link created. Anyone with this URL can view the protocol:", `${window.location.origin}${link.url}`);
+}
+
+async function loadSharedProtocols() {
+  if (!sharedListEl) return;
+
+  try {
+    const res = await fetch("/api/protocols?scope=shared", {
+      credentials: "include",
+    });
+
+    if (!res.ok) {
+      console.error("loadSharedProtocols status:", res.status);
+      return;
+    }
+
+    const data = await res.json();
+    const list = Array.isArray(data) ? data : [];
+
+    sharedListEl.innerHTML = "";
+    if (noSharedMessage) {
+      noSharedMessage.textContent = list.length ? "" : "Nothing has been shared with you.";
+    }
+
+    list.forEach((p) => {
+      const row = document.createElement("div");
+      row.style.display = "flex";
+      row.style.alignItems = "center";
+      row.style.justifyContent = "space-between";
+      row.style.gap = "8px";
+      row.style.padding = "6px 0";
+      row.style.borderBottom = "1px solid #1f2937";
+
+      const nameSpan = document.createElement("span");
+      nameSpan.textContent = p.name || "(unnamed protocol)";
+      nameSpan.style.fontSize = "13px";
+
+      const badge = document.createElement("span");
+      badge.textContent = p.shared_with_me === "edit" ? "Shared · can edit" : "Shared · read-only";
+      badge.style.marginLeft = "8px";
+      badge.style.fontSize = "11px";
+      badge.style.padding = "2px 6px";
+      badge.style.borderRadius = "999px";
+      badge.style.border = "1px solid #60a5fa";
+      badge.style.color = "#60a5fa";
+      nameSpan.appendChild(badge);
+      nameSpan.appendChild(statusBadge(p.status));
+
+      const rightSide = document.createElement("div");
+      rightSide.style.display = "flex";
+      rightSide.style.gap = "6px";
+
+      const openBtn = document.createElement("button");
+      openBtn.type = "button";
+      openBtn.textContent = "Open";
+      openBtn.addEventListener("click", () => {
+        window.location.href = `/?protocolId=${encodeURIComponent(p.id)}`;
+      });
+
+      const leaveBtn = document.createElement("button");
+      leaveBtn.type = "button";
+      leaveBtn.textContent = "Remove";
+      leaveBtn.addEventListener("click", async () => {
+        if (!confirm(`Stop seeing "${p.name}"? The owner can share it again.`)) return;
+        if (await teamRequest(`/api/protocols/${encodeURIComponent(p.id)}/shares/${encodeURIComponent(currentUserId)}`, "DELETE")) {
+          await loadSharedProtocols();
+        }
+      });
+
+      rightSide.appendChild(openBtn);
+      rightSide.appendChild(leaveBtn);
+      row.appendChild(nameSpan);
+      row.appendChild(rightSide);
+      sharedListEl.appendChild(row);
+    });
+  } catch (err) {
+    console.error("loadSharedProtocols error:", err);
+  }
+}
+
+// ---------- Sessions ----------
+
+async function loadSessions() {
+  if (!sessionListEl) return;
+
+  try {
+    const res = await fetch("/api/sessions", { credentials: "include" });
+    if (!res.ok) {
+      console.error("loadSessions status:", res.status);
+      return;
+    }
+
+    const list = await res.json();
+    sessionListEl.innerHTML = "";
+    if (revokeOtherSessionsBtn) {
+      revokeOtherSessionsBtn.style.display = list.length > 1 ? "" : "none";
+    }
+
+    list.forEach((s) => {
+      const row = document.createElement("div");
+      row.style.display = "flex";
+      row.style.alignItems = "center";
+      row.style.justifyContent = "space-between";
+      row.style.gap = "8px";
+      row.style.padding = "6px 0";
+      row.style.borderBottom = "1px solid #1f2937";
+
+      const info = document.createElement("span");
+      info.style.fontSize = "13px";
+      info.textContent = s.user_agent || "Unknown browser";
+      if (s.current) info.textContent += " (this session)";
+
+      const details = document.createElement("span");
+      details.style.display = "block";
+      details.style.fontSize = "11px";
+      details.style.color = "#9ca3af";
+      details.textContent =
+        `${s.ip || "unknown address"} · signed in ${new Date(s.created_at).toLocaleString()}` +
+        ` · last active ${new Date(s.last_seen_at).toLocaleString()}` +
+        ` · ends ${new Date(s.expires_at).toLocaleString()}`;
+      info.appendChild(details);
+
+      const revokeBtn = document.createElement("button");
+      revokeBtn.type = "button";
+      revokeBtn.textContent = s.current ? "Sign out" : "Revoke";
+      revokeBtn.addEventListener("click", async () => {
+        try {
+          const res = await fetch(`/api/sessions/${encodeURIComponent(s.id)}`, {
+            method: "DELETE",
+            credentials: "include",
+          });
+          if (!res.ok) {
+            const text = await res.text();
+            console.error("revoke session error:", res.status, text);
+            alert("Failed to revoke session (see console).");
+            return;
+          }
+          if (s.current) {
+            window.location.href = "/";
+            return;
+          }
+          await loadSessions();
+        } catch (err) {
+          console.error("revoke session error:", err);
+          alert("Failed to revoke session (network error).");
+        }
+      });
+
+      row.appendChild(info);
+      row.appendChild(revokeBtn);
+      sessionListEl.appendChild(row);
+    });
+  } catch (err) {
+    console.error("loadSessions error:", err);
+  }
+}
+
+if (revokeOtherSessionsBtn) {
+  revokeOtherSessionsBtn.addEventListener("click", async () => {
+    if (!confirm("Sign out every other browser and device?")) return;
+    try {
+      const res = await fetch("/api/sessions", {
+        method: "DELETE",
+        credentials: "include",
+      });
+      if (!res.ok) {
+        const text = await res.text();
+        console.error("revoke other sessions error:", res.status, text);
+        alert("Failed to sign out other sessions (see console).");
+        return;
+      }
+      await loadSessions();
+    } catch (err) {
+      console.error("revoke other sessions error:", err);
+      alert("Failed to sign out other sessions (network error).");
+    }
+  });
+}
+
+// ---------- Protocol trash ----------
+
+async function loadProtocolTrash() {
+  if (!trashListEl) return;
+
+  try {
+    const res = await fetch("/api/protocols/trash", {
+      credentials: "include",
+    });
+
+    if (!res.ok) {
+      console.error("loadProtocolTrash status:", res.status);
+      return;
+    }
+
+    const data = await res.json();
+    const list = Array.isArray(data) ? data : [];
+
+    trashListEl.innerHTML = "";
+    if (noTrashMessage) {
+      noTrashMessage.textContent = list.length ? "" : "The trash is empty.";
+    }
+
+    list.forEach((p) => {
+      const row = document.createElement("div");
+      row.style.display = "flex";
+      row.style.alignItems = "center";
+      row.style.justifyContent = "space-between";
+      row.style.gap = "8px";
+      row.style.padding = "6px 0";
+      row.style.borderBottom = "1px solid #1f2937";
+
+      const nameSpan = document.createElement("span");
+      nameSpan.textContent = p.name || "(unnamed protocol)";
+      nameSpan.style.fontSize = "13px";
+
+      const purge = document.createElement("span");
+      purge.textContent = ` · deleted ${new Date(p.deleted_at).toLocaleDateString()}, removed for good after ${new Date(p.purge_at).toLocaleDateString()}`;
+      purge.style.fontSize = "11px";
+      purge.style.color = "#9ca3af";
+      nameSpan.appendChild(purge);
+
+      const restoreBtn = document.createElement("button");
+      restoreBtn.type = "button";
+      restoreBtn.textContent = "Restore";
+      restoreBtn.addEventListener("click", async () => {
+        try {
+          const res = await fetch(`/api/protocols/${encodeURIComponent(p.id)}/restore`, {
+            method: "POST",
+            credentials: "include",
+          });
+
+          if (!res.ok) {
+            const text = await res.text();
+            console.error("restore protocol error:", res.status, text);
+            alert("Failed to restore protocol (see console).");
+            return;
+          }
+
+          await loadAccountProtocols();
+          await loadProtocolTrash();
+        } catch (err) {
+          console.error("restore protocol error:", err);
+          alert("Failed to restore protocol (network error).");
+        }
+      });
+
+      row.appendChild(nameSpan);
+      row.appendChild(restoreBtn);
+      trashListEl.appendChild(row);
+    });
+  } catch (err) {
+    console.error("loadProtocolTrash error:", err);
+  }
+}
+
+// ---------- Protocol lifecycle ----------
+
+const STATUS_LABELS = {
+  draft: ["Draft", "#9ca3af"],
+  in_review: ["In review", "#f59e0b"],
+  approved: ["Approved", "#22c55e"],
+  retired: ["Retired", "#ef4444"],
+};
+
+function statusBadge(status) {
+  const [label, color] = STATUS_LABELS[status] || STATUS_LABELS.draft;
+  const badge = document.createElement("span");
+  badge.textContent = label;
+  badge.style.marginLeft = "8px";
+  badge.style.fontSize = "11px";
+  badge.style.padding = "2px 6px";
+  badge.style.borderRadius = "999px";
+  badge.style.border = `1px solid ${color}`;
+  badge.style.color = color;
+  return badge;
+}
+
+async function postTransition(id, action, comment) {
+  const res = await fetch(`/api/protocols/${encodeURIComponent(id)}/transitions`, {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    credentials: "include",
+    body: JSON.stringify({ action, comment: comment || "" }),
+  });
+
+  if (!res.ok) {
+    const text = await res.text();
+    console.error(`${action} error:`, res.status, text);
+    alert(text || `Failed to ${action} protocol (see console).`);
+    return false;
+  }
+  return true;
+}
+
+function transitionButton(p, action, label) {
+  const btn = document.createElement("button");
+  btn.type = "button";
+  btn.textContent = label;
+  btn.addEventListener("click", async () => {
+    if (!p.id) return;
+    if (action === "retire" && !confirm(`Retire protocol "${p.name}"? It will be hidden from the builder.`)) {
+      return;
+    }
+    try {
+      if (await postTransition(p.id, action)) {
+        await loadAccountProtocols();
+      }
+    } catch (err) {
+      console.error(`${action} network error:`, err);
+      alert(`Failed to ${action} protocol (network error).`);
+    }
+  });
+  return btn;
+}
+
+// Reviewers: protocols waiting for approval
+async function loadReviewQueue() {
+  if (!reviewSection || !reviewListEl) return;
+  reviewSection.style.display = "";
+
+  try {
+    const res = await fetch("/api/protocols?scope=review", {
+      credentials: "include",
+    });
+    if (!res.ok) {
+      console.error("loadReviewQueue status:", res.status);
+      return;
+    }
+
+    const data = await res.json();
+    const list = Array.isArray(data) ? data : [];
+    reviewListEl.innerHTML = "";
+
+    if (!list.length) {
+      reviewListEl.textContent = "Nothing is waiting for review.";
+      return;
+    }
+
+    list.forEach((p) => {
+      const row = document.createElement("div");
+      row.style.display = "flex";
+      row.style.alignItems = "center";
+      row.style.justifyContent = "space-between";
+      row.style.gap = "8px";
+      row.style.padding = "6px 0";
+      row.style.borderBottom = "1px solid #1f2937";
+
+      const nameSpan = document.createElement("span");
+      nameSpan.textContent = `${p.name || "(unnamed protocol)"} (v${p.version})`;
+      nameSpan.style.fontSize = "13px";
+
+      const rightSide = document.createElement("div");
+      rightSide.style.display = "flex";
+      rightSide.style.gap = "6px";
+
+      const openBtn = document.createElement("button");
+      openBtn.type = "button";
+      openBtn.textContent = "Open";
+      openBtn.addEventListener("click", () => {
+        window.location.href = `/?protocolId=${encodeURIComponent(p.id)}`;
+      });
+
+      const approveBtn = document.createElement("button");
+      approveBtn.type = "button";
+      approveBtn.textContent = "Approve";
+      approveBtn.addEventListener("click", async () => {
+        const comment = prompt("Approval comment (optional):", "");
+        if (comment === null) return;
+        if (await postTransition(p.id, "approve", comment)) {
+          await loadReviewQueue();
+        }
+      });
+
+      const rejectBtn = document.createElement("button");
+      rejectBtn.type = "button";
+      rejectBtn.textContent = "Send back";
+      rejectBtn.addEventListener("click", async () => {
+        const comment = prompt("What needs to change?", "");
+        if (comment === null) return;
+        if (await postTransition(p.id, "reject", comment)) {
+          await loadReviewQueue();
+        }
+      });
+
+      rightSide.appendChild(openBtn);
+      rightSide.appendChild(approveBtn);
+      rightSide.appendChild(rejectBtn);
+
+      row.appendChild(nameSpan);
+      row.appendChild(rightSide);
+      reviewListEl.appendChild(row);
+    });
+  } catch (err) {
+    console.error("loadReviewQueue error:", err);
+  }
+}
+
 // ---------- Saved protocols list ----------
 
 // ---------- Saved protocols list ----------
@@ -226,7 +1039,7 @@ async function loadAccountProtocols() {
 
       if (p.is_public) {
         const badge = document.createElement("span");
-        badge.textContent = "Public";
+        badge.textContent = p.visibility === "public" ? "Public" : "Organization";
         badge.style.marginLeft = "8px";
         badge.style.fontSize = "11px";
         badge.style.padding = "2px 6px";
@@ -236,6 +1049,25 @@ async function loadAccountProtocols() {
         nameSpan.appendChild(badge);
       }
 
+      nameSpan.appendChild(statusBadge(p.status));
+
+      if (p.team_name) {
+        const team = document.createElement("span");
+        team.textContent = ` · ${p.team_name}`;
+        team.style.fontSize = "11px";
+        team.style.color = "#60a5fa";
+        nameSpan.appendChild(team);
+      }
+
+      if (p.forked_from) {
+        const lineage = document.createElement("span");
+        const srcName = p.forked_from.name || `protocol #${p.forked_from.id}`;
+        lineage.textContent = ` · forked from ${srcName} v${p.forked_from.version}`;
+        lineage.style.fontSize = "11px";
+        lineage.style.color = "#9ca3af";
+        nameSpan.appendChild(lineage);
+      }
+
       const rightSide = document.createElement("div");
       rightSide.style.display = "flex";
       rightSide.style.gap = "6px";
@@ -249,41 +1081,72 @@ async function loadAccountProtocols() {
         window.location.href = `/?protocolId=${encodeURIComponent(p.id)}`;
       });
 
-      // 🔹 Make public (only if not already public)
-      const makePublicBtn = document.createElement("button");
-      makePublicBtn.type = "button";
-      makePublicBtn.textContent = "Make public";
+      // 🔹 Visibility (owners can move between levels, including back to private)
+      const visibilitySelect = document.createElement("select");
+      VISIBILITY_OPTIONS.forEach(([value, label]) => {
+        const opt = document.createElement("option");
+        opt.value = value;
+        opt.textContent = label;
+        visibilitySelect.appendChild(opt);
+      });
+      visibilitySelect.value = p.visibility || "private";
+      visibilitySelect.addEventListener("change", async () => {
+        if (!p.id) return;
+        const visibility = visibilitySelect.value;
+        try {
+          const res = await fetch(`/api/protocols/${encodeURIComponent(p.id)}/visibility`, {
+            method: "POST",
+            headers: { "Content-Type": "application/json" },
+            credentials: "include",
+            body: JSON.stringify({ visibility }),
+          });
 
-      if (p.is_public) {
-        makePublicBtn.disabled = true;
-        makePublicBtn.textContent = "Public";
-      } else {
-        makePublicBtn.addEventListener("click", async () => {
-          if (!p.id) return;
-          try {
-            const res = await fetch("/api/protocols", {
-              method: "POST",
-              headers: { "Content-Type": "application/json" },
-              credentials: "include",
-              body: JSON.stringify({
-                id: p.id,
-                makePublic: true,
-              }),
-            });
-
-            if (!res.ok) {
-              const text = await res.text();
-              console.error("makePublic error:", res.status, text);
-              alert("Failed to make protocol public (see console).");
-              return;
-            }
+          if (!res.ok) {
+            const text = await res.text();
+            console.error("visibility error:", res.status, text);
+            alert(text || "Failed to change visibility (see console).");
+            visibilitySelect.value = p.visibility || "private";
+            return;
+          }
 
-            alert("Protocol is now public and visible to all users.");
-            await loadAccountProtocols();
-          } catch (err) {
-            console.error("makePublic network error:", err);
-            alert("Failed to make protocol public (network error).");
+          await loadAccountProtocols();
+        } catch (err) {
+          console.error("visibility network error:", err);
+          alert("Failed to change visibility (network error).");
+          visibilitySelect.value = p.visibility || "private";
+        }
+      });
+
+      // 🔹 Owning team (only teams the user can edit in are offered)
+      let teamSelect = null;
+      const editableTeams = myTeams.filter((t) => t.role !== "viewer");
+      if (editableTeams.length || p.team_id) {
+        teamSelect = document.createElement("select");
+        const personal = document.createElement("option");
+        personal.value = "0";
+        personal.textContent = "Personal";
+        teamSelect.appendChild(personal);
+        editableTeams.forEach((t) => {
+          const opt = document.createElement("option");
+          opt.value = String(t.id);
+          opt.textContent = t.name;
+          teamSelect.appendChild(opt);
+        });
+        if (p.team_id && !editableTeams.some((t) => t.id === p.team_id)) {
+          const opt = document.createElement("option");
+          opt.value = String(p.team_id);
+          opt.textContent = p.team_name;
+          teamSelect.appendChild(opt);
+        }
+        teamSelect.value = String(p.team_id || 0);
+        teamSelect.addEventListener("change", async () => {
+          const teamId = Number(teamSelect.value);
+          const ok = await teamRequest(`/api/protocols/${encodeURIComponent(p.id)}/team`, "POST", { teamId });
+          if (!ok) {
+            teamSelect.value = String(p.team_id || 0);
+            return;
           }
+          await loadAccountProtocols();
         });
       }
 
@@ -296,7 +1159,7 @@ async function loadAccountProtocols() {
 
       deleteBtn.addEventListener("click", async () => {
         if (!p.id) return;
-        if (!confirm(`Delete protocol "${p.name}"? This cannot be undone.`)) {
+        if (!confirm(`Move protocol "${p.name}" to the trash? You can restore it from the trash below.`)) {
           return;
         }
 
@@ -319,16 +1182,73 @@ async function loadAccountProtocols() {
           }
 
           await loadAccountProtocols();
+          await loadProtocolTrash();
         } catch (err) {
           console.error("delete protocol error:", err);
           alert("Failed to delete protocol (network error).");
         }
       });
 
-      // Order: Open | Make public | Delete
+      // Lifecycle: Submit for review / Withdraw / Retire / Reopen
+      const lifecycleBtns = [];
+      if (p.status === "draft") {
+        lifecycleBtns.push(transitionButton(p, "submit", "Submit for review"));
+      }
+      if (p.status === "in_review") {
+        lifecycleBtns.push(transitionButton(p, "withdraw", "Withdraw"));
+      }
+      if (p.status === "draft" || p.status === "approved") {
+        lifecycleBtns.push(transitionButton(p, "retire", "Retire"));
+      }
+      if (p.status === "retired") {
+        lifecycleBtns.push(transitionButton(p, "reopen", "Reopen"));
+      }
+
+      // Who forked this one
+      let forksBtn = null;
+      if (p.fork_count > 0) {
+        forksBtn = document.createElement("button");
+        forksBtn.type = "button";
+        forksBtn.textContent = `Forks (${p.fork_count})`;
+        forksBtn.addEventListener("click", () => showProtocolForks(p));
+      }
+
+      // Share with individual colleagues
+      const shareBtn = document.createElement("button");
+      shareBtn.type = "button";
+      shareBtn.textContent = "Share";
+      shareBtn.addEventListener("click", () => manageProtocolShares(p));
+
+      // Canonical Xtract JSON of the approved version
+      let exportBtn = null;
+      if (p.approved_version && p.status !== "retired") {
+        exportBtn = document.createElement("button");
+        exportBtn.type = "button";
+        exportBtn.textContent = `Export v${p.approved_version}`;
+        exportBtn.addEventListener("click", () => {
+          window.open(`/api/protocols/${encodeURIComponent(p.id)}/export`, "_blank");
+        });
+      }
+
+      // Read-only links for people without an account
+      const linksBtn = document.createElement("button");
+      linksBtn.type = "button";
+      linksBtn.textContent = "Links";
+      linksBtn.addEventListener("click", () => manageShareLinks(p));
+
+      // Order: Open | lifecycle | Export | Forks | Share | Links | Team | Visibility | Delete
+      // (team editors get the first four; the rest are the owner's)
       rightSide.appendChild(openBtn);
-      rightSide.appendChild(makePublicBtn);
-      rightSide.appendChild(deleteBtn);
+      lifecycleBtns.forEach((b) => rightSide.appendChild(b));
+      if (exportBtn) rightSide.appendChild(exportBtn);
+      if (forksBtn) rightSide.appendChild(forksBtn);
+      if (p.can_manage) {
+        rightSide.appendChild(shareBtn);
+        rightSide.appendChild(linksBtn);
+        if (teamSelect) rightSide.appendChild(teamSelect);
+        rightSide.appendChild(visibilitySelect);
+        rightSide.appendChild(deleteBtn);
+      }
 
       row.appendChild(nameSpan);
       row.appendChild(rightSide);
@@ -380,7 +1300,8 @@ async function loadAccountColumnPresets() {
       meta.className = "protocol-meta";
       meta.textContent =
         `key: ${p.key}` +
-        (p.standardOrder != null ? ` · order ${p.standardOrder}` : "");
+        (p.standardOrder != null ? ` · order ${p.standardOrder}` : "") +
+        (p.teamId ? ` · team ${teamName(p.teamId)}` : "");
 
       main.appendChild(title);
       main.appendChild(meta);
@@ -399,6 +1320,7 @@ async function loadAccountColumnPresets() {
         if (presetOrderInput)
           presetOrderInput.value =
             p.standardOrder != null ? String(p.standardOrder) : "";
+        if (presetTeamSelect) presetTeamSelect.value = String(p.teamId || 0);
 
         const cfg = p.config || {};
 
@@ -483,8 +1405,8 @@ async function loadAccountColumnPresets() {
 
       actions.appendChild(editBtn);
 
-      // Delete button (admin only)
-      if (currentUserIsAdmin) {
+      // Delete button (admins, or editors of the owning team)
+      if (currentUserIsAdmin || canEditTeam(p.teamId)) {
         const delBtn = document.createElement("button");
         delBtn.type = "button";
         delBtn.className = "btn-danger small";
@@ -643,6 +1565,9 @@ if (presetForm) {
       if (!Number.isNaN(n)) payload.standardOrder = n;
     }
 
+    const teamId = Number(presetTeamSelect?.value || 0);
+    if (teamId) payload.teamId = teamId;
+
     try {
       const res = await fetch("/api/column-presets", {
         method: "POST",
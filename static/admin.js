@@ -3,6 +3,7 @@ console.log("admin.js loaded");
 const userSelect = document.getElementById("adminUserSelect");
 const promoteBtn = document.getElementById("promoteBtn");
 const demoteBtn = document.getElementById("demoteBtn");
+const reviewerBtn = document.getElementById("reviewerBtn");
 const deleteBtn = document.getElementById("deleteBtn");
 const adminResetForm = document.getElementById("adminResetForm");
 const adminResetPasswordInput = document.getElementById("adminResetPassword");
@@ -13,6 +14,14 @@ const approveBtn = document.getElementById("approveBtn");
 const unapproveBtn = document.getElementById("unapproveBtn");
 const approvalStatusSpan = document.getElementById("approvalStatus");
 
+const inviteEmailInput = document.getElementById("inviteEmail");
+const inviteRoleSelect = document.getElementById("inviteRole");
+const inviteDaysInput = document.getElementById("inviteDays");
+const createInviteBtn = document.getElementById("createInviteBtn");
+const inviteLinkRow = document.getElementById("inviteLinkRow");
+const inviteLinkInput = document.getElementById("inviteLink");
+const invitationListEl = document.getElementById("invitationList");
+
 let adminUsersCache = [];
 
 
@@ -42,7 +51,8 @@ async function loadUsers() {
       opt.value = u.id; // numeric id
       let label = u.email;
       if (u.is_admin) label += " (admin)";
-      if (!u.is_approved) label += " [PENDING]";
+      else if (u.is_reviewer) label += " (reviewer)";
+      if (!u.is_approved) label += " [PENDING since " + formatRequestDate(u.created_at) + "]";
       opt.textContent = label;
       userSelect.appendChild(opt);
     });
@@ -134,6 +144,41 @@ if (demoteBtn) {
   });
 }
 
+// Grant / revoke the reviewer role
+if (reviewerBtn) {
+  reviewerBtn.addEventListener("click", async () => {
+    const userId = getSelectedUserId();
+    if (!userId) {
+      alert("Please choose a user.");
+      return;
+    }
+
+    const user = adminUsersCache.find((u) => u.id === userId);
+    const isReviewer = !(user && user.is_reviewer);
+
+    try {
+      const res = await fetch("/admin/reviewer", {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        credentials: "include",
+        body: JSON.stringify({ userId, isReviewer }),
+      });
+
+      if (!res.ok) {
+        const text = await res.text();
+        console.error("reviewer error:", res.status, text);
+        alert("Failed to update reviewer role (see console).");
+        return;
+      }
+
+      alert(isReviewer ? "User can now review protocols." : "Reviewer role removed.");
+      await loadUsers();
+    } catch (err) {
+      console.error("reviewerBtn error:", err);
+      alert("Failed to update reviewer role (network error).");
+    }
+  });
+}
 
 // Delete user
 if (deleteBtn) {
@@ -260,7 +305,13 @@ function refreshApprovalStatus() {
 
   approvalStatusSpan.textContent = u.is_approved
     ? "Status: approved"
-    : "Status: pending approval";
+    : "Status: pending approval (requested " + formatRequestDate(u.created_at) + ")";
+}
+
+// created_at as a short local date, e.g. for "pending since ..."
+function formatRequestDate(ts) {
+  const d = new Date(ts);
+  return Number.isNaN(d.getTime()) ? "unknown date" : d.toLocaleDateString();
 }
 
 if (userSelect) {
@@ -335,5 +386,134 @@ if (unapproveBtn) {
   });
 }
 
+// --- Invitations ---
+
+function invitationStatus(inv) {
+  if (inv.redeemed_at) {
+    return "used by " + (inv.redeemed_by || "a deleted user") + " on " + new Date(inv.redeemed_at).toLocaleString();
+  }
+  if (inv.revoked_at) return "revoked " + new Date(inv.revoked_at).toLocaleString();
+  if (new Date(inv.expires_at) <= new Date()) return "expired " + new Date(inv.expires_at).toLocaleString();
+  return "open until " + new Date(inv.expires_at).toLocaleString();
+}
+
+async function loadInvitations() {
+  if (!invitationListEl) return;
+
+  try {
+    const res = await fetch("/admin/invitations", { credentials: "include" });
+    if (!res.ok) {
+      console.error("loadInvitations status:", res.status);
+      return;
+    }
+
+    const list = await res.json();
+    invitationListEl.innerHTML = "";
+
+    list.forEach((inv) => {
+      const row = document.createElement("div");
+      row.style.display = "flex";
+      row.style.alignItems = "center";
+      row.style.justifyContent = "space-between";
+      row.style.gap = "8px";
+      row.style.padding = "6px 0";
+      row.style.borderBottom = "1px solid #1f2937";
+
+      const info = document.createElement("span");
+      info.style.fontSize = "13px";
+      info.textContent = `${inv.email} (${inv.role})`;
+
+      const details = document.createElement("span");
+      details.style.display = "block";
+      details.style.fontSize = "11px";
+      details.style.color = "#9ca3af";
+      details.textContent =
+        `created ${new Date(inv.created_at).toLocaleString()}` +
+        (inv.created_by ? ` by ${inv.created_by}` : "") +
+        ` · ${invitationStatus(inv)}`;
+      info.appendChild(details);
+      row.appendChild(info);
+
+      const usable = !inv.redeemed_at && !inv.revoked_at && new Date(inv.expires_at) > new Date();
+      if (usable) {
+        const revokeBtn = document.createElement("button");
+        revokeBtn.type = "button";
+        revokeBtn.textContent = "Revoke";
+        revokeBtn.addEventListener("click", async () => {
+          if (!confirm(`Revoke the invitation for ${inv.email}?`)) return;
+          try {
+            const res = await fetch(`/admin/invitations/${inv.id}`, {
+              method: "DELETE",
+              credentials: "include",
+            });
+            if (!res.ok) {
+              const text = await res.text();
+              console.error("revoke invitation error:", res.status, text);
+              alert("Failed to revoke invitation (see console).");
+              return;
+            }
+            await loadInvitations();
+          } catch (err) {
+            console.error("revoke invitation error:", err);
+            alert("Failed to revoke invitation (network error).");
+          }
+        });
+
+        row.appendChild(revokeBtn);
+      }
+
+      invitationListEl.appendChild(row);
+    });
+  } catch (err) {
+    console.error("loadInvitations error:", err);
+  }
+}
+
+function showInviteLink(url) {
+  if (!inviteLinkRow || !inviteLinkInput) return;
+  inviteLinkInput.value = window.location.origin + url;
+  inviteLinkRow.style.display = "";
+  inviteLinkInput.select();
+}
+
+if (createInviteBtn) {
+  createInviteBtn.addEventListener("click", async () => {
+    const email = inviteEmailInput ? inviteEmailInput.value.trim() : "";
+    if (!email) {
+      alert("Please enter the invitee's email.");
+      return;
+    }
+    const role = inviteRoleSelect ? inviteRoleSelect.value : "user";
+    const expiresInDays = inviteDaysInput ? parseInt(inviteDaysInput.value, 10) || 0 : 0;
+
+    try {
+      const res = await fetch("/admin/invitations", {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        credentials: "include",
+        body: JSON.stringify({ email, role, expiresInDays }),
+      });
+
+      if (!res.ok) {
+        const text = await res.text();
+        console.error("create invitation error:", res.status, text);
+        alert("Failed to create invitation: " + text.trim());
+        return;
+      }
+
+      const data = await res.json();
+      if (inviteEmailInput) inviteEmailInput.value = "";
+      showInviteLink(data.url);
+      await loadInvitations();
+    } catch (err) {
+      console.error("createInviteBtn error:", err);
+      alert("Failed to create invitation (network error).");
+    }
+  });
+}
+
 
-document.addEventListener("DOMContentLoaded", loadUsers);
+document.addEventListener("DOMContentLoaded", () => {
+  loadUsers();
+  loadInvitations();
+});
@@ -116,6 +116,41 @@ function showLoggedOut() {
 
 // --- Login / Signup / Okta wiring ---
 
+// Show the invite-code field or the allowed domains, depending on the
+// server's signup policy.
+async function loadSignupPolicy() {
+  const inviteRow = document.getElementById("signupInviteRow");
+  const note = document.getElementById("signupPolicyNote");
+
+  try {
+    const res = await fetch("/signup/policy", { credentials: "include" });
+    if (!res.ok) return;
+    const policy = await res.json();
+
+    // an invitation link (/?invite=...) fills the code in
+    const invite = new URLSearchParams(window.location.search).get("invite");
+    const inviteInput = document.getElementById("signupInviteCode");
+    if (invite && inviteInput) inviteInput.value = invite;
+
+    if (inviteRow) {
+      inviteRow.style.display = policy.inviteRequired || invite ? "block" : "none";
+    }
+    if (!note) return;
+
+    let text = "";
+    if (policy.policy === "approval") {
+      text = "New accounts need an admin's approval before they can log in.";
+    } else if (policy.policy === "domain" && Array.isArray(policy.domains)) {
+      const domains = policy.domains.map((d) => "@" + d + (policy.subdomains ? " (and subdomains)" : "")).join(", ");
+      text = "Sign-up is open to " + domains + " addresses. An admin approves new accounts before they can log in.";
+    }
+    note.textContent = text;
+    note.style.display = text ? "block" : "none";
+  } catch (err) {
+    console.error("loadSignupPolicy error", err);
+  }
+}
+
 function attachAuthHandlers() {
   const loginForm = document.getElementById("loginForm");
   const signupForm = document.getElementById("signupForm");
@@ -174,13 +209,15 @@ function attachAuthHandlers() {
       e.preventDefault();
       const email = document.getElementById("signupEmail").value;
       const password = document.getElementById("signupPassword").value;
+      const inviteInput = document.getElementById("signupInviteCode");
+      const inviteCode = inviteInput ? inviteInput.value.trim() : "";
 
       try {
         const res = await fetch("/signup", {
           method: "POST",
           headers: { "Content-Type": "application/json" },
           credentials: "include",
-          body: JSON.stringify({ email, password }),
+          body: JSON.stringify({ email, password, inviteCode }),
         });
 
         console.log("SIGNUP status:", res.status);
@@ -189,7 +226,10 @@ function attachAuthHandlers() {
           const text = await res.text();
           console.error("SIGNUP error body:", text);
 
-          if (text.toLowerCase().includes("password")) {
+          if (res.status === 403) {
+            // Turned away by the signup policy (invite code, email domain)
+            alert("Signup failed: " + text.trim());
+          } else if (text.toLowerCase().includes("password")) {
             alert("Password needs to meet requirements:\n- At least 8 characters\n- One uppercase letter\n- One lowercase letter\n- One number\n- One special character");
           } else {
             // Fallback for duplicate email or other errors
@@ -205,8 +245,9 @@ function attachAuthHandlers() {
           await checkAuth();
           // 🔹 CHANGED: Generic success message
           alert("Account created! You are now logged in.");
+        } else if (data.pendingApproval) {
+          alert("Account created. An admin needs to approve it before you can log in.");
         } else {
-          // This path might theoretically never hit now, but good to keep as fallback
           alert("Account created. Please log in.");
         }
       } catch (err) {
@@ -216,6 +257,8 @@ function attachAuthHandlers() {
     });
   }
 
+  loadSignupPolicy();
+
   // Okta login button
   const oktaLoginBtn = document.getElementById("oktaLoginBtn");
   if (oktaLoginBtn) {
@@ -1,6 +1,10 @@
 console.log("logicgrid builder.js loaded");
 
 
+// Shape of the protocol JSON generateJson writes (protocol.FormatVersion on
+// the server). Bump both together.
+const PROTOCOL_FORMAT_VERSION = 1;
+
 // -----------------------------
 // Standard namedFunctions snippets
 // -----------------------------
@@ -34,6 +38,11 @@ const addScoreFnBtn = document.getElementById("addScoreFnBtn");
 const refreshScoringColsBtn = document.getElementById("refreshScoringColsBtn");
 
 
+// Hand-written functions / rules carried over from an imported protocol.
+// The builder can't edit them; generateJson just passes them through.
+let customFunctions = [];
+let customRules = [];
+
 // Create a bottom "Add Trigger/Rule" button under the scoring section
 let addScoreFnBtnBottom = null;
 let scoringFooterRow = null;
@@ -1182,19 +1191,9 @@ function applyTemplate() {
         const bgSel = card.querySelector(".col-bg");
         if (bgSel) bgSel.value = col.backgroundColor || "#FFFFFF";
 
-        // ----- derive allowInt / allowStr / ranges / string options -----
-        let allowInt = col.allowInt;
-        let allowStr = col.allowStr;
-
-        if (allowInt === undefined || allowStr === undefined) {
-            const ints = (col.possibleValues || []).find(v => v.type === "integer");
-            const strs = (col.possibleValues || []).find(v => v.type === "string");
-            allowInt = allowInt ?? !!ints;
-            allowStr = allowStr ?? !!strs;
-            col.intMin = col.intMin ?? (ints ? ints.min : null);
-            col.intMax = col.intMax ?? (ints ? ints.max : null);
-            col.strOptions = col.strOptions ?? (strs ? (strs.options || []) : []);
-        }
+        // ----- allowInt / allowStr / ranges / string options -----
+        const allowInt = !!col.allowInt;
+        const allowStr = !!col.allowStr;
 
         const intMinInput = card.querySelector(".col-intmin");
         const intMaxInput = card.querySelector(".col-intmax");
@@ -1346,19 +1345,9 @@ function applyProtocolToUI(protocol) {
         if (bgSel) bgSel.value = col.backgroundColor || "#FFFFFF";
 
         // ----- value type + ranges/options -----
-        // derive allowInt/allowStr if missing (for old saves)
-        let allowInt = col.allowInt;
-        let allowStr = col.allowStr;
-
-        if (allowInt === undefined || allowStr === undefined) {
-            const ints = (col.possibleValues || []).find(v => v.type === "integer");
-            const strs = (col.possibleValues || []).find(v => v.type === "string");
-            allowInt = allowInt ?? !!ints;
-            allowStr = allowStr ?? !!strs;
-            col.intMin = col.intMin ?? (ints ? ints.min : null);
-            col.intMax = col.intMax ?? (ints ? ints.max : null);
-            col.strOptions = col.strOptions ?? (strs ? (strs.options || []) : []);
-        }
+        // The server upgrades old saves, so the hints are always present.
+        const allowInt = !!col.allowInt;
+        const allowStr = !!col.allowStr;
 
         const intMinInput = card.querySelector(".col-intmin");
         const intMaxInput = card.querySelector(".col-intmax");
@@ -1473,6 +1462,10 @@ function applyProtocolToUI(protocol) {
         }
     }
 
+    // 3) Custom code kept from an import
+    customFunctions = Array.isArray(protocol.customFunctions) ? protocol.customFunctions : [];
+    customRules = Array.isArray(protocol.customRules) ? protocol.customRules : [];
+
 }
 
 function setSelectValueCaseInsensitive(select, value) {
@@ -2194,17 +2187,28 @@ function generateJson() {
         return null;
     }
 
+    // ---- custom code from an import, passed through as-is ----
+    customFunctions.forEach((fn) => {
+        if (!(fn.name in namedFunctions)) {
+            namedFunctions[fn.name] = fn.body;
+        }
+    });
+    customRules.forEach((rule) => calculationRules.push(rule));
+
     const fullProtocol = {
         protocol_id: protocolId,
         version_number: versionNumber,
+        format_version: PROTOCOL_FORMAT_VERSION,
         columns: columns,
         namedFunctions: namedFunctions,
         calculationRules: calculationRules,
         // UI-only meta (we keep this in DB but NOT in exported JSON):
         scoringConfigs: scoringConfigs
     };
+    if (customFunctions.length) fullProtocol.customFunctions = customFunctions;
+    if (customRules.length) fullProtocol.customRules = customRules;
 
-    // What the user sees / copies for Xtract:
+    // Preview in the output box; Xtract gets the approved version instead
     const exportProtocol = stripUiMeta(fullProtocol);
 
     if (output) {
@@ -3048,11 +3052,13 @@ function applyAiSetProtocolMetaAction(action) {
         lastLoadedName = action.name;
     }
 
-    // Protocol id / record id
+    // Protocol id / record id (its version is unknown until it is loaded)
     if (action.protocolId != null) {
         lastProtocolId = action.protocolId;
+        lastProtocolVersion = null;
     } else if (action.id != null) {
         lastProtocolId = action.id;
+        lastProtocolVersion = null;
     }
 }
 
@@ -0,0 +1,27 @@
+// csrf.js
+// The server wants the csrf_token cookie echoed back in an X-CSRF-Token
+// header on every POST / PUT / PATCH / DELETE. Load this before the other
+// scripts so every fetch to our own origin carries it.
+(function () {
+  const SAFE_METHODS = ["GET", "HEAD", "OPTIONS"];
+
+  function csrfToken() {
+    const match = document.cookie.match(/(?:^|;\s*)csrf_token=([^;]*)/);
+    return match ? decodeURIComponent(match[1]) : "";
+  }
+
+  const originalFetch = window.fetch.bind(window);
+
+  window.fetch = function (input, init = {}) {
+    const method = (init.method || (input instanceof Request ? input.method : "GET")).toUpperCase();
+    const url = new URL(input instanceof Request ? input.url : input, window.location.href);
+
+    if (SAFE_METHODS.includes(method) || url.origin !== window.location.origin) {
+      return originalFetch(input, init);
+    }
+
+    const headers = new Headers(init.headers || (input instanceof Request ? input.headers : undefined));
+    headers.set("X-CSRF-Token", csrfToken());
+    return originalFetch(input, { ...init, headers });
+  };
+})();
@@ -4,12 +4,16 @@ console.log("protocols.js loaded");
 // These are shared between builder & auth
 let lastProtocolId = null;
 let lastLoadedName = null;
+let lastProtocolVersion = null; // head version we loaded/saved (sent as If-Match)
+let lastApprovedVersion = null; // the loaded protocol's exportable version, if any
 
 // DOM references that relate to protocols specifically
 const protocolNameInput = document.getElementById("protocolName");
 const saveProtocolBtn = document.getElementById("saveProtocolBtn");
 const savedProtocolsSelect = document.getElementById("savedProtocols");
 const loadProtocolBtn = document.getElementById("loadProtocolBtn");
+const importProtocolBtn = document.getElementById("importProtocolBtn");
+const exportApprovedBtn = document.getElementById("exportApprovedBtn");
 
 // --- Saving current protocol to backend ---
 
@@ -38,20 +42,57 @@ async function saveCurrentProtocol() {
   if (lastLoadedName && name !== lastLoadedName) {
     idToSend = 0;          // force create new
     lastProtocolId = null; // clear local pointer
+    lastProtocolVersion = null;
+    lastApprovedVersion = null;
+    refreshExportApprovedBtn();
+  }
+
+  const headers = { "Content-Type": "application/json" };
+  if (idToSend && lastProtocolVersion) {
+    headers["If-Match"] = `"v${lastProtocolVersion}"`;
   }
 
   try {
     const res = await fetch("/api/protocols", {
       method: "POST",
-      headers: { "Content-Type": "application/json" },
+      headers,
       credentials: "include",
       body: JSON.stringify({
         id: idToSend,
         name,
-        data: JSON.stringify(fullProtocol),
+        data: fullProtocol,
       }),
     });
 
+    if (res.status === 422) {
+      const body = await res.json();
+      const problems = (body.problems || [])
+        .map((p) => `• ${p.path}: ${p.message}`)
+        .join("\n");
+      alert(`Protocol has problems and was not saved:\n${problems}`);
+      return;
+    }
+
+    if (res.status === 428) {
+      alert("Load this protocol before saving over it, so newer changes are not lost.");
+      return;
+    }
+
+    if (res.status === 409) {
+      // Someone saved a newer version since we loaded it
+      const body = await res.json();
+      const current = body.current || {};
+      const overwrite = confirm(
+        `"${current.name || name}" was changed by someone else (now version ${current.version}).\n\n` +
+          "OK: save your changes on top of it.\nCancel: keep editing without saving."
+      );
+      if (overwrite && current.version) {
+        lastProtocolVersion = current.version;
+        await saveCurrentProtocol();
+      }
+      return;
+    }
+
     if (!res.ok) {
       const text = await res.text();
       console.error("save protocol error body:", text);
@@ -63,6 +104,7 @@ async function saveCurrentProtocol() {
     if (respJson.id) {
       lastProtocolId = respJson.id;
       lastLoadedName = name;
+      lastProtocolVersion = respJson.version || null;
     }
 
     alert("Protocol saved.");
@@ -102,10 +144,17 @@ async function fetchSavedProtocols() {
       opt.value = p.id;
 
       let label = p.name || "(unnamed protocol)";
-      if (p.is_public) {
+      if (p.shared_with_me) {
+        label = "👥 " + label + (p.shared_with_me === "edit" ? " (shared, can edit)" : " (shared, read-only)");
+      } else if (p.is_public) {
         label = "🌍 " + label;
       }
 
+      if (p.status === "approved") {
+        label += " ✓";
+      } else if (p.status === "in_review") {
+        label += " (in review)";
+      }
       opt.textContent = label;
       savedProtocolsSelect.appendChild(opt);
     });
@@ -149,24 +198,21 @@ async function loadProtocolById(id) {
 
     lastProtocolId = p.id || null;
     lastLoadedName = p.name || null;
+    lastProtocolVersion = p.version || null;
+    lastApprovedVersion = p.status !== "retired" ? p.approved_version || null : null;
+    refreshExportApprovedBtn();
 
     if (protocolNameInput) {
       protocolNameInput.value = p.name || "";
     }
 
-    let protocol;
-    try {
-      protocol = JSON.parse(p.data || "{}");
-    } catch (err) {
-      console.error("Saved protocol JSON is invalid:", err);
-      alert("Saved protocol JSON is invalid; see console.");
-      return;
-    }
+    // Server returns the parsed protocol object
+    const protocol = p.data || {};
 
     // Hand off to builder
     applyProtocolToUI(protocol); // from builder.js
 
-    // Xtract-safe export JSON (no scoringConfigs)
+    // Preview of the head without UI meta; Xtract gets the approved version
     if (output) {
       const exportProtocol = stripUiMeta(protocol);
       output.value = JSON.stringify(exportProtocol, null, 2);
@@ -188,6 +234,86 @@ async function loadProtocolById(id) {
   }
 }
 
+// --- Export the approved version for Xtract ---
+
+// Only approved versions go to Xtract, so the builder offers the server's
+// export of the loaded protocol's approved version, never its own preview.
+function refreshExportApprovedBtn() {
+  if (!exportApprovedBtn) return;
+  if (lastProtocolId && lastApprovedVersion) {
+    exportApprovedBtn.textContent = `Export approved v${lastApprovedVersion}`;
+    exportApprovedBtn.style.display = "";
+  } else {
+    exportApprovedBtn.style.display = "none";
+  }
+}
+
+function exportApprovedProtocol() {
+  if (!lastProtocolId || !lastApprovedVersion) return;
+  window.open(`/api/protocols/${encodeURIComponent(lastProtocolId)}/export`, "_blank");
+}
+
+// --- Import hand-written Xtract JSON pasted into the output box ---
+
+async function importXtractProtocol() {
+  const text = output ? output.value.trim() : "";
+  if (!text) {
+    alert("Paste the Xtract JSON into the box below first.");
+    return;
+  }
+
+  let data;
+  try {
+    data = JSON.parse(text);
+  } catch (err) {
+    alert("That is not valid JSON: " + err.message);
+    return;
+  }
+
+  const name = prompt("Name for the imported protocol:", (protocolNameInput && protocolNameInput.value.trim()) || "");
+  if (!name) return;
+
+  try {
+    const res = await fetch("/api/protocols/import", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      credentials: "include",
+      body: JSON.stringify({ name, data }),
+    });
+
+    if (res.status === 422) {
+      const body = await res.json();
+      const problems = (body.problems || [])
+        .map((p) => `• ${p.path}: ${p.message}`)
+        .join("\n");
+      alert(`Protocol has problems and was not imported:\n${problems}`);
+      return;
+    }
+
+    if (!res.ok) {
+      const text = await res.text();
+      console.error("import protocol error body:", text);
+      alert("Failed to import protocol (see console).");
+      return;
+    }
+
+    const respJson = await res.json();
+    await fetchSavedProtocols();
+    await loadProtocolById(respJson.id);
+
+    const report = respJson.report || {};
+    const lines = [`Imported ${report.scoringConfigs || 0} scoring function(s) as editable rules.`];
+    (report.customFunctions || []).forEach((fn) => {
+      lines.push(`• ${fn.name} kept as custom code: ${fn.reason}`);
+    });
+    (report.warnings || []).forEach((w) => lines.push(`• ${w}`));
+    alert(lines.join("\n"));
+  } catch (err) {
+    console.error("importXtractProtocol error:", err);
+    alert("Failed to import protocol (network error).");
+  }
+}
+
 // --- Strip UI-only metadata before export ---
 
 function stripUiMeta(fullProtocol) {
@@ -244,3 +370,9 @@ if (saveProtocolBtn) {
 if (loadProtocolBtn) {
   loadProtocolBtn.addEventListener("click", loadSelectedProtocol);
 }
+if (importProtocolBtn) {
+  importProtocolBtn.addEventListener("click", importXtractProtocol);
+}
+if (exportApprovedBtn) {
+  exportApprovedBtn.addEventListener("click", exportApprovedProtocol);
+}
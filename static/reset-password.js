@@ -0,0 +1,90 @@
+// reset-password.js
+console.log("reset-password.js loaded");
+
+const forgotSection = document.getElementById("forgotSection");
+const resetSection = document.getElementById("resetSection");
+const forgotPasswordForm = document.getElementById("forgotPasswordForm");
+const resetPasswordForm = document.getElementById("resetPasswordForm");
+
+// The emailed link carries ?token=...; keep it in memory and take it out of
+// the address bar so it doesn't linger in history.
+const resetToken = new URLSearchParams(window.location.search).get("token");
+if (resetToken) {
+  window.history.replaceState(null, "", window.location.pathname);
+  if (forgotSection) forgotSection.style.display = "none";
+  if (resetSection) resetSection.style.display = "";
+}
+
+// ---------- Step 1: request a link ----------
+
+if (forgotPasswordForm) {
+  forgotPasswordForm.addEventListener("submit", async (e) => {
+    e.preventDefault();
+
+    const email = document.getElementById("forgotEmail").value.trim();
+    if (!email) {
+      alert("Please enter your email.");
+      return;
+    }
+
+    try {
+      const res = await fetch("/forgot-password", {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        credentials: "include",
+        body: JSON.stringify({ email }),
+      });
+
+      if (!res.ok) {
+        const text = await res.text();
+        console.error("forgot-password error:", res.status, text);
+        alert("Failed to send reset link (see console).");
+        return;
+      }
+
+      alert("If an account uses that email, a reset link is on its way.");
+      forgotPasswordForm.reset();
+    } catch (err) {
+      console.error("forgotPasswordForm error:", err);
+      alert("Failed to send reset link (network error).");
+    }
+  });
+}
+
+// ---------- Step 2: set the new password ----------
+
+if (resetPasswordForm) {
+  resetPasswordForm.addEventListener("submit", async (e) => {
+    e.preventDefault();
+
+    const newPassword = document.getElementById("resetNewPassword").value;
+    const confirmPassword = document.getElementById("resetConfirmPassword").value;
+
+    if (newPassword !== confirmPassword) {
+      alert("New passwords do not match.");
+      return;
+    }
+
+    try {
+      const res = await fetch("/reset-password", {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        credentials: "include",
+        body: JSON.stringify({ token: resetToken, newPassword }),
+      });
+
+      if (!res.ok) {
+        const text = await res.text();
+        console.error("reset-password error:", res.status, text);
+        alert(res.status === 400 ? text || "Invalid request." : "Failed to reset password (see console).");
+        return;
+      }
+
+      alert("Password updated. Please log in with your new password.");
+      window.location.href = "/";
+    } catch (err) {
+      console.error("resetPasswordForm error:", err);
+      alert("Failed to reset password (network error).");
+    }
+  });
+}
@@ -0,0 +1,123 @@
+console.log("shared.js loaded");
+
+// Read-only view of a protocol opened through a share link (/shared/{token}).
+
+const sharedNameEl = document.getElementById("sharedName");
+const sharedMetaEl = document.getElementById("sharedMeta");
+const sharedColumnsSection = document.getElementById("sharedColumnsSection");
+const sharedColumnsEl = document.getElementById("sharedColumns");
+const sharedDownload = document.getElementById("sharedDownload");
+const sharedFunctionsSection = document.getElementById("sharedFunctionsSection");
+const sharedFunctionsEl = document.getElementById("sharedFunctions");
+const sharedJsonSection = document.getElementById("sharedJsonSection");
+const sharedJsonEl = document.getElementById("sharedJson");
+
+function sharedToken() {
+  const parts = window.location.pathname.split("/").filter(Boolean);
+  return parts.length === 2 && parts[0] === "shared" ? parts[1] : "";
+}
+
+function describeValues(values) {
+  return (values || [])
+    .map((v) => {
+      if (v.type === "integer") {
+        const min = v.min != null ? v.min : "";
+        const max = v.max != null ? v.max : "";
+        return min !== "" || max !== "" ? `integers ${min}–${max}` : "integers";
+      }
+      if (v.type === "string") {
+        return (v.options || []).join(", ");
+      }
+      return v.type;
+    })
+    .join("; ");
+}
+
+function renderSharedProtocol(shared) {
+  const protocol = shared.protocol || {};
+
+  document.title = `${shared.name} (shared protocol)`;
+  sharedNameEl.textContent = shared.name || "(unnamed protocol)";
+  sharedMetaEl.textContent = `Approved version ${shared.version} · ${shared.status} · read-only`;
+
+  sharedColumnsEl.innerHTML = "";
+  (protocol.columns || []).forEach((col) => {
+    const row = document.createElement("div");
+    row.className = "protocol-row";
+
+    const main = document.createElement("div");
+    main.className = "protocol-main";
+
+    const title = document.createElement("div");
+    title.className = "protocol-title";
+    title.textContent = `${col.name} (${col.abbr})`;
+    if (col.backgroundColor) {
+      title.style.borderLeft = `8px solid ${col.backgroundColor}`;
+      title.style.paddingLeft = "6px";
+    }
+
+    const meta = document.createElement("div");
+    meta.className = "protocol-meta";
+    const bits = [`id: ${col.id}`];
+    if (col.possibleValues) bits.push(`values: ${describeValues(col.possibleValues)}`);
+    if (col.positiveValues) bits.push(`positive: ${describeValues(col.positiveValues)}`);
+    if (col.autoFill) bits.push(`auto-fill: ${col.autoFill.value}`);
+    if (col.useAsStartingDilution) bits.push("starting dilution");
+    if (col.showWhenPrescribing) bits.push("shown when prescribing");
+    meta.textContent = bits.join(" · ");
+
+    main.appendChild(title);
+    main.appendChild(meta);
+    row.appendChild(main);
+    sharedColumnsEl.appendChild(row);
+  });
+  sharedColumnsSection.style.display = "block";
+
+  sharedFunctionsEl.innerHTML = "";
+  Object.entries(protocol.namedFunctions || {}).forEach(([name, body]) => {
+    const h = document.createElement("h3");
+    h.textContent = name;
+    const pre = document.createElement("pre");
+    pre.textContent = body;
+    pre.style.fontSize = "12px";
+    pre.style.whiteSpace = "pre-wrap";
+    sharedFunctionsEl.appendChild(h);
+    sharedFunctionsEl.appendChild(pre);
+  });
+  sharedFunctionsSection.style.display = "block";
+
+  sharedJsonEl.value = JSON.stringify(protocol, null, 2);
+  sharedJsonSection.style.display = "block";
+}
+
+async function loadSharedProtocol() {
+  const token = sharedToken();
+  if (!token) {
+    sharedMetaEl.textContent = "This link is not valid.";
+    return;
+  }
+
+  sharedDownload.href = `/api/shared/${encodeURIComponent(token)}/export`;
+
+  try {
+    const res = await fetch(`/api/shared/${encodeURIComponent(token)}`);
+    if (!res.ok) {
+      if (res.status === 404) {
+        sharedMetaEl.textContent = "This link is invalid, has been revoked, or has expired.";
+      } else if (res.status === 409) {
+        sharedMetaEl.textContent = "This protocol has no approved version to share yet.";
+        sharedDownload.style.display = "none";
+      } else {
+        sharedMetaEl.textContent = "Failed to load the protocol. Please try again.";
+      }
+      return;
+    }
+
+    renderSharedProtocol(await res.json());
+  } catch (err) {
+    console.error("loadSharedProtocol error:", err);
+    sharedMetaEl.textContent = "Failed to load the protocol (network error).";
+  }
+}
+
+document.addEventListener("DOMContentLoaded", loadSharedProtocol);